@@ -0,0 +1,376 @@
+package analytics
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 播放端按tag到达时间统计：到达间隔、同类型tag的到达抖动(RFC 3550)、到达时间相对媒体时间戳的偏移、
+// 卡顿、滑动窗口内的音视频码率和帧率，结束时输出带分位数的汇总
+
+const (
+	audioTag = 8
+	videoTag = 9
+)
+
+// Options 统计参数
+type Options struct {
+	// StallGap 视频帧的到达间隔比时间戳间隔多出StallGap以上时记为一次卡顿
+	StallGap time.Duration
+	// Window 码率和帧率的滑动窗口
+	Window time.Duration
+}
+
+func (o *Options) AddFlags() {
+	flag.DurationVar(&o.StallGap, "stallGap", 500*time.Millisecond, "a video frame later than its timestamp gap by more than this is a stall")
+	flag.DurationVar(&o.Window, "window", 2*time.Second, "sliding window of the audio/video bitrate and frame rate")
+}
+
+// Sample 一个tag的统计结果，时间单位都是毫秒
+type Sample struct {
+	IntervalMs float64 // 与上一个tag的到达间隔
+	JitterMs   float64 // 同类型tag的平滑到达抖动
+	DelayMs    float64 // 到达时间减媒体时间戳，相对目前为止的最小值，即网络造成的额外延迟
+	StallMs    float64 // 大于0时表示这个视频帧之前卡顿了多久
+	Player     PlayerUpdate
+	Latency    *LatencySample // tag中带有时间标记时不为nil
+}
+
+// WindowStats 滑动窗口内的码率和帧率
+type WindowStats struct {
+	AudioKbps float64
+	VideoKbps float64
+	Fps       float64
+}
+
+func (w WindowStats) String() string {
+	return fmt.Sprintf("audio:%.1fkbps, video:%.1fkbps, fps:%.1f", w.AudioKbps, w.VideoKbps, w.Fps)
+}
+
+// Percentiles 一组数值的分位数
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func (p Percentiles) String() string {
+	return fmt.Sprintf("p50:%.1f, p95:%.1f, p99:%.1f, max:%.1f", p.P50, p.P95, p.P99, p.Max)
+}
+
+// Summary 整个播放过程的汇总
+type Summary struct {
+	DurationMs    float64       `json:"duration_ms"` // 第一个tag到最后一个tag的到达时间
+	Tags          int64         `json:"tags"`
+	VideoFrames   int64         `json:"video_frames"`
+	Bytes         int64         `json:"bytes"`
+	AudioKbps     float64       `json:"audio_kbps"`
+	VideoKbps     float64       `json:"video_kbps"`
+	Fps           float64       `json:"fps"`
+	IntervalMs    Percentiles   `json:"interval_ms"`
+	DelayMs       Percentiles   `json:"delay_ms"` // 相对整个过程的最小偏移
+	AudioJitterMs float64       `json:"audio_jitter_ms"`
+	VideoJitterMs float64       `json:"video_jitter_ms"`
+	Stalls        int           `json:"stalls"`
+	StallMs       float64       `json:"stall_ms"`
+	MaxStallMs    float64       `json:"max_stall_ms"`
+	WindowFps     Percentiles   `json:"window_fps"` // 窗口填满之后每个视频帧到达时的窗口帧率
+	MinWindowFps  float64       `json:"min_window_fps"`
+	Player        *PlayerStats  `json:"player,omitempty"`
+	Latency       *LatencyStats `json:"latency,omitempty"` // 收到过时间标记时不为nil
+}
+
+// Print 输出多行的汇总
+func (s Summary) Print(w io.Writer) {
+	fmt.Fprintf(w, "flv summary, duration:%.1fms, tags:%d, video frames:%d, bytes:%d\n", s.DurationMs, s.Tags, s.VideoFrames, s.Bytes)
+	fmt.Fprintf(w, "  bitrate, audio:%.1fkbps, video:%.1fkbps, fps:%.1f, window fps min:%.1f, %s\n", s.AudioKbps, s.VideoKbps, s.Fps, s.MinWindowFps, s.WindowFps)
+	fmt.Fprintf(w, "  interval ms, %s\n", s.IntervalMs)
+	fmt.Fprintf(w, "  delay ms, %s\n", s.DelayMs)
+	fmt.Fprintf(w, "  jitter, audio:%.1fms, video:%.1fms\n", s.AudioJitterMs, s.VideoJitterMs)
+	fmt.Fprintf(w, "  stalls:%d, stall time:%.1fms, max stall:%.1fms\n", s.Stalls, s.StallMs, s.MaxStallMs)
+	if s.Player != nil {
+		fmt.Fprintf(w, "  player, %s\n", s.Player)
+	}
+	if s.Latency != nil {
+		fmt.Fprintf(w, "  latency ms, %s\n", s.Latency)
+	}
+}
+
+// windowEntry 滑动窗口中的一个tag
+type windowEntry struct {
+	arrival time.Time
+	tagType uint8
+	size    int
+	frame   bool
+}
+
+// typeState 同类型tag上一次的到达时间和时间戳
+type typeState struct {
+	arrival   time.Time
+	timestamp uint32
+	jitter    float64
+}
+
+// Analyzer 按到达顺序统计一路flv流，可以在多个goroutine中调用
+type Analyzer struct {
+	Options
+	// Player 不为nil时同时把tag送入模拟播放器，汇总中带上播放结果
+	Player *Player
+	// Latency 不为nil时从tag中取出推流端插入的时间标记，计算端到端时延
+	Latency *LatencyMeter
+
+	lock         sync.Mutex
+	first        time.Time
+	firstTs      uint32
+	last         time.Time
+	minOffset    float64
+	audio        typeState
+	video        typeState
+	window       []windowEntry
+	intervals    []float64
+	offsets      []float64
+	windowFps    []float64
+	tags         int64
+	videoFrames  int64
+	bytes        int64
+	audioBytes   int64
+	videoBytes   int64
+	stalls       int
+	stallMs      float64
+	maxStallMs   float64
+	minWindowFps float64
+}
+
+func NewAnalyzer(options Options) *Analyzer {
+	return &Analyzer{Options: options}
+}
+
+// isVideoFrame 视频tag中除AVC/HEVC sequence header以外的都算一帧
+func isVideoFrame(body []byte) bool {
+	if len(body) < 2 {
+		return false
+	}
+	codecId := body[0] & 0x0f
+	return !((codecId == 7 || codecId == 12) && body[1] == 0)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Add 收到一个tag时调用
+func (a *Analyzer) Add(tagType uint8, timestamp uint32, body []byte) Sample {
+	return a.AddAt(time.Now(), tagType, timestamp, body)
+}
+
+// AddAt 指定到达时间，用于回放记录下来的到达时间
+func (a *Analyzer) AddAt(arrival time.Time, tagType uint8, timestamp uint32, body []byte) Sample {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var sample Sample
+	if a.Player != nil {
+		sample.Player = a.Player.AddAt(arrival, tagType, timestamp, body)
+	}
+	if a.Latency != nil {
+		if latencySample, ok := a.Latency.AddAt(arrival, tagType, body); ok {
+			sample.Latency = &latencySample
+		}
+	}
+	a.tags++
+	a.bytes += int64(len(body))
+	if !a.last.IsZero() {
+		sample.IntervalMs = milliseconds(arrival.Sub(a.last))
+		a.intervals = append(a.intervals, sample.IntervalMs)
+	}
+	a.last = arrival
+	if tagType != audioTag && tagType != videoTag {
+		return sample
+	}
+
+	if a.first.IsZero() {
+		a.first, a.firstTs = arrival, timestamp
+	}
+	// 服务端开播时会突发发送gop缓存，这些tag比时间戳提前到达，偏移取相对最小值
+	offset := milliseconds(arrival.Sub(a.first)) - float64(int64(timestamp)-int64(a.firstTs))
+	if len(a.offsets) == 0 || offset < a.minOffset {
+		a.minOffset = offset
+	}
+	a.offsets = append(a.offsets, offset)
+	sample.DelayMs = offset - a.minOffset
+
+	state := &a.audio
+	frame := false
+	if tagType == videoTag {
+		state = &a.video
+		frame = isVideoFrame(body)
+		a.videoBytes += int64(len(body))
+	} else {
+		a.audioBytes += int64(len(body))
+	}
+	if tagType == audioTag || frame {
+		if !state.arrival.IsZero() {
+			// RFC 3550：J += (|D| - J) / 16
+			d := milliseconds(arrival.Sub(state.arrival)) - float64(int64(timestamp)-int64(state.timestamp))
+			state.jitter += (math.Abs(d) - state.jitter) / 16
+			if frame && timestamp >= state.timestamp && d > milliseconds(a.StallGap) {
+				sample.StallMs = d
+				a.stalls++
+				a.stallMs += d
+				if d > a.maxStallMs {
+					a.maxStallMs = d
+				}
+			}
+		}
+		state.arrival, state.timestamp = arrival, timestamp
+		sample.JitterMs = state.jitter
+	}
+
+	// 每个tag都去掉窗口外的tag，只有音频或不输出窗口统计时窗口也不会一直增长
+	a.trimWindow(arrival)
+	a.window = append(a.window, windowEntry{arrival: arrival, tagType: tagType, size: len(body), frame: frame})
+	if frame {
+		a.videoFrames++
+		// 窗口填满之前的帧率不准，不计入统计
+		if arrival.Sub(a.first) >= a.Window {
+			fps := a.windowStats(arrival).Fps
+			a.windowFps = append(a.windowFps, fps)
+			if a.minWindowFps == 0 || fps < a.minWindowFps {
+				a.minWindowFps = fps
+			}
+		}
+	}
+	return sample
+}
+
+// WindowStats 当前滑动窗口内的码率和帧率
+func (a *Analyzer) WindowStats() WindowStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.windowStats(time.Now())
+}
+
+// trimWindow 去掉在now之前Window以外到达的tag
+func (a *Analyzer) trimWindow(now time.Time) {
+	begin := now.Add(-a.Window)
+	i := 0
+	for i < len(a.window) && a.window[i].arrival.Before(begin) {
+		i++
+	}
+	a.window = a.window[i:]
+}
+
+// windowStats 去掉窗口外的tag后计算，窗口没有填满时按实际时长计算
+func (a *Analyzer) windowStats(now time.Time) WindowStats {
+	a.trimWindow(now)
+	span := a.Window
+	if !a.first.IsZero() && now.Sub(a.first) < span {
+		span = now.Sub(a.first)
+	}
+	var stats WindowStats
+	if span <= 0 {
+		return stats
+	}
+	ms := milliseconds(span)
+	for _, entry := range a.window {
+		if entry.tagType == audioTag {
+			stats.AudioKbps += float64(entry.size) * 8 / ms
+		} else {
+			stats.VideoKbps += float64(entry.size) * 8 / ms
+		}
+		if entry.frame {
+			stats.Fps += 1000 / ms
+		}
+	}
+	return stats
+}
+
+// Summary 到目前为止的汇总
+func (a *Analyzer) Summary() Summary {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	summary := Summary{
+		Tags:          a.tags,
+		VideoFrames:   a.videoFrames,
+		Bytes:         a.bytes,
+		IntervalMs:    percentiles(a.intervals),
+		AudioJitterMs: a.audio.jitter,
+		VideoJitterMs: a.video.jitter,
+		Stalls:        a.stalls,
+		StallMs:       a.stallMs,
+		MaxStallMs:    a.maxStallMs,
+		WindowFps:     percentiles(a.windowFps),
+		MinWindowFps:  a.minWindowFps,
+	}
+	delays := make([]float64, len(a.offsets))
+	for i, offset := range a.offsets {
+		delays[i] = offset - a.minOffset
+	}
+	summary.DelayMs = percentiles(delays)
+	if a.Player != nil {
+		stats := a.Player.Stats()
+		summary.Player = &stats
+	}
+	if a.Latency != nil {
+		if stats := a.Latency.Stats(); stats.Samples > 0 {
+			summary.Latency = &stats
+		}
+	}
+	if !a.first.IsZero() {
+		summary.DurationMs = milliseconds(a.last.Sub(a.first))
+	}
+	if summary.DurationMs > 0 {
+		summary.AudioKbps = float64(a.audioBytes) * 8 / summary.DurationMs
+		summary.VideoKbps = float64(a.videoBytes) * 8 / summary.DurationMs
+		summary.Fps = float64(a.videoFrames) * 1000 / summary.DurationMs
+	}
+	return summary
+}
+
+// percentiles values为空时返回零值
+func percentiles(values []float64) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return Percentiles{
+		P50: Percentile(sorted, 50),
+		P95: Percentile(sorted, 95),
+		P99: Percentile(sorted, 99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+// Percentile sorted已排序，线性插值，sorted为空时返回0
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(pos-float64(lower))
+}
+
+// PrintOnInterrupt 收到Ctrl-C或SIGTERM时输出汇总后退出，探测程序通常一直读到被中断
+func (a *Analyzer) PrintOnInterrupt(w io.Writer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		a.Summary().Print(w)
+		os.Exit(0)
+	}()
+}
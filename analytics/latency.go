@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"quic_demo/latency"
+)
+
+// 推流端用-marker插入了时间标记时，播放端按收到标记时的墙钟减去标记中的发送时间计算端到端时延。
+// 服务端开播时发送的gop缓存中的sei标记也会被取出，这些标记的时延包含了缓存的时长
+
+// LatencySample 一个时间标记的端到端时延
+type LatencySample struct {
+	Seq       uint64
+	LatencyMs float64
+	Lost      uint64 // 与上一个标记之间缺少的序号数
+}
+
+func (s LatencySample) String() string {
+	return fmt.Sprintf("seq:%d, latency:%.1fms, lost:%d", s.Seq, s.LatencyMs, s.Lost)
+}
+
+// LatencyStats 所有时间标记的时延汇总
+type LatencyStats struct {
+	Samples   int         `json:"samples"`
+	Lost      uint64      `json:"lost"`
+	MinMs     float64     `json:"min_ms"`
+	MeanMs    float64     `json:"mean_ms"`
+	LatencyMs Percentiles `json:"latency_ms"`
+}
+
+func (s LatencyStats) String() string {
+	return fmt.Sprintf("samples:%d, lost:%d, min:%.1f, mean:%.1f, %s", s.Samples, s.Lost, s.MinMs, s.MeanMs, s.LatencyMs)
+}
+
+// LatencyMeter 从收到的tag中取出时间标记，可以在多个goroutine中调用
+type LatencyMeter struct {
+	lock      sync.Mutex
+	extractor latency.Extractor
+	nextSeq   uint64
+	lost      uint64
+	values    []float64
+}
+
+func NewLatencyMeter() *LatencyMeter {
+	return &LatencyMeter{}
+}
+
+// Add 收到一个tag时调用，tag中有时间标记时ok为true
+func (m *LatencyMeter) Add(tagType uint8, body []byte) (LatencySample, bool) {
+	return m.AddAt(time.Now(), tagType, body)
+}
+
+func (m *LatencyMeter) AddAt(arrival time.Time, tagType uint8, body []byte) (LatencySample, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	marker, ok := m.extractor.Extract(tagType, body)
+	if !ok {
+		return LatencySample{}, false
+	}
+	sample := LatencySample{
+		Seq:       marker.Seq,
+		LatencyMs: milliseconds(arrival.Sub(marker.SendTime)),
+	}
+	// 序号变小说明推流端重新开始了，不算丢失
+	if len(m.values) > 0 && marker.Seq > m.nextSeq {
+		sample.Lost = marker.Seq - m.nextSeq
+		m.lost += sample.Lost
+	}
+	m.nextSeq = marker.Seq + 1
+	m.values = append(m.values, sample.LatencyMs)
+	return sample, true
+}
+
+// Stats 没有收到过时间标记时Samples为0
+func (m *LatencyMeter) Stats() LatencyStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats := LatencyStats{
+		Samples:   len(m.values),
+		Lost:      m.lost,
+		LatencyMs: percentiles(m.values),
+	}
+	for i, value := range m.values {
+		if i == 0 || value < stats.MinMs {
+			stats.MinMs = value
+		}
+		stats.MeanMs += value / float64(len(m.values))
+	}
+	return stats
+}
@@ -0,0 +1,230 @@
+package analytics
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 模拟播放器的缓冲：缓冲够StartupBuffer的媒体时长后开始播放，播放位置按墙钟推进，
+// 位置追上收到的最大时间戳时缓冲耗尽进入卡顿，重新缓冲够RebufferBuffer后继续播放。
+// 到达时播放位置已经超过其时间戳的视频帧记为迟到帧，播放器会丢弃
+
+// PlayerOptions 模拟播放器的缓冲参数
+type PlayerOptions struct {
+	// StartupBuffer 开始播放前需要缓冲的媒体时长
+	StartupBuffer time.Duration
+	// RebufferBuffer 卡顿后恢复播放需要缓冲的媒体时长，0时与StartupBuffer相同
+	RebufferBuffer time.Duration
+}
+
+func (o *PlayerOptions) AddFlags() {
+	flag.DurationVar(&o.StartupBuffer, "startupBuffer", 500*time.Millisecond, "media buffered before the simulated player starts")
+	flag.DurationVar(&o.RebufferBuffer, "rebufferBuffer", 0, "media buffered before the simulated player resumes after running empty, 0 for startupBuffer")
+}
+
+const (
+	playerWaiting = iota
+	playerPlaying
+	playerRebuffering
+)
+
+// PlayerUpdate 一个tag到达时播放器状态的变化
+type PlayerUpdate struct {
+	Started    bool    // 开始播放
+	Rebuffered bool    // 在这个tag到达之前缓冲已经耗尽
+	Resumed    bool    // 卡顿后恢复播放
+	RebufferMs float64 // Resumed时这次卡顿的时长
+	BufferMs   float64 // 当前缓冲的媒体时长
+}
+
+// String 没有状态变化时为空
+func (u PlayerUpdate) String() string {
+	var events []string
+	if u.Started {
+		events = append(events, "player started")
+	}
+	if u.Rebuffered {
+		events = append(events, "player rebuffering")
+	}
+	if u.Resumed {
+		events = append(events, fmt.Sprintf("player resumed after %.1fms", u.RebufferMs))
+	}
+	if len(events) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s, buffer:%.1fms", strings.Join(events, ", "), u.BufferMs)
+}
+
+// PlayerStats 模拟播放的结果
+type PlayerStats struct {
+	StartupMs     float64 `json:"startup_ms"` // 从开始请求到开始播放，没有开始播放时为到目前的时长
+	Started       bool    `json:"started"`
+	PlayMs        float64 `json:"play_ms"`
+	Rebuffers     int     `json:"rebuffers"`
+	RebufferMs    float64 `json:"rebuffer_ms"`
+	RebufferRatio float64 `json:"rebuffer_ratio"` // 卡顿时长占开始播放之后时长的比例
+	Frames        int64   `json:"frames"`
+	LateFrames    int64   `json:"late_frames"`
+	QoE           float64 `json:"qoe"`
+}
+
+func (s PlayerStats) String() string {
+	return fmt.Sprintf("startup:%.1fms, rebuffers:%d, rebuffer:%.1fms, ratio:%.2f%%, late frames:%d/%d, qoe:%.1f",
+		s.StartupMs, s.Rebuffers, s.RebufferMs, s.RebufferRatio*100, s.LateFrames, s.Frames, s.QoE)
+}
+
+// QoE 0到100的综合评分，各项扣分有上限：
+// 首帧每秒扣5分(最多25)，卡顿比例每1%扣4分(最多40)，每分钟每次卡顿扣8分(最多25)，迟到帧每1%扣1分(最多10)。
+// 没有开始播放时为0
+func (s PlayerStats) qoe() float64 {
+	if !s.Started {
+		return 0
+	}
+	score := 100.0
+	score -= math.Min(25, 5*s.StartupMs/1000)
+	score -= math.Min(40, 4*s.RebufferRatio*100)
+	if sessionMs := s.PlayMs + s.RebufferMs; sessionMs > 0 {
+		score -= math.Min(25, 8*float64(s.Rebuffers)/(sessionMs/60000))
+	}
+	if s.Frames > 0 {
+		score -= math.Min(10, float64(s.LateFrames)*100/float64(s.Frames))
+	}
+	return math.Max(0, score)
+}
+
+// Player 模拟播放器，tag的到达时间需要单调不减
+type Player struct {
+	PlayerOptions
+
+	lock          sync.Mutex
+	begin         time.Time
+	state         int
+	firstTs       int64
+	latestTs      int64   // 收到的最大音视频时间戳
+	position      float64 // 等待或卡顿时的播放位置，毫秒
+	playWall      time.Time
+	playTs        float64 // 本段播放开始时的播放位置
+	rebufferStart time.Time
+	stats         PlayerStats
+}
+
+// NewPlayer begin为开始请求的时间，首帧时间从这里算
+func NewPlayer(options PlayerOptions, begin time.Time) *Player {
+	if options.RebufferBuffer == 0 {
+		options.RebufferBuffer = options.StartupBuffer
+	}
+	return &Player{
+		PlayerOptions: options,
+		begin:         begin,
+		firstTs:       -1,
+	}
+}
+
+// Add 收到一个tag时调用
+func (p *Player) Add(tagType uint8, timestamp uint32, body []byte) PlayerUpdate {
+	return p.AddAt(time.Now(), tagType, timestamp, body)
+}
+
+func (p *Player) AddAt(arrival time.Time, tagType uint8, timestamp uint32, body []byte) PlayerUpdate {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var update PlayerUpdate
+	if tagType != audioTag && tagType != videoTag {
+		return update
+	}
+	update.Rebuffered = p.advance(arrival)
+
+	ts := int64(timestamp)
+	if p.firstTs < 0 {
+		p.firstTs, p.latestTs = ts, ts
+		p.position = float64(ts)
+	}
+	if tagType == videoTag && isVideoFrame(body) {
+		p.stats.Frames++
+		if p.state == playerPlaying && float64(ts) < p.positionAt(arrival) {
+			p.stats.LateFrames++
+		}
+	}
+	if ts > p.latestTs {
+		p.latestTs = ts
+	}
+
+	switch p.state {
+	case playerWaiting:
+		if p.buffered(p.position) >= p.StartupBuffer {
+			p.stats.Started = true
+			p.stats.StartupMs = milliseconds(arrival.Sub(p.begin))
+			p.play(arrival)
+			update.Started = true
+		}
+	case playerRebuffering:
+		if p.buffered(p.position) >= p.RebufferBuffer {
+			update.RebufferMs = milliseconds(arrival.Sub(p.rebufferStart))
+			p.stats.RebufferMs += update.RebufferMs
+			p.play(arrival)
+			update.Resumed = true
+		}
+	}
+	update.BufferMs = milliseconds(p.buffered(p.positionAt(arrival)))
+	return update
+}
+
+func (p *Player) buffered(position float64) time.Duration {
+	return time.Duration((float64(p.latestTs) - position) * float64(time.Millisecond))
+}
+
+// positionAt 播放中按墙钟推进，等待和卡顿时停在position
+func (p *Player) positionAt(now time.Time) float64 {
+	if p.state != playerPlaying {
+		return p.position
+	}
+	return p.playTs + milliseconds(now.Sub(p.playWall))
+}
+
+func (p *Player) play(now time.Time) {
+	p.state = playerPlaying
+	p.playWall, p.playTs = now, p.position
+}
+
+// advance 推进到now，播放位置追上最大时间戳时从追上的时刻开始卡顿，返回是否进入了卡顿
+func (p *Player) advance(now time.Time) bool {
+	if p.state != playerPlaying || p.positionAt(now) < float64(p.latestTs) {
+		return false
+	}
+	emptyAt := p.playWall.Add(time.Duration((float64(p.latestTs) - p.playTs) * float64(time.Millisecond)))
+	p.stats.PlayMs += milliseconds(emptyAt.Sub(p.playWall))
+	p.stats.Rebuffers++
+	p.position = float64(p.latestTs)
+	p.rebufferStart = emptyAt
+	p.state = playerRebuffering
+	return true
+}
+
+// Stats 到目前为止的结果，正在播放或卡顿的这一段算到now
+func (p *Player) Stats() PlayerStats {
+	return p.StatsAt(time.Now())
+}
+
+func (p *Player) StatsAt(now time.Time) PlayerStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.advance(now)
+	stats := p.stats
+	switch p.state {
+	case playerWaiting:
+		stats.StartupMs = milliseconds(now.Sub(p.begin))
+	case playerPlaying:
+		stats.PlayMs += milliseconds(now.Sub(p.playWall))
+	case playerRebuffering:
+		stats.RebufferMs += milliseconds(now.Sub(p.rebufferStart))
+	}
+	if total := stats.PlayMs + stats.RebufferMs; total > 0 {
+		stats.RebufferRatio = stats.RebufferMs / total
+	}
+	stats.QoE = stats.qoe()
+	return stats
+}
@@ -0,0 +1,173 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"quic_demo/analytics"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunResult 一次运行的结果
+type RunResult struct {
+	Protocol  string `json:"protocol"`  // rtmp/httpflv
+	Transport string `json:"transport"` // tcp/tls/quic
+	Run       int    `json:"run"`
+	Error     string `json:"error,omitempty"`
+	Metrics
+}
+
+// Summary 一组数值的统计
+type Summary struct {
+	Median float64 `json:"median"`
+	P95    float64 `json:"p95"`
+	Mean   float64 `json:"mean"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+// Summarize 计算中位数、p95等，values为空时返回零值
+func Summarize(values []float64) Summary {
+	if len(values) == 0 {
+		return Summary{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	return Summary{
+		Median: analytics.Percentile(sorted, 50),
+		P95:    analytics.Percentile(sorted, 95),
+		Mean:   sum / float64(len(sorted)),
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+	}
+}
+
+// Group 同一协议和传输层的多次运行的汇总
+type Group struct {
+	Protocol   string  `json:"protocol"`
+	Transport  string  `json:"transport"`
+	Runs       int     `json:"runs"`
+	Failures   int     `json:"failures"`
+	StartupMs  Summary `json:"startup_ms"`
+	Stalls     Summary `json:"stalls"`
+	StallMs    Summary `json:"stall_ms"`
+	LatencyMs  Summary `json:"latency_ms"`
+	Throughput Summary `json:"throughput_kbps"`
+	Rebuffers  Summary `json:"rebuffers"`
+	QoE        Summary `json:"qoe"`
+}
+
+// Report 整个测试的报告
+type Report struct {
+	FileName string      `json:"file_name"`
+	Duration string      `json:"duration"`
+	Repeat   int         `json:"repeat"`
+	Impair   string      `json:"impair"` // 损伤参数，为空表示没有经过损伤代理
+	Begin    time.Time   `json:"begin"`
+	Groups   []Group     `json:"groups"`
+	Results  []RunResult `json:"results"`
+}
+
+// AddResult 添加一次运行的结果
+func (r *Report) AddResult(result RunResult) {
+	r.Results = append(r.Results, result)
+}
+
+// groupValues 一组成功运行的各项指标
+type groupValues struct {
+	startupMs  []float64
+	stalls     []float64
+	stallMs    []float64
+	latencyMs  []float64
+	throughput []float64
+	rebuffers  []float64
+	qoe        []float64
+}
+
+// Summarize 按协议和传输层汇总，顺序与结果第一次出现的顺序一致，失败的运行不计入统计
+func (r *Report) Summarize() {
+	r.Groups = nil
+	index := make(map[string]int)
+	var values []*groupValues
+	for _, result := range r.Results {
+		key := result.Protocol + "/" + result.Transport
+		i, ok := index[key]
+		if !ok {
+			i = len(r.Groups)
+			index[key] = i
+			r.Groups = append(r.Groups, Group{Protocol: result.Protocol, Transport: result.Transport})
+			values = append(values, &groupValues{})
+		}
+		r.Groups[i].Runs++
+		if result.Error != "" {
+			r.Groups[i].Failures++
+			continue
+		}
+		v := values[i]
+		v.startupMs = append(v.startupMs, result.StartupMs)
+		v.stalls = append(v.stalls, float64(result.Stalls))
+		v.stallMs = append(v.stallMs, result.StallMs)
+		if result.LatencyMs > 0 {
+			v.latencyMs = append(v.latencyMs, result.LatencyMs)
+		}
+		v.throughput = append(v.throughput, result.ThroughputKbps)
+		v.rebuffers = append(v.rebuffers, float64(result.Rebuffers))
+		v.qoe = append(v.qoe, result.QoE)
+	}
+	for i, v := range values {
+		r.Groups[i].StartupMs = Summarize(v.startupMs)
+		r.Groups[i].Stalls = Summarize(v.stalls)
+		r.Groups[i].StallMs = Summarize(v.stallMs)
+		r.Groups[i].LatencyMs = Summarize(v.latencyMs)
+		r.Groups[i].Throughput = Summarize(v.throughput)
+		r.Groups[i].Rebuffers = Summarize(v.rebuffers)
+		r.Groups[i].QoE = Summarize(v.qoe)
+	}
+}
+
+// WriteJson 输出json格式的报告
+func (r *Report) WriteJson(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteMarkdown 输出markdown格式的报告，汇总表在前，每次运行的明细在后
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Transport benchmark\n\n")
+	fmt.Fprintf(&b, "- file: %s\n- duration per run: %s\n- repeat: %d\n", r.FileName, r.Duration, r.Repeat)
+	if r.Impair != "" {
+		fmt.Fprintf(&b, "- impairment: %s\n", r.Impair)
+	} else {
+		fmt.Fprintf(&b, "- impairment: none\n")
+	}
+	fmt.Fprintf(&b, "- begin: %s\n\n", r.Begin.Format(time.RFC3339))
+
+	fmt.Fprintf(&b, "## Summary\n\n")
+	fmt.Fprintf(&b, "| protocol | transport | runs | failures | startup median (ms) | startup p95 (ms) | stalls median | stall time median (ms) | latency median (ms) | latency p95 (ms) | throughput median (kbps) | rebuffers median | qoe median | qoe min |\n")
+	fmt.Fprintf(&b, "|---|---|---|---|---|---|---|---|---|---|---|---|---|---|\n")
+	for _, g := range r.Groups {
+		fmt.Fprintf(&b, "| %s | %s | %d | %d | %.1f | %.1f | %.1f | %.1f | %.1f | %.1f | %.1f | %.1f | %.1f | %.1f |\n",
+			g.Protocol, g.Transport, g.Runs, g.Failures, g.StartupMs.Median, g.StartupMs.P95, g.Stalls.Median,
+			g.StallMs.Median, g.LatencyMs.Median, g.LatencyMs.P95, g.Throughput.Median, g.Rebuffers.Median, g.QoE.Median, g.QoE.Min)
+	}
+
+	fmt.Fprintf(&b, "\n## Runs\n\n")
+	fmt.Fprintf(&b, "| protocol | transport | run | startup (ms) | stalls | stall time (ms) | latency (ms) | throughput (kbps) | rebuffers | rebuffer ratio (%%) | qoe | bytes | error |\n")
+	fmt.Fprintf(&b, "|---|---|---|---|---|---|---|---|---|---|---|---|---|\n")
+	for _, result := range r.Results {
+		fmt.Fprintf(&b, "| %s | %s | %d | %.1f | %d | %.1f | %.1f | %.1f | %d | %.2f | %.1f | %d | %s |\n",
+			result.Protocol, result.Transport, result.Run, result.StartupMs, result.Stalls, result.StallMs,
+			result.LatencyMs, result.ThroughputKbps, result.Rebuffers, result.RebufferRatio*100, result.QoE, result.Bytes,
+			strings.ReplaceAll(result.Error, "|", "\\|"))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
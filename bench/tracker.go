@@ -0,0 +1,142 @@
+package bench
+
+import (
+	"quic_demo/analytics"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	audioTag = 8
+	videoTag = 9
+)
+
+// Metrics 一次播放的结果
+type Metrics struct {
+	StartupMs      float64 `json:"startup_ms"`      // 开始播放到收到第一个视频关键帧
+	Stalls         int     `json:"stalls"`          // 卡顿次数
+	StallMs        float64 `json:"stall_ms"`        // 卡顿总时长
+	LatencyMs      float64 `json:"latency_ms"`      // 推流发出到播放收到的端到端时延中位数
+	ThroughputKbps float64 `json:"throughput_kbps"` // 收到的数据量除以播放时长
+	Bytes          int64   `json:"bytes"`
+	Tags           int64   `json:"tags"`
+	Rebuffers      int     `json:"rebuffers"`      // 模拟播放器缓冲耗尽的次数
+	RebufferRatio  float64 `json:"rebuffer_ratio"` // 模拟播放器卡顿时长占比
+	QoE            float64 `json:"qoe"`            // 模拟播放器的综合评分，0到100
+}
+
+// Tracker 同一进程内推流和播放时，按时间戳匹配推流发出和播放收到的tag，
+// 计算首帧、卡顿、端到端时延和吞吐
+type Tracker struct {
+	// StallGap 视频tag的到达间隔比时间戳间隔多出StallGap以上时记为一次卡顿
+	StallGap time.Duration
+	// Player 模拟播放器的缓冲参数，在Begin之前设置
+	Player analytics.PlayerOptions
+
+	lock          sync.Mutex
+	sent          map[uint64]time.Time
+	begin         time.Time
+	firstKeyframe time.Time
+	lastArrival   time.Time
+	lastVideoAt   time.Time
+	lastVideoTs   uint32
+	metrics       Metrics
+	latencies     []float64
+	player        *analytics.Player
+	now           func() time.Time // 当前时间，测试时替换
+}
+
+func NewTracker(stallGap time.Duration) *Tracker {
+	return &Tracker{
+		StallGap: stallGap,
+		sent:     make(map[uint64]time.Time),
+		now:      time.Now,
+	}
+}
+
+func tagKey(tagType uint8, timestamp uint32) uint64 {
+	return uint64(tagType)<<32 | uint64(timestamp)
+}
+
+// Sent 推流发出一个tag，用作RtmpPublisher.OnTag
+func (t *Tracker) Sent(tagType uint8, timestamp uint32, body []byte) {
+	if tagType != audioTag && tagType != videoTag {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// 文件循环推流时时间戳会重复，记最近一次发送的时间
+	t.sent[tagKey(tagType, timestamp)] = t.now()
+}
+
+// Begin 开始播放，首帧时间从这里算
+func (t *Tracker) Begin() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.begin = t.now()
+	t.player = analytics.NewPlayer(t.Player, t.begin)
+}
+
+// Received 播放收到一个tag，用作RtmpPlay.OnTag
+func (t *Tracker) Received(tagType uint8, timestamp uint32, body []byte) {
+	t.lock.Lock()
+	now := t.now()
+	defer t.lock.Unlock()
+	t.metrics.Tags++
+	t.metrics.Bytes += int64(len(body))
+	t.lastArrival = now
+	if tagType != audioTag && tagType != videoTag {
+		return
+	}
+	if t.player != nil {
+		t.player.AddAt(now, tagType, timestamp, body)
+	}
+	// 匹配后删除，重复收到同一时间戳的tag时不会再匹配到之前的发送时间
+	if sentAt, ok := t.sent[tagKey(tagType, timestamp)]; ok {
+		t.latencies = append(t.latencies, float64(now.Sub(sentAt))/float64(time.Millisecond))
+		delete(t.sent, tagKey(tagType, timestamp))
+	}
+	if tagType != videoTag || len(body) < 2 {
+		return
+	}
+	if t.firstKeyframe.IsZero() {
+		// 关键帧且不是AVC/HEVC sequence header
+		if body[0]>>4 == 1 && body[1] != 0 {
+			t.firstKeyframe = now
+			t.metrics.StartupMs = float64(now.Sub(t.begin)) / float64(time.Millisecond)
+			t.lastVideoAt, t.lastVideoTs = now, timestamp
+		}
+		return
+	}
+	if !t.lastVideoAt.IsZero() && timestamp >= t.lastVideoTs {
+		gap := now.Sub(t.lastVideoAt) - time.Duration(timestamp-t.lastVideoTs)*time.Millisecond
+		if gap > t.StallGap {
+			t.metrics.Stalls++
+			t.metrics.StallMs += float64(gap) / float64(time.Millisecond)
+		}
+	}
+	t.lastVideoAt, t.lastVideoTs = now, timestamp
+}
+
+// Metrics 返回当前结果
+func (t *Tracker) Metrics() Metrics {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	metrics := t.metrics
+	if len(t.latencies) > 0 {
+		latencies := append([]float64(nil), t.latencies...)
+		sort.Float64s(latencies)
+		metrics.LatencyMs = analytics.Percentile(latencies, 50)
+	}
+	if !t.begin.IsZero() && t.lastArrival.After(t.begin) {
+		metrics.ThroughputKbps = float64(metrics.Bytes*8) / float64(t.lastArrival.Sub(t.begin)/time.Millisecond+1)
+	}
+	if t.player != nil {
+		stats := t.player.Stats()
+		metrics.Rebuffers = stats.Rebuffers
+		metrics.RebufferRatio = stats.RebufferRatio
+		metrics.QoE = stats.QoE
+	}
+	return metrics
+}
@@ -0,0 +1,44 @@
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTrackerRepeatedTimestamps 循环推流时时间戳重复，时延按最近一次发送计算
+func TestTrackerRepeatedTimestamps(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	tracker := NewTracker(time.Second)
+	tracker.now = func() time.Time { return clock }
+	tracker.Begin()
+	frame := []byte{0x27, 1, 0, 0, 0}
+	var want []float64
+	for lap := 0; lap < 3; lap++ {
+		for ts := uint32(0); ts < 200; ts += 40 {
+			tracker.Sent(videoTag, ts, frame)
+			clock = clock.Add(10 * time.Millisecond)
+		}
+		// 每圈的时延不同：发送和接收的间隔都是10ms，每个tag的时延为50ms+delay
+		delay := time.Duration(50*(lap+1)) * time.Millisecond
+		clock = clock.Add(delay)
+		for ts := uint32(0); ts < 200; ts += 40 {
+			tracker.Received(videoTag, ts, frame)
+			want = append(want, float64(50+delay/time.Millisecond))
+			clock = clock.Add(10 * time.Millisecond)
+		}
+	}
+	// 收到两次同一个tag时，第二次不匹配
+	tracker.Received(videoTag, 0, frame)
+
+	if len(tracker.latencies) != len(want) {
+		t.Fatalf("latencies:%d, want %d", len(tracker.latencies), len(want))
+	}
+	for i, latency := range tracker.latencies {
+		if latency != want[i] {
+			t.Errorf("latency %d:%vms, want %vms", i, latency, want[i])
+		}
+	}
+	if len(tracker.sent) != 0 {
+		t.Fatalf("sent entries:%d, want 0", len(tracker.sent))
+	}
+}
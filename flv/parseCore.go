@@ -49,39 +49,42 @@ func NewFlvParse(reader io.Reader) (*FlvParse, error) {
 func (f *FlvParse) ReadTag() (*TagInfo, error) {
 	tmpBuf := make([]byte, 4)
 	tagInfo := &TagInfo{}
-	// Read tag tagInfo
+	// Read tag tagInfo，在tag边界上读到结尾时直接返回io.EOF
 	if _, err := io.ReadFull(f.Reader, tmpBuf[3:]); err != nil {
-		return nil, fmt.Errorf("io.ReadFull failed, err:%v", err)
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("io.ReadFull failed, err:%w", err)
 	}
 	tagInfo.TagType = tmpBuf[3]
 
 	// Read tag size
 	if _, err := io.ReadFull(f.Reader, tmpBuf[1:]); err != nil {
-		return nil, fmt.Errorf("io.ReadFull failed, err:%v", err)
+		return nil, fmt.Errorf("io.ReadFull failed, err:%w", err)
 	}
 	tagInfo.DataSize = uint32(tmpBuf[1])<<16 | uint32(tmpBuf[2])<<8 | uint32(tmpBuf[3])
 
 	// Read timestamp
 	if _, err := io.ReadFull(f.Reader, tmpBuf); err != nil {
-		return nil, fmt.Errorf("io.ReadFull failed, err:%v", err)
+		return nil, fmt.Errorf("io.ReadFull failed, err:%w", err)
 	}
-	tagInfo.Timestamp = uint32(tmpBuf[3])<<32 + uint32(tmpBuf[0])<<16 + uint32(tmpBuf[1])<<8 + uint32(tmpBuf[2])
+	tagInfo.Timestamp = uint32(tmpBuf[3])<<24 + uint32(tmpBuf[0])<<16 + uint32(tmpBuf[1])<<8 + uint32(tmpBuf[2])
 
 	// Read stream ID
 	if _, err := io.ReadFull(f.Reader, tmpBuf[1:]); err != nil {
-		return nil, fmt.Errorf("io.ReadFull failed, err:%v", err)
+		return nil, fmt.Errorf("io.ReadFull failed, err:%w", err)
 	}
 
 	// Read data
 	data := make([]byte, tagInfo.DataSize)
 	if _, err := io.ReadFull(f.Reader, data); err != nil {
-		return nil, fmt.Errorf("io.ReadFull failed, err:%v", err)
+		return nil, fmt.Errorf("io.ReadFull failed, err:%w", err)
 	}
 	tagInfo.Body = data
 
 	// Read previous tag size
 	if _, err := io.ReadFull(f.Reader, tmpBuf); err != nil {
-		return nil, fmt.Errorf("io.ReadFull failed, err:%v", err)
+		return nil, fmt.Errorf("io.ReadFull failed, err:%w", err)
 	}
 
 	return tagInfo, nil
@@ -0,0 +1,46 @@
+package flv
+
+import (
+	"fmt"
+	"io"
+)
+
+// WriteHeader 写入flv header和第一个PreviousTagSize
+func WriteHeader(writer io.Writer, hasAudio bool, hasVideo bool) error {
+	flags := byte(0)
+	if hasAudio {
+		flags |= 0x04
+	}
+	if hasVideo {
+		flags |= 0x01
+	}
+	header := []byte{'F', 'L', 'V', 0x01, flags, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+	if _, err := writer.Write(header); err != nil {
+		return fmt.Errorf("write flv header failed, err:%v", err)
+	}
+	return nil
+}
+
+// WriteTag 写入一个tag及其PreviousTagSize
+func WriteTag(writer io.Writer, tagInfo *TagInfo) error {
+	dataSize := uint32(len(tagInfo.Body))
+	buf := make([]byte, 11+dataSize+4)
+	buf[0] = tagInfo.TagType
+	buf[1] = byte(dataSize >> 16)
+	buf[2] = byte(dataSize >> 8)
+	buf[3] = byte(dataSize)
+	buf[4] = byte(tagInfo.Timestamp >> 16)
+	buf[5] = byte(tagInfo.Timestamp >> 8)
+	buf[6] = byte(tagInfo.Timestamp)
+	buf[7] = byte(tagInfo.Timestamp >> 24)
+	copy(buf[11:], tagInfo.Body)
+	tagSize := 11 + dataSize
+	buf[tagSize] = byte(tagSize >> 24)
+	buf[tagSize+1] = byte(tagSize >> 16)
+	buf[tagSize+2] = byte(tagSize >> 8)
+	buf[tagSize+3] = byte(tagSize)
+	if _, err := writer.Write(buf); err != nil {
+		return fmt.Errorf("write flv tag failed, err:%v", err)
+	}
+	return nil
+}
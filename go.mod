@@ -3,9 +3,10 @@ module quic_demo
 go 1.16
 
 require (
-	github.com/lucas-clemente/quic-go v0.24.0 // indirect
-	github.com/zhangpeihao/goamf v0.0.0-20140409082417-3ff2c19514a8 // indirect
-	github.com/zhangpeihao/goflv v0.0.0-20140409083800-f2c8a1d6c9e1 // indirect
-	github.com/zhangpeihao/gortmp v0.0.0-20161114025007-d5f2189e629f // indirect
+	github.com/lucas-clemente/quic-go v0.24.0
+	github.com/zhangpeihao/goamf v0.0.0-20140409082417-3ff2c19514a8
+	github.com/zhangpeihao/goflv v0.0.0-20140409083800-f2c8a1d6c9e1
+	github.com/zhangpeihao/gortmp v0.0.0-20161114025007-d5f2189e629f
 	github.com/zhangpeihao/log v0.0.0-20170117094621-62e921e41859 // indirect
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 )
@@ -1,30 +1,59 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"quic_demo/analytics"
 	"quic_demo/flv"
-	"strings"
+	"quic_demo/quicConn"
+	"quic_demo/resolver"
+	"quic_demo/timing"
+	"strconv"
 	"time"
 )
 
 func main() {
 
-	var ip string
 	var port int
 	var httpUrl string
-	flag.StringVar(&ip, "ip", "", "server ip")
+	var version string
+	var alpn string
+	var sessionCacheFile string
+	var early bool
+	var qlogDir string
+	var statsInterval int
 	flag.StringVar(&httpUrl, "url", "", "http url, https://domain/live/stream.flv")
 	flag.IntVar(&port, "port", 443, "server port, default 443")
+	flag.StringVar(&version, "version", "v1", "quic version, v1 or draft29, http/3 dials with a single version")
+	flag.StringVar(&alpn, "alpn", "", "tls alpn, default h3 for v1 and h3-29 for draft29")
+	flag.StringVar(&sessionCacheFile, "sessionCache", "", "tls session cache file, kept between runs for resumption and 0-RTT")
+	flag.BoolVar(&early, "early", true, "send the http request as 0-RTT data when a cached session is available")
+	flag.StringVar(&qlogDir, "qlogDir", "", "write a qlog file per quic session into this dir, empty to disable")
+	flag.IntVar(&statsInterval, "statsInterval", 5, "flv window bitrate and quic stats interval in seconds, 0 to disable")
+	var analyticsOptions analytics.Options
+	analyticsOptions.AddFlags()
+	var playerOptions analytics.PlayerOptions
+	playerOptions.AddFlags()
+	var raceDialer quicConn.RaceDialer
+	raceDialer.AddFlags(true)
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
 	flag.Parse()
-	if ip == "" || httpUrl == "" {
-		log.Fatalln("ip == \"\" ||  url == \"\"")
+	if httpUrl == "" {
+		log.Fatalln("url == \"\"")
 	}
 
 	url2, err := url.Parse(httpUrl)
@@ -32,29 +61,146 @@ func main() {
 		log.Fatalf("url.Parse failed, err:%v", err)
 	}
 
-	domain := strings.Split(url2.Host, ":")[0]
+	domain := url2.Hostname()
+	addrs, err := addrOptions.Lookup(domain)
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	ip := addrs.Ips[0]
+	quicVersions, err := quicConn.ParseVersions(version)
+	if err != nil || len(quicVersions) != 1 {
+		log.Fatalf("quicConn.ParseVersions failed, version:%s, err:%v", version, err)
+	}
+	nextProtos := quicConn.ParseAlpn(alpn)
+	if len(nextProtos) == 0 {
+		nextProtos = []string{quicConn.H3AlpnForVersion(quicVersions[0])}
+	}
+
+	sessionCache, err := quicConn.NewFileSessionCache(sessionCacheFile)
+	if err != nil {
+		log.Fatalf("quicConn.NewFileSessionCache err:%v", err)
+	}
+
+	tlsConfig, err := tlsOptions.QuicClientConfig(domain)
+	if err != nil {
+		log.Fatalf("tlsOptions.QuicClientConfig err:%v", err)
+	}
+	tlsConfig.ClientSessionCache = sessionCache
+
+	tracer := quicConn.NewTracer()
+	tracer.QlogDir = qlogDir
+	recorder := timing.NewRecorder("quic")
+	addrs.RecordDns(recorder)
+	quicAddr := net.JoinHostPort(ip, strconv.Itoa(port))
+	quicConfig := &quic.Config{
+		Versions: quicVersions,
+		Tracer:   tracer,
+	}
+
+	var raceResult *quicConn.RaceResult
+	if raceDialer.Enabled {
+		// quic与tcp赛跑，udp不通时回退到https over tcp
+		raceTlsConfig := tlsConfig.Clone()
+		raceTlsConfig.NextProtos = nextProtos
+		raceDialer.QuicAddr = quicAddr
+		raceDialer.QuicTlsConfig = raceTlsConfig
+		raceDialer.QuicConfig = quicConfig
+		raceDialer.Timing = recorder
+		if raceDialer.Tls {
+			if raceDialer.TlsConfig, err = tlsOptions.ClientConfig(domain); err != nil {
+				log.Fatalf("tlsOptions.ClientConfig err:%v", err)
+			}
+			raceDialer.TlsConfig.NextProtos = []string{"http/1.1"}
+		}
+		raceResult, err = raceDialer.Dial(context.Background())
+		if err != nil {
+			log.Fatalf("raceDialer.Dial err:%v", err)
+		}
+		fmt.Printf("%s\n", raceResult)
+	}
 
+	var h3Session quic.EarlySession
 	roundTripper := &http3.RoundTripper{
-		QuicConfig: &quic.Config{
-			Versions: []quic.VersionNumber{quic.VersionDraft29},
-		},
-		TLSClientConfig: &tls.Config{
-			ServerName: domain,
-			NextProtos: []string{"rtmp over quic"},
-		},
+		QuicConfig:      quicConfig,
+		TLSClientConfig: tlsConfig,
 		Dial: func(network, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlySession, error) {
-			return quic.DialAddrEarly(fmt.Sprintf("%s:%d", ip, port), tlsCfg, cfg)
+			if raceResult != nil && raceResult.Session != nil && h3Session == nil {
+				// 第一次请求使用赛跑赢了的session
+				h3Session = raceResult.Session
+				return h3Session, nil
+			}
+			// http3.RoundTripper按版本覆盖了NextProtos，这里换成指定的alpn
+			tlsCfg.NextProtos = nextProtos
+			recorder.Start(timing.PhaseQuicHandshake)
+			session, err := quic.DialAddrEarly(quicAddr, tlsCfg, cfg)
+			if err != nil {
+				return nil, err
+			}
+			h3Session = session
+			go func() {
+				if quicConn.WaitHandshake(session) {
+					recorder.End(timing.PhaseQuicHandshake)
+				}
+			}()
+			return session, nil
 		},
 	}
 	defer roundTripper.Close()
 	hclient := &http.Client{
 		Transport: roundTripper,
 	}
+	if raceResult != nil && raceResult.Conn != nil {
+		// tcp赢了，在赛跑建好的连接上走http/1.1
+		early = false
+		dialRace := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if conn := raceResult.Conn; conn != nil {
+				raceResult.Conn = nil
+				return conn, nil
+			}
+			return nil, fmt.Errorf("race connection already used")
+		}
+		// 连接上是否已做tls由-tcpTls决定，两个拨号函数返回同一个连接
+		hclient.Transport = &http.Transport{
+			DialTLSContext: dialRace,
+			DialContext:    dialRace,
+		}
+	}
 	beginTime := time.Now()
 	fmt.Printf("begin time:%d\n", beginTime.UnixNano()/1e6)
-	resp, err := hclient.Get(httpUrl)
+	method := http.MethodGet
+	if early {
+		// 只有GET_0RTT才会在握手完成前发送请求
+		method = http3.MethodGet0RTT
+	}
+	req, err := http.NewRequest(method, httpUrl, nil)
+	if err != nil {
+		log.Fatalf("http.NewRequest err:%v", err)
+	}
+	go func() {
+		recorder.Wait(timing.PhaseFirstVideoKeyframe, 10*time.Second)
+		recorder.Print(os.Stdout)
+	}()
+	recorder.Start(timing.PhaseHttpTtfb)
+	resp, err := hclient.Do(req)
+	if err != nil && h3Session != nil && quicConn.WaitHandshake(h3Session) && tracer.SessionInfo(h3Session).Rejected0RTT() {
+		// 0-RTT被拒绝后原session上的流不可用，关闭后重新建连请求
+		log.Printf("0-RTT rejected, retry after handshake, err:%v", err)
+		roundTripper.Close()
+		req.Method = http.MethodGet
+		resp, err = hclient.Do(req)
+	}
 	if err != nil {
-		log.Fatalf("hclient.Get err:%v", err)
+		log.Fatalf("hclient.Do err:%v", err)
+	}
+	// http3.RoundTripper不支持httptrace，以收到响应头作为首字节时间
+	recorder.End(timing.PhaseHttpTtfb)
+	if h3Session != nil && quicConn.WaitHandshake(h3Session) {
+		fmt.Printf("%s\n", tracer.SessionInfo(h3Session))
 	}
 	respBody := resp.Body
 	defer respBody.Close()
@@ -64,18 +210,44 @@ func main() {
 	}
 
 	flvParse, err := flv.NewFlvParse(respBody)
-	lastTime := beginTime
-	for true {
-
+	if err != nil {
+		log.Fatalln("flv.NewFlvParse error, ", err)
+	}
+	recorder.Mark(timing.PhaseFlvHeader)
+	analyzer := analytics.NewAnalyzer(analyticsOptions)
+	analyzer.Player = analytics.NewPlayer(playerOptions, beginTime)
+	analyzer.Latency = analytics.NewLatencyMeter()
+	analyzer.PrintOnInterrupt(os.Stdout)
+	lastTime, lastStatsTime := beginTime, beginTime
+	for {
 		tagInfo, err := flvParse.ReadTag()
+		if errors.Is(err, io.EOF) {
+			analyzer.Summary().Print(os.Stdout)
+			return
+		}
 		if err != nil {
+			analyzer.Summary().Print(os.Stdout)
 			log.Fatalln("flvParse.ReadTag error, ", err)
-
 		}
+		recorder.MarkTag(tagInfo.TagType, tagInfo.Body)
 		currentTime := time.Now()
-		fmt.Printf("read tag, curr time:%d, interval:%d, type:%d, body:%d, pts:%d\n",
-			currentTime.UnixNano()/1e6, currentTime.Sub(lastTime).Nanoseconds()/1e6, tagInfo.TagType, len(tagInfo.Body), tagInfo.Timestamp)
-
+		sample := analyzer.AddAt(currentTime, tagInfo.TagType, tagInfo.Timestamp, tagInfo.Body)
+		fmt.Printf("read tag, curr time:%d, interval:%d, type:%d, body:%d, pts:%d, jitter:%.1f, delay:%.1f\n",
+			currentTime.UnixNano()/1e6, currentTime.Sub(lastTime).Nanoseconds()/1e6, tagInfo.TagType, len(tagInfo.Body), tagInfo.Timestamp,
+			sample.JitterMs, sample.DelayMs)
+		lastTime = currentTime
+		if sample.StallMs > 0 {
+			fmt.Printf("stall, gap:%.1fms, pts:%d\n", sample.StallMs, tagInfo.Timestamp)
+		}
+		if event := sample.Player.String(); event != "" {
+			fmt.Printf("%s, pts:%d\n", event, tagInfo.Timestamp)
+		}
+		if sample.Latency != nil {
+			fmt.Printf("latency, %s, pts:%d\n", sample.Latency, tagInfo.Timestamp)
+		}
+		if statsInterval > 0 && currentTime.Sub(lastStatsTime) >= time.Duration(statsInterval)*time.Second {
+			fmt.Printf("flv stats, %s, %s\n", analyzer.WindowStats(), tracer.Stats(h3Session))
+			lastStatsTime = currentTime
+		}
 	}
-
 }
@@ -0,0 +1,68 @@
+package httpFlv
+
+import (
+	"log"
+	"net/http"
+	"quic_demo/flv"
+	"strings"
+)
+
+// Handler 以http-flv方式输出直播流，url为/app/streamName.flv，
+// 同一个Handler可以同时挂在http/1.1、http/2和http/3的server上
+type Handler struct {
+	Source TagSource
+	// SetHeaders 在写响应头之前调用，可用于设置Alt-Svc等
+	SetHeaders func(header http.Header)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, ".flv") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".flv")
+	tags, cancel, err := h.Source.Subscribe(key)
+	if err != nil {
+		log.Printf("subscribe failed, key:%s, err:%v", key, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer cancel()
+	log.Printf("http-flv play, proto:%s, remote:%s, key:%s", r.Proto, r.RemoteAddr, key)
+
+	header := w.Header()
+	if h.SetHeaders != nil {
+		h.SetHeaders(header)
+	}
+	header.Set("Content-Type", "video/x-flv")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if err := flv.WriteHeader(w, true, true); err != nil {
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("http-flv play end, proto:%s, remote:%s, key:%s", r.Proto, r.RemoteAddr, key)
+			return
+		case tag, ok := <-tags:
+			if !ok {
+				return
+			}
+			if err := flv.WriteTag(w, tag); err != nil {
+				log.Printf("http-flv write failed, remote:%s, err:%v", r.RemoteAddr, err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
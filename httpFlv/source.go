@@ -0,0 +1,113 @@
+package httpFlv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"quic_demo/flv"
+	"quic_demo/rtmpServer"
+	"sync"
+	"time"
+)
+
+// TagSource 为http-flv提供直播流的tag，key为"app/streamName"
+type TagSource interface {
+	Subscribe(key string) (tags <-chan *flv.TagInfo, cancel func(), err error)
+}
+
+// RtmpSource 从进程内的rtmp服务器获取通过rtmp推上来的流
+type RtmpSource struct {
+	Server *rtmpServer.Server
+}
+
+func (s *RtmpSource) Subscribe(key string) (<-chan *flv.TagInfo, func(), error) {
+	subscriber := s.Server.Subscribe(key)
+	return subscriber.Tags, subscriber.Close, nil
+}
+
+// FileSource 按时间戳实时读取本地flv文件，所有key都返回同一个文件，每个订阅者从头开始
+type FileSource struct {
+	FileName string
+	Loop     bool
+}
+
+func (s *FileSource) Subscribe(key string) (<-chan *flv.TagInfo, func(), error) {
+	file, err := os.Open(s.FileName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open flv file failed, file:%s, err:%v", s.FileName, err)
+	}
+	flvParse, err := flv.NewFlvParse(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("flv.NewFlvParse failed, file:%s, err:%v", s.FileName, err)
+	}
+
+	tags := make(chan *flv.TagInfo, 64)
+	done := make(chan struct{})
+	go s.readLoop(file, flvParse, tags, done)
+	closeOnce := sync.Once{}
+	return tags, func() {
+		closeOnce.Do(func() {
+			close(done)
+		})
+	}, nil
+}
+
+func (s *FileSource) readLoop(file *os.File, flvParse *flv.FlvParse, tags chan<- *flv.TagInfo, done <-chan struct{}) {
+	defer close(tags)
+	defer func() {
+		file.Close()
+	}()
+
+	startAt := time.Now()
+	startTs := int64(-1)
+	// 循环播放时，下一轮的时间戳接在上一轮之后
+	offsetTs := uint32(0)
+	lastTs := uint32(0)
+	// 本轮读到的tag数，一个tag都没读到就出错的文件不再循环，避免空转
+	lapTags := 0
+	for {
+		tagInfo, err := flvParse.ReadTag()
+		if err != nil {
+			// 录制的文件最后一个tag可能不完整，也当作文件结尾
+			end := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+			if !s.Loop || !end || lapTags == 0 {
+				return
+			}
+			file.Close()
+			file, err = os.Open(s.FileName)
+			if err != nil {
+				return
+			}
+			if flvParse, err = flv.NewFlvParse(file); err != nil {
+				return
+			}
+			offsetTs = lastTs + 40
+			lapTags = 0
+			continue
+		}
+		lapTags++
+		tagInfo.Timestamp += offsetTs
+		lastTs = tagInfo.Timestamp
+
+		if startTs < 0 {
+			startTs = int64(tagInfo.Timestamp)
+		}
+		// 按时间戳平滑发送
+		waitTime := time.Duration(int64(tagInfo.Timestamp)-startTs)*time.Millisecond - time.Since(startAt)
+		if waitTime > 0 {
+			select {
+			case <-time.After(waitTime):
+			case <-done:
+				return
+			}
+		}
+
+		select {
+		case tags <- tagInfo:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"log"
+	"net"
+	"net/http"
+	"quic_demo/httpFlv"
+	"quic_demo/quicConn"
+	"quic_demo/rtmpServer"
+)
+
+func main() {
+
+	var addr string
+	var h3Addr string
+	var rtmpAddr string
+	var certFile string
+	var keyFile string
+	var fileName string
+	var loop bool
+	var versions string
+	var qlogDir string
+	flag.StringVar(&addr, "addr", ":443", "https(http/1.1, http/2) listen addr, empty to disable")
+	flag.StringVar(&h3Addr, "h3Addr", ":443", "http/3 listen addr, empty to disable")
+	flag.StringVar(&rtmpAddr, "rtmpAddr", ":1935", "rtmp ingest listen addr, used when fileName is empty")
+	flag.StringVar(&certFile, "cert", "", "cert file, self-signed if empty")
+	flag.StringVar(&keyFile, "key", "", "key file")
+	flag.StringVar(&fileName, "fileName", "", "flv file served for every stream, paced in real time")
+	flag.BoolVar(&loop, "loop", true, "loop the flv file")
+	flag.StringVar(&versions, "versions", "v1,draft29", "supported quic versions of http/3, alpn is h3 for v1 and h3-29 for draft29")
+	flag.StringVar(&qlogDir, "qlogDir", "", "write a qlog file per http/3 session into this dir, empty to disable")
+	flag.Parse()
+	if addr == "" && h3Addr == "" {
+		log.Fatalln("addr == \"\" && h3Addr == \"\"")
+	}
+
+	tlsConfig, err := quicConn.LoadServerTlsConfig(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("quicConn.LoadServerTlsConfig err:%v", err)
+	}
+
+	handler := &httpFlv.Handler{}
+	if fileName != "" {
+		handler.Source = &httpFlv.FileSource{FileName: fileName, Loop: loop}
+	} else {
+		if rtmpAddr == "" {
+			log.Fatalln("fileName == \"\" && rtmpAddr == \"\"")
+		}
+		listener, err := net.Listen("tcp", rtmpAddr)
+		if err != nil {
+			log.Fatalf("net.Listen err:%v", err)
+		}
+		server := rtmpServer.NewServer()
+		go server.Serve(listener)
+		handler.Source = &httpFlv.RtmpSource{Server: server}
+		log.Printf("rtmp ingest on %s", rtmpAddr)
+	}
+
+	errChan := make(chan error, 2)
+	if h3Addr != "" {
+		quicVersions, err := quicConn.ParseVersions(versions)
+		if err != nil {
+			log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+		}
+		tracer := quicConn.NewTracer()
+		tracer.QlogDir = qlogDir
+		h3Server := &http3.Server{
+			Server: &http.Server{
+				Addr:      h3Addr,
+				Handler:   handler,
+				TLSConfig: tlsConfig,
+			},
+			QuicConfig: &quic.Config{
+				Versions: quicVersions,
+				Tracer:   tracer,
+			},
+		}
+		// 通过Alt-Svc告知https客户端可以升级到http/3
+		handler.SetHeaders = func(header http.Header) {
+			h3Server.SetQuicHeaders(header)
+		}
+		go func() {
+			log.Printf("http/3 on %s", h3Addr)
+			errChan <- h3Server.ListenAndServe()
+		}()
+	}
+	if addr != "" {
+		server := &http.Server{
+			Addr:      addr,
+			Handler:   handler,
+			TLSConfig: tlsConfig,
+		}
+		go func() {
+			log.Printf("https(http/1.1, http/2) on %s", addr)
+			errChan <- server.ListenAndServeTLS("", "")
+		}()
+	}
+	log.Fatalf("server exit, err:%v", <-errChan)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"quic_demo/bench"
+	"quic_demo/quicConn"
+	"quic_demo/resolver"
+	"quic_demo/timing"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// 在一条连接上同时发起多个请求，对比h3和h2(一条tcp连接)的多路复用：
+// 每个请求的ttfb、吞吐和两次读之间的最大间隔，tcp丢包时所有流一起卡住，quic只影响丢包所在的流
+
+// requestResult 一个请求的结果
+type requestResult struct {
+	Index      int
+	Url        string
+	Status     int
+	Err        string
+	TtfbMs     float64 // 从发出请求到收到响应头
+	Bytes      int64
+	BodyMs     float64 // 从收到响应头到读完body或到达-duration
+	MaxGapMs   float64 // 两次读之间的最大间隔
+	Throughput float64 // kbps，按body的读取时间计算
+}
+
+// protoResult 一个协议的一轮请求
+type protoResult struct {
+	Proto       string
+	Dials       int
+	HandshakeMs float64
+	WallMs      float64
+	Requests    []requestResult
+}
+
+func main() {
+	var urls string
+	var count int
+	var protos string
+	var port int
+	var version string
+	var alpn string
+	var duration time.Duration
+	var warmup bool
+	flag.StringVar(&urls, "urls", "", "urls on the same host, comma separated, such as: https://domain/live/a.flv,https://domain/seg/1.ts")
+	flag.IntVar(&count, "n", 1, "concurrent requests of each url")
+	flag.StringVar(&protos, "protos", "h3,h2", "http protocols to compare, each runs on a single connection, comma separated, h1/h2/h2c/h3")
+	flag.IntVar(&port, "port", 443, "server port, default 443")
+	flag.StringVar(&version, "version", "v1", "quic version for h3, v1 or draft29")
+	flag.StringVar(&alpn, "alpn", "", "tls alpn for h3, default h3 for v1 and h3-29 for draft29")
+	flag.DurationVar(&duration, "duration", 10*time.Second, "max read time of each request, live flv streams never end, 0 to read to the end")
+	flag.BoolVar(&warmup, "warmup", true, "set up the connection with a request of the first url before the parallel requests, so ttfb does not include the handshake")
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
+	flag.Parse()
+
+	if urls == "" || count <= 0 {
+		log.Fatalln("urls == \"\" || n <= 0")
+	}
+	var targets []string
+	host := ""
+	for _, rawUrl := range strings.Split(urls, ",") {
+		rawUrl = strings.TrimSpace(rawUrl)
+		if rawUrl == "" {
+			continue
+		}
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			log.Fatalf("url.Parse failed, url:%s, err:%v", rawUrl, err)
+		}
+		if host != "" && u.Hostname() != host {
+			log.Fatalf("all urls should be on the same host, %s != %s", u.Hostname(), host)
+		}
+		host = u.Hostname()
+		for i := 0; i < count; i++ {
+			targets = append(targets, rawUrl)
+		}
+	}
+
+	addrs, err := addrOptions.Lookup(host)
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	serverAddr := net.JoinHostPort(addrs.Ips[0], strconv.Itoa(port))
+	quicVersions, err := quicConn.ParseVersions(version)
+	if err != nil || len(quicVersions) != 1 {
+		log.Fatalf("quicConn.ParseVersions failed, version:%s, err:%v", version, err)
+	}
+
+	var results []protoResult
+	for _, proto := range strings.Split(protos, ",") {
+		proto, err := quicConn.ParseHttpProto(strings.TrimSpace(proto))
+		if err != nil {
+			log.Fatalf("quicConn.ParseHttpProto err:%v", err)
+		}
+		var tlsConfig *tls.Config
+		if proto == quicConn.HttpProtoH3 {
+			tlsConfig, err = tlsOptions.QuicClientConfig(host)
+		} else {
+			tlsConfig, err = tlsOptions.ClientConfig(host)
+		}
+		if err != nil {
+			log.Fatalf("tlsOptions.ClientConfig err:%v", err)
+		}
+		httpTransport := &quicConn.HttpTransport{
+			Proto:      proto,
+			Addr:       serverAddr,
+			TLSConfig:  tlsConfig,
+			QuicConfig: &quic.Config{Versions: quicVersions},
+			H3Alpn:     quicConn.ParseAlpn(alpn),
+			SingleConn: true,
+		}
+		u, _ := url.Parse(targets[0])
+		if err := httpTransport.CheckScheme(u.Scheme); err != nil {
+			log.Fatalln(err)
+		}
+		result, err := runProto(httpTransport, targets, duration, warmup)
+		if err != nil {
+			log.Fatalf("%s failed, err:%v", proto, err)
+		}
+		printProtoResult(os.Stdout, result)
+		results = append(results, result)
+	}
+	printComparison(os.Stdout, results)
+}
+
+// runProto 在一条新连接上并发请求所有url
+func runProto(httpTransport *quicConn.HttpTransport, targets []string, duration time.Duration, warmup bool) (protoResult, error) {
+	result := protoResult{Proto: httpTransport.Proto}
+	httpTransport.Timing = timing.NewRecorder(httpTransport.Proto)
+	roundTripper, err := httpTransport.RoundTripper()
+	if err != nil {
+		return result, err
+	}
+	defer closeRoundTripper(roundTripper)
+	client := &http.Client{Transport: roundTripper}
+
+	if warmup {
+		resp, err := client.Get(targets[0])
+		if err != nil {
+			return result, fmt.Errorf("warmup request failed, err:%v", err)
+		}
+		// h2和h3关闭body只会重置这条流，连接保留
+		resp.Body.Close()
+		if err := httpTransport.CheckResponse(resp); err != nil {
+			return result, err
+		}
+	}
+
+	result.Requests = make([]requestResult, len(targets))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			<-start
+			result.Requests[i] = doRequest(client, i, target, duration)
+		}(i, target)
+	}
+	beginTime := time.Now()
+	close(start)
+	wg.Wait()
+	result.WallMs = float64(time.Since(beginTime)) / float64(time.Millisecond)
+	result.Dials = httpTransport.Dials()
+	for _, name := range []string{timing.PhaseQuicHandshake, timing.PhaseTlsHandshake, timing.PhaseTcpConnect} {
+		if phase, ok := httpTransport.Timing.Get(name); ok {
+			result.HandshakeMs = phase.EndMs
+			break
+		}
+	}
+	return result, nil
+}
+
+func doRequest(client *http.Client, index int, target string, duration time.Duration) requestResult {
+	result := requestResult{Index: index, Url: target}
+	ctx := context.Background()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	beginTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	headerTime := time.Now()
+	result.Status = resp.StatusCode
+	result.TtfbMs = float64(headerTime.Sub(beginTime)) / float64(time.Millisecond)
+
+	buf := make([]byte, 32*1024)
+	lastRead := headerTime
+	for {
+		n, err := resp.Body.Read(buf)
+		now := time.Now()
+		if n > 0 {
+			result.Bytes += int64(n)
+			if gap := float64(now.Sub(lastRead)) / float64(time.Millisecond); gap > result.MaxGapMs {
+				result.MaxGapMs = gap
+			}
+			lastRead = now
+		}
+		if err != nil {
+			// 到达-duration结束读取是正常的
+			if err != io.EOF && ctx.Err() == nil {
+				result.Err = err.Error()
+			}
+			break
+		}
+	}
+	endTime := time.Now()
+	result.BodyMs = float64(endTime.Sub(headerTime)) / float64(time.Millisecond)
+	if result.BodyMs > 0 {
+		result.Throughput = float64(result.Bytes) * 8 / result.BodyMs
+	}
+	return result
+}
+
+func printProtoResult(w io.Writer, result protoResult) {
+	fmt.Fprintf(w, "%s, connections:%d, handshake:%.1fms, wall:%.1fms\n", result.Proto, result.Dials, result.HandshakeMs, result.WallMs)
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "#\turl\tstatus\tttfb ms\tbytes\tbody ms\tkbps\tmax gap ms\terror\n")
+	for _, request := range result.Requests {
+		fmt.Fprintf(table, "%d\t%s\t%d\t%.1f\t%d\t%.1f\t%.1f\t%.1f\t%s\n", request.Index, request.Url, request.Status,
+			request.TtfbMs, request.Bytes, request.BodyMs, request.Throughput, request.MaxGapMs, request.Err)
+	}
+	table.Flush()
+	fmt.Fprintln(w)
+}
+
+// printComparison 每个协议一行，ttfb和最大间隔取所有请求的中位数、p95和最大值
+func printComparison(w io.Writer, results []protoResult) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "proto\tconns\trequests\terrors\tttfb p50\tttfb p95\tttfb max\tgap p50\tgap p95\tgap max\ttotal kbps\n")
+	for _, result := range results {
+		var ttfbs, gaps []float64
+		errCount := 0
+		bytes := int64(0)
+		for _, request := range result.Requests {
+			if request.Err != "" {
+				errCount++
+			}
+			if request.Status != 0 {
+				ttfbs = append(ttfbs, request.TtfbMs)
+				gaps = append(gaps, request.MaxGapMs)
+			}
+			bytes += request.Bytes
+		}
+		ttfb := bench.Summarize(ttfbs)
+		gap := bench.Summarize(gaps)
+		totalKbps := 0.0
+		if result.WallMs > 0 {
+			totalKbps = float64(bytes) * 8 / result.WallMs
+		}
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\n", result.Proto, result.Dials, len(result.Requests), errCount,
+			ttfb.Median, ttfb.P95, ttfb.Max, gap.Median, gap.P95, gap.Max, totalKbps)
+	}
+	table.Flush()
+}
+
+// closeRoundTripper http3.RoundTripper需要Close，其他的关闭空闲连接
+func closeRoundTripper(roundTripper http.RoundTripper) {
+	if closer, ok := roundTripper.(io.Closer); ok {
+		closer.Close()
+		return
+	}
+	if idle, ok := roundTripper.(interface{ CloseIdleConnections() }); ok {
+		idle.CloseIdleConnections()
+	}
+}
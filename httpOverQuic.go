@@ -1,72 +1,366 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/http3"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"quic_demo/quicConn"
+	"quic_demo/resolver"
+	"quic_demo/timing"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// headerFlags 可以重复指定的-H
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header should be \"Name: value\", got:%s", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// 退出码：正常完成为0，4xx为4，5xx为5，请求或读取失败为1
+const (
+	exitClientError = 4
+	exitServerError = 5
 )
 
 func main() {
 
-	var ip string
 	var port int
 	var httpUrl string
+	var proto string
+	var version string
+	var alpn string
+	var qlogDir string
 	var print int
-	flag.StringVar(&ip, "ip", "", "server ip")
+	var method string
+	var headers headerFlags
+	var data string
+	var outFile string
+	var include bool
+	var follow bool
+	var maxRedirs int
+	var writeOut string
+	var fail bool
+	var timeout time.Duration
 	flag.StringVar(&httpUrl, "url", "", "http url, https://domain/live/stream.flv")
-	flag.IntVar(&port, "port", 443, "server port, default 443")
-	flag.IntVar(&print, "print", 1, "print response, default 1")
+	flag.IntVar(&port, "port", 0, "server port, default the url port, 443 for https and 80 for http")
+	flag.StringVar(&proto, "proto", quicConn.HttpProtoH3, "http protocol, auto/h1/h2/h2c/h3, compare the same url over different http versions")
+	flag.StringVar(&version, "version", "v1", "quic version for h3, v1 or draft29, http/3 dials with a single version")
+	flag.StringVar(&alpn, "alpn", "", "tls alpn for h3, default h3 for v1 and h3-29 for draft29")
+	flag.StringVar(&qlogDir, "qlogDir", "", "write a qlog file per quic session into this dir, empty to disable")
+	flag.IntVar(&print, "print", 1, "print response body, 0 to read and discard it")
+	flag.StringVar(&method, "X", "", "request method, default GET, or POST when -data is set")
+	flag.Var(&headers, "H", "request header \"Name: value\", repeatable")
+	flag.StringVar(&data, "data", "", "request body, @file to read it from a file, @- from stdin")
+	flag.StringVar(&outFile, "o", "-", "write the response body to this file, - for stdout")
+	flag.BoolVar(&include, "i", false, "print the response status line and headers before the body")
+	flag.BoolVar(&follow, "L", false, "follow redirects")
+	flag.IntVar(&maxRedirs, "maxRedirs", 10, "max redirects to follow with -L")
+	flag.StringVar(&writeOut, "w", "", "print after the transfer, such as \"%{http_code} %{time_total}\\n\", variables: "+strings.Join(writeOutVars, ","))
+	flag.BoolVar(&fail, "fail", true, "exit 4 for 4xx and 5 for 5xx responses, false to exit 0 after any complete response")
+	flag.DurationVar(&timeout, "timeout", 0, "timeout of the whole transfer, 0 for none")
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
 	flag.Parse()
-	if ip == "" || httpUrl == "" {
-		log.Fatalln("ip == \"\" ||  url == \"\"")
+	if httpUrl == "" {
+		log.Fatalln("url == \"\"")
 	}
 
 	url2, err := url.Parse(httpUrl)
 	if err != nil {
 		log.Fatalf("url.Parse failed, err:%v", err)
 	}
+	proto, err = quicConn.ParseHttpProto(proto)
+	if err != nil {
+		log.Fatalf("quicConn.ParseHttpProto err:%v", err)
+	}
+
+	var body []byte
+	switch {
+	case data == "@-":
+		body, err = ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		body, err = ioutil.ReadFile(data[1:])
+	default:
+		body = []byte(data)
+	}
+	if err != nil {
+		log.Fatalf("read request body failed, data:%s, err:%v", data, err)
+	}
+	if method == "" {
+		method = http.MethodGet
+		if data != "" {
+			method = http.MethodPost
+		}
+	}
+	var bodyReader io.Reader
+	if data != "" {
+		// bytes.Reader的body可以在307/308重定向时重新发送
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), httpUrl, bodyReader)
+	if err != nil {
+		log.Fatalf("http.NewRequest err:%v", err)
+	}
+	for _, header := range headers {
+		index := strings.Index(header, ":")
+		name, value := strings.TrimSpace(header[:index]), strings.TrimSpace(header[index+1:])
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(name, value)
+	}
+
+	urlPort, _ := strconv.Atoi(url2.Port())
+	if urlPort == 0 {
+		urlPort = 80
+		if url2.Scheme == "https" {
+			urlPort = 443
+		}
+	}
+	if port == 0 {
+		port = urlPort
+	}
+
+	domain := url2.Hostname()
+	addrs, err := addrOptions.Lookup(domain)
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	ip := addrs.Ips[0]
+	quicVersions, err := quicConn.ParseVersions(version)
+	if err != nil || len(quicVersions) != 1 {
+		log.Fatalf("quicConn.ParseVersions failed, version:%s, err:%v", version, err)
+	}
 
-	domain := strings.Split(url2.Host, ":")[0]
+	// ServerName为空时按每个请求的域名设置sni，-L重定向到其他域名时也正确
+	var tlsConfig *tls.Config
+	if proto == quicConn.HttpProtoH3 {
+		tlsConfig, err = tlsOptions.QuicClientConfig("")
+	} else {
+		tlsConfig, err = tlsOptions.ClientConfig("")
+	}
+	if err != nil {
+		log.Fatalf("tlsOptions.ClientConfig err:%v", err)
+	}
+
+	var output io.Writer = os.Stdout
+	var outputFile *os.File
+	if print <= 0 {
+		output = ioutil.Discard
+	} else if outFile != "-" {
+		outputFile, err = os.Create(outFile)
+		if err != nil {
+			log.Fatalf("os.Create failed, file:%s, err:%v", outFile, err)
+		}
+		output = outputFile
+	}
+
+	transport := "tcp"
+	if proto == quicConn.HttpProtoH3 {
+		transport = "quic"
+	} else if url2.Scheme == "https" {
+		transport = "tcp+tls"
+	}
+	recorder := timing.NewRecorder(transport)
+	addrs.RecordDns(recorder)
 
-	roundTripper := &http3.RoundTripper{
+	tracer := quicConn.NewTracer()
+	tracer.QlogDir = qlogDir
+	httpTransport := &quicConn.HttpTransport{
+		Proto:     proto,
+		Addr:      net.JoinHostPort(ip, strconv.Itoa(port)),
+		Host:      net.JoinHostPort(domain, strconv.Itoa(urlPort)),
+		TLSConfig: tlsConfig,
 		QuicConfig: &quic.Config{
-			Versions: []quic.VersionNumber{quic.VersionDraft29},
-		},
-		TLSClientConfig: &tls.Config{
-			ServerName: domain,
-			NextProtos: []string{"rtmp over quic"},
-		},
-		Dial: func(network, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlySession, error) {
-			return quic.DialAddrEarly(fmt.Sprintf("%s:%d", ip, port), tlsCfg, cfg)
+			Versions: quicVersions,
+			Tracer:   tracer,
 		},
+		H3Alpn: quicConn.ParseAlpn(alpn),
+		Timing: recorder,
 	}
-	defer roundTripper.Close()
+	if err := httpTransport.CheckScheme(url2.Scheme); err != nil {
+		log.Fatalln(err)
+	}
+	roundTripper, err := httpTransport.RoundTripper()
+	if err != nil {
+		log.Fatalf("httpTransport.RoundTripper err:%v", err)
+	}
+	redirects := 0
 	hclient := &http.Client{
 		Transport: roundTripper,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !follow {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > maxRedirs {
+				return fmt.Errorf("stopped after %d redirects", maxRedirs)
+			}
+			redirects++
+			fmt.Fprintf(os.Stderr, "redirect to:%s\n", req.URL)
+			return nil
+		},
+	}
+	// h3和h2c的建连由HttpTransport记录，其他的tcp连接和tls握手从httptrace取
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			recorder.Start(timing.PhaseTcpConnect)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			recorder.End(timing.PhaseTcpConnect)
+		},
+		TLSHandshakeStart: func() {
+			recorder.Start(timing.PhaseTlsHandshake)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			recorder.End(timing.PhaseTlsHandshake)
+		},
+	}))
+
+	// ttfb从发出第一个请求算到收到最终的响应头，跟随重定向时包含中间的请求
+	recorder.Start(timing.PhaseHttpTtfb)
+	resp, err := hclient.Do(req)
+	if err != nil {
+		log.Fatalf("hclient.Do err:%v", err)
+	}
+	recorder.End(timing.PhaseHttpTtfb)
+	if httpTransport.H3Session != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", tracer.SessionInfo(httpTransport.H3Session))
+	}
+	fmt.Fprintf(os.Stderr, "http protocol:%s\n", quicConn.NegotiatedHttpProto(resp))
+	if err := httpTransport.CheckResponse(resp); err != nil {
+		log.Fatalln(err)
 	}
-	resp, err := hclient.Get(httpUrl)
+	fmt.Fprintf(os.Stderr, "http status:%v\n", resp.StatusCode)
+
+	if include {
+		fmt.Fprintf(output, "%s %s\r\n", resp.Proto, resp.Status)
+		resp.Header.Write(output)
+		fmt.Fprintf(output, "\r\n")
+	}
+	size, err := io.Copy(output, resp.Body)
+	resp.Body.Close()
 	if err != nil {
-		log.Fatalf("hclient.Get err:%v", err)
-	}
-	fmt.Printf("http status:%v\n", resp.StatusCode)
-	if print > 0 {
-		fmt.Printf("resp:")
-		defer resp.Body.Close()
-		for {
-			buf := make([]byte, 1024)
-			len, err := resp.Body.Read(buf)
-			if err != nil {
-				fmt.Printf("%s", string(buf[:len]))
-				log.Fatalf("\nresp.Body.Read err:%v\n", err)
+		log.Fatalf("read response body failed, size:%d, err:%v", size, err)
+	}
+	end := time.Now()
+	closeRoundTripper(roundTripper)
+	if outputFile != nil {
+		if err := outputFile.Close(); err != nil {
+			log.Fatalf("close output failed, file:%s, err:%v", outFile, err)
+		}
+	}
+
+	if writeOut != "" {
+		fmt.Print(expandWriteOut(writeOut, writeOutValues(recorder, resp, end, size, redirects, ip)))
+	}
+	if fail {
+		os.Exit(exitCode(resp.StatusCode))
+	}
+}
+
+func exitCode(statusCode int) int {
+	switch {
+	case statusCode >= 500:
+		return exitServerError
+	case statusCode >= 400:
+		return exitClientError
+	}
+	return 0
+}
+
+// writeOutVars -w支持的变量，含义和curl相同，时间为从开始(有dns解析时为dns开始)累计的秒数
+var writeOutVars = []string{
+	"http_code", "http_version", "content_type", "remote_ip", "url_effective", "num_redirects",
+	"size_download", "speed_download",
+	"time_namelookup", "time_connect", "time_appconnect", "time_starttransfer", "time_total",
+}
+
+func writeOutValues(recorder *timing.Recorder, resp *http.Response, end time.Time, size int64, redirects int, ip string) map[string]string {
+	seconds := func(ms float64) string {
+		return strconv.FormatFloat(ms/1000, 'f', 6, 64)
+	}
+	phaseEnd := func(names ...string) string {
+		for _, name := range names {
+			if phase, ok := recorder.Get(name); ok {
+				return seconds(phase.EndMs)
 			}
-			fmt.Printf("%s", string(buf[:len]))
 		}
+		return seconds(0)
+	}
+	totalMs := float64(end.Sub(recorder.Begin)) / float64(time.Millisecond)
+	speed := int64(0)
+	if totalMs > 0 {
+		speed = int64(float64(size) * 1000 / totalMs)
+	}
+	return map[string]string{
+		"http_code":       strconv.Itoa(resp.StatusCode),
+		"http_version":    resp.Proto,
+		"content_type":    resp.Header.Get("Content-Type"),
+		"remote_ip":       ip,
+		"url_effective":   resp.Request.URL.String(),
+		"num_redirects":   strconv.Itoa(redirects),
+		"size_download":   strconv.FormatInt(size, 10),
+		"speed_download":  strconv.FormatInt(speed, 10),
+		"time_namelookup": phaseEnd(timing.PhaseDns),
+		// quic没有单独的连接阶段，和curl一样取握手完成的时间
+		"time_connect":       phaseEnd(timing.PhaseTcpConnect, timing.PhaseQuicHandshake),
+		"time_appconnect":    phaseEnd(timing.PhaseTlsHandshake, timing.PhaseQuicHandshake),
+		"time_starttransfer": phaseEnd(timing.PhaseHttpTtfb),
+		"time_total":         seconds(totalMs),
 	}
+}
+
+var writeOutPattern = regexp.MustCompile(`%\{([a-z_]+)\}`)
 
+// expandWriteOut 替换%{name}，并处理\n、\t转义，未知的变量原样保留
+func expandWriteOut(format string, vars map[string]string) string {
+	format = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\r`, "\r").Replace(format)
+	return writeOutPattern.ReplaceAllStringFunc(format, func(match string) string {
+		if value, ok := vars[match[2:len(match)-1]]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// closeRoundTripper http3.RoundTripper需要Close，其他的关闭空闲连接
+func closeRoundTripper(roundTripper http.RoundTripper) {
+	if closer, ok := roundTripper.(io.Closer); ok {
+		closer.Close()
+		return
+	}
+	if idle, ok := roundTripper.(interface{ CloseIdleConnections() }); ok {
+		idle.CloseIdleConnections()
+	}
 }
@@ -1,36 +1,112 @@
 package main
 
 import (
-	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	neturl "net/url"
+	"os"
+	"quic_demo/analytics"
 	"quic_demo/flv"
+	"quic_demo/quicConn"
+	"quic_demo/resolver"
+	"quic_demo/timing"
+	"strconv"
 	"time"
 )
 
 func main() {
 	var url string
-	var ip string
 	var port int
+	var proto string
+	var version string
+	var alpn string
+	var statsInterval int
 	flag.StringVar(&url, "url", "", "such as: https://domain/live/stream.flv")
-	flag.StringVar(&ip, "ip", "", "ip")
-	flag.IntVar(&port, "port", 0, "port")
+	flag.IntVar(&port, "port", 0, "port, default the url port, 443 for https and 80 for http")
+	flag.StringVar(&proto, "proto", quicConn.HttpProtoAuto, "http protocol, auto/h1/h2/h2c/h3, auto negotiates h2 or http/1.1 by alpn")
+	flag.StringVar(&version, "version", "v1", "quic version for h3, v1 or draft29")
+	flag.StringVar(&alpn, "alpn", "", "tls alpn for h3, default h3 for v1 and h3-29 for draft29")
+	flag.IntVar(&statsInterval, "statsInterval", 5, "sliding window bitrate and frame rate interval in seconds, 0 to disable")
+	var analyticsOptions analytics.Options
+	analyticsOptions.AddFlags()
+	var playerOptions analytics.PlayerOptions
+	playerOptions.AddFlags()
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
 	flag.Parse()
 
-	if url == "" || ip == "" || port == 0 {
-		log.Fatalln("domain/uri/ip/port error")
+	if url == "" {
+		log.Fatalln("domain/uri error")
 	}
+	url2, err := neturl.Parse(url)
+	if err != nil {
+		log.Fatalf("url.Parse failed, err:%v", err)
+	}
+	proto, err = quicConn.ParseHttpProto(proto)
+	if err != nil {
+		log.Fatalf("quicConn.ParseHttpProto err:%v", err)
+	}
+	if port == 0 {
+		port, _ = strconv.Atoi(url2.Port())
+	}
+	if port == 0 {
+		port = 80
+		if url2.Scheme == "https" {
+			port = 443
+		}
+	}
+	addrs, err := addrOptions.Lookup(url2.Hostname())
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	serverAddr := net.JoinHostPort(addrs.Ips[0], strconv.Itoa(port))
 
-	dialer := net.Dialer{}
+	httpTransport := &quicConn.HttpTransport{
+		Proto: proto,
+		Addr:  serverAddr,
+	}
+	if err := httpTransport.CheckScheme(url2.Scheme); err != nil {
+		log.Fatalln(err)
+	}
+	if proto == quicConn.HttpProtoH3 {
+		quicVersions, err := quicConn.ParseVersions(version)
+		if err != nil || len(quicVersions) != 1 {
+			log.Fatalf("quicConn.ParseVersions failed, version:%s, err:%v", version, err)
+		}
+		httpTransport.QuicConfig = &quic.Config{Versions: quicVersions}
+		httpTransport.H3Alpn = quicConn.ParseAlpn(alpn)
+		httpTransport.TLSConfig, err = tlsOptions.QuicClientConfig(url2.Hostname())
+		if err != nil {
+			log.Fatalf("tlsOptions.QuicClientConfig err:%v", err)
+		}
+	} else {
+		// ServerName为空时由http.Transport取url中的域名
+		httpTransport.TLSConfig, err = tlsOptions.ClientConfig("")
+		if err != nil {
+			log.Fatalf("tlsOptions.ClientConfig err:%v", err)
+		}
+	}
+	roundTripper, err := httpTransport.RoundTripper()
+	if err != nil {
+		log.Fatalf("httpTransport.RoundTripper err:%v", err)
+	}
 	client := http.Client{
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return dialer.Dial(network, fmt.Sprintf("%s:%d", ip, port))
-			},
-		},
+		Transport: roundTripper,
 	}
 
 	req, err := http.NewRequest(http.MethodGet, url, nil)
@@ -38,32 +114,109 @@ func main() {
 		log.Fatalln("http.NewRequest failed, ", err)
 	}
 
+	transport := "tcp"
+	if proto == quicConn.HttpProtoH3 {
+		transport = "quic"
+	} else if url2.Scheme == "https" {
+		transport = "tcp+tls"
+	}
+	recorder := timing.NewRecorder(transport)
+	addrs.RecordDns(recorder)
+	httpTransport.Timing = recorder
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			recorder.Start(timing.PhaseDns)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			recorder.End(timing.PhaseDns)
+		},
+		ConnectStart: func(network, addr string) {
+			recorder.Start(timing.PhaseTcpConnect)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			recorder.End(timing.PhaseTcpConnect)
+		},
+		TLSHandshakeStart: func() {
+			recorder.Start(timing.PhaseTlsHandshake)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			recorder.End(timing.PhaseTlsHandshake)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			recorder.Start(timing.PhaseHttpTtfb)
+		},
+		GotFirstResponseByte: func() {
+			recorder.End(timing.PhaseHttpTtfb)
+		},
+	}))
+	go func() {
+		recorder.Wait(timing.PhaseFirstVideoKeyframe, 10*time.Second)
+		recorder.Print(os.Stdout)
+	}()
+
 	beginTime := time.Now()
 	fmt.Printf("begin time:%d\n", beginTime.UnixNano()/1e6)
+	if proto == quicConn.HttpProtoH3 {
+		// http3.RoundTripper不回调httptrace，ttfb按收到响应头计算
+		recorder.Start(timing.PhaseHttpTtfb)
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Fatalln("client.Do failed, ", err)
 	}
+	if proto == quicConn.HttpProtoH3 {
+		recorder.End(timing.PhaseHttpTtfb)
+	}
 	respBody := resp.Body
 	defer respBody.Close()
+	fmt.Printf("http protocol:%s\n", quicConn.NegotiatedHttpProto(resp))
+	if err := httpTransport.CheckResponse(resp); err != nil {
+		log.Fatalln(err)
+	}
 
 	if resp.StatusCode != 200 {
 		log.Fatalln("resp.StatusCode error, ", resp.StatusCode)
 	}
 
 	flvParse, err := flv.NewFlvParse(respBody)
-	lastTime := beginTime
-	for true {
-
+	if err != nil {
+		log.Fatalln("flv.NewFlvParse error, ", err)
+	}
+	recorder.Mark(timing.PhaseFlvHeader)
+	analyzer := analytics.NewAnalyzer(analyticsOptions)
+	analyzer.Player = analytics.NewPlayer(playerOptions, beginTime)
+	analyzer.Latency = analytics.NewLatencyMeter()
+	analyzer.PrintOnInterrupt(os.Stdout)
+	lastTime, lastStatsTime := beginTime, beginTime
+	for {
 		tagInfo, err := flvParse.ReadTag()
+		if errors.Is(err, io.EOF) {
+			analyzer.Summary().Print(os.Stdout)
+			return
+		}
 		if err != nil {
+			analyzer.Summary().Print(os.Stdout)
 			log.Fatalln("flvParse.ReadTag error, ", err)
-
 		}
+		recorder.MarkTag(tagInfo.TagType, tagInfo.Body)
 		currentTime := time.Now()
-		fmt.Printf("read tag, curr time:%d, interval:%d, type:%d, body:%d, pts:%d\n",
-			currentTime.UnixNano()/1e6, currentTime.Sub(lastTime).Nanoseconds()/1e6, tagInfo.TagType, len(tagInfo.Body), tagInfo.Timestamp)
-
+		sample := analyzer.AddAt(currentTime, tagInfo.TagType, tagInfo.Timestamp, tagInfo.Body)
+		fmt.Printf("read tag, curr time:%d, interval:%d, type:%d, body:%d, pts:%d, jitter:%.1f, delay:%.1f\n",
+			currentTime.UnixNano()/1e6, currentTime.Sub(lastTime).Nanoseconds()/1e6, tagInfo.TagType, len(tagInfo.Body), tagInfo.Timestamp,
+			sample.JitterMs, sample.DelayMs)
+		lastTime = currentTime
+		if sample.StallMs > 0 {
+			fmt.Printf("stall, gap:%.1fms, pts:%d\n", sample.StallMs, tagInfo.Timestamp)
+		}
+		if event := sample.Player.String(); event != "" {
+			fmt.Printf("%s, pts:%d\n", event, tagInfo.Timestamp)
+		}
+		if sample.Latency != nil {
+			fmt.Printf("latency, %s, pts:%d\n", sample.Latency, tagInfo.Timestamp)
+		}
+		if statsInterval > 0 && currentTime.Sub(lastStatsTime) >= time.Duration(statsInterval)*time.Second {
+			fmt.Printf("flv stats, %s\n", analyzer.WindowStats())
+			lastStatsTime = currentTime
+		}
 	}
-
 }
@@ -0,0 +1,65 @@
+package impair
+
+import (
+	"flag"
+	"time"
+)
+
+// Flags 损伤参数的命令行形式，丢包率等以百分比表示
+type Flags struct {
+	Delay        time.Duration
+	Jitter       time.Duration
+	Loss         float64
+	GeP          float64
+	GeR          float64
+	GeGoodLoss   float64
+	GeBadLoss    float64
+	Reorder      float64
+	ReorderDelay time.Duration
+	RateKbps     int64
+	QueueDelay   time.Duration
+	Outages      string
+}
+
+// AddFlags 在flag.CommandLine上注册损伤参数
+func (f *Flags) AddFlags() {
+	flag.DurationVar(&f.Delay, "delay", 0, "one way delay of each direction")
+	flag.DurationVar(&f.Jitter, "jitter", 0, "delay jitter, uniform in [delay-jitter, delay+jitter]")
+	flag.Float64Var(&f.Loss, "loss", 0, "random loss percent, 0~100")
+	flag.Float64Var(&f.GeP, "geP", 0, "gilbert-elliott good to bad percent per packet, enables bursty loss instead of -loss")
+	flag.Float64Var(&f.GeR, "geR", 30, "gilbert-elliott bad to good percent per packet")
+	flag.Float64Var(&f.GeGoodLoss, "geGoodLoss", 0, "loss percent in the good state")
+	flag.Float64Var(&f.GeBadLoss, "geBadLoss", 100, "loss percent in the bad state")
+	flag.Float64Var(&f.Reorder, "reorder", 0, "reorder percent, a reordered udp packet is delayed by -reorderDelay")
+	flag.DurationVar(&f.ReorderDelay, "reorderDelay", 10*time.Millisecond, "extra delay of reordered packets")
+	flag.Int64Var(&f.RateKbps, "rate", 0, "bandwidth of each direction in kbps, 0 for unlimited")
+	flag.DurationVar(&f.QueueDelay, "queue", 200*time.Millisecond, "max udp queueing delay under -rate before tail drop, 0 for unlimited")
+	flag.StringVar(&f.Outages, "outages", "", "scripted outages from the first packet, such as 10s+2s,30s+5s")
+}
+
+// Config 转换为Config，Seed需要调用方设置
+func (f *Flags) Config() (Config, error) {
+	outages, err := ParseOutages(f.Outages)
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{
+		Delay:        f.Delay,
+		Jitter:       f.Jitter,
+		Loss:         f.Loss / 100,
+		GeP:          f.GeP / 100,
+		GeR:          f.GeR / 100,
+		GeGoodLoss:   f.GeGoodLoss / 100,
+		GeBadLoss:    f.GeBadLoss / 100,
+		Reorder:      f.Reorder / 100,
+		ReorderDelay: f.ReorderDelay,
+		RateKbps:     f.RateKbps,
+		QueueDelay:   f.QueueDelay,
+		Outages:      outages,
+	}, nil
+}
+
+// Enabled 是否配置了任何损伤
+func (c Config) Enabled() bool {
+	return c.Delay > 0 || c.Jitter > 0 || c.Loss > 0 || c.GeP > 0 || c.Reorder > 0 || c.RateKbps > 0 || len(c.Outages) > 0
+}
@@ -0,0 +1,226 @@
+package impair
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config 单方向链路的损伤参数
+type Config struct {
+	Delay        time.Duration // 单向时延
+	Jitter       time.Duration // 时延在[Delay-Jitter, Delay+Jitter]内均匀分布
+	Loss         float64       // 随机丢包率，0~1，GeP>0时不生效
+	GeP          float64       // Gilbert-Elliott模型，每个包从good转到bad的概率
+	GeR          float64       // 从bad转回good的概率
+	GeGoodLoss   float64       // good状态下的丢包率
+	GeBadLoss    float64       // bad状态下的丢包率
+	Reorder      float64       // 乱序概率，被选中的包额外延迟ReorderDelay
+	ReorderDelay time.Duration
+	RateKbps     int64         // 带宽，0不限制
+	QueueDelay   time.Duration // 带宽受限时udp最大排队时延，超过后尾部丢弃，0不限制
+	Outages      []Outage      // 链路中断，时间从链路上第一个包开始算
+	Seed         int64         // 随机数种子，相同的种子和相同的包序列得到相同的结果
+}
+
+// Outage 一次链路中断
+type Outage struct {
+	Start    time.Duration
+	Duration time.Duration
+}
+
+func (o Outage) String() string {
+	return fmt.Sprintf("%v+%v", o.Start, o.Duration)
+}
+
+// ParseOutages 解析"10s+2s,30s+5s"，即第10秒开始中断2秒，第30秒开始中断5秒
+func ParseOutages(outages string) ([]Outage, error) {
+	var result []Outage
+	for _, item := range strings.Split(outages, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "+", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid outage:%s, want start+duration", item)
+		}
+		start, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid outage start:%s, err:%v", item, err)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid outage duration:%s, err:%v", item, err)
+		}
+		result = append(result, Outage{Start: start, Duration: duration})
+	}
+	return result, nil
+}
+
+// LinkStats 链路统计
+type LinkStats struct {
+	Packets     int64
+	Bytes       int64
+	LossDrops   int64 // 随机或突发丢包
+	OutageDrops int64 // 中断期间丢弃
+	QueueDrops  int64 // 排队超时丢弃
+	Reordered   int64
+	Retransmits int64 // tcp上丢包转成的重传等待次数
+	Stalls      int64 // tcp上因中断等待的次数
+}
+
+func (s LinkStats) String() string {
+	return fmt.Sprintf("packets:%d, bytes:%d, loss:%d, outage:%d, queue:%d, reordered:%d, retransmits:%d, stalls:%d",
+		s.Packets, s.Bytes, s.LossDrops, s.OutageDrops, s.QueueDrops, s.Reordered, s.Retransmits, s.Stalls)
+}
+
+// Link 一个方向的链路，决定每个包(或每段tcp数据)何时送达、是否丢弃
+type Link struct {
+	config Config
+
+	lock        sync.Mutex
+	rand        *rand.Rand
+	begin       time.Time
+	bad         bool      // Gilbert-Elliott当前状态
+	busyUntil   time.Time // 带宽受限时链路空闲的时间
+	lastDeliver time.Time // tcp保序，不能早于上一段的送达时间
+	stats       LinkStats
+}
+
+func NewLink(config Config) *Link {
+	return &Link{
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+// Stats 返回当前统计
+func (l *Link) Stats() LinkStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stats
+}
+
+// Packet 数据报(udp)，返回送达时间，drop为true时丢弃
+func (l *Link) Packet(size int, now time.Time) (deliverAt time.Time, drop bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stats.Packets++
+	l.stats.Bytes += int64(size)
+
+	if _, ok := l.outageEnd(now); ok {
+		l.stats.OutageDrops++
+		return now, true
+	}
+	if l.lost() {
+		l.stats.LossDrops++
+		return now, true
+	}
+	sendAt, ok := l.transmit(size, now, true)
+	if !ok {
+		l.stats.QueueDrops++
+		return now, true
+	}
+	deliverAt = sendAt.Add(l.delay())
+	if l.config.Reorder > 0 && l.rand.Float64() < l.config.Reorder {
+		l.stats.Reordered++
+		deliverAt = deliverAt.Add(l.config.ReorderDelay)
+	}
+	return deliverAt, false
+}
+
+// Segment 流式数据(tcp)，不会丢弃也不会乱序。中断期间的数据等到中断结束，
+// 丢包按一次超时重传处理，等待retransmitDelay，后面的数据也要排在它后面(队头阻塞)
+func (l *Link) Segment(size int, now time.Time) time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stats.Packets++
+	l.stats.Bytes += int64(size)
+
+	start := now
+	if end, ok := l.outageEnd(now); ok {
+		l.stats.Stalls++
+		start = end
+	}
+	if l.lost() {
+		l.stats.Retransmits++
+		start = start.Add(l.retransmitDelay())
+	}
+	sendAt, _ := l.transmit(size, start, false)
+	deliverAt := sendAt.Add(l.delay())
+	if deliverAt.Before(l.lastDeliver) {
+		deliverAt = l.lastDeliver
+	}
+	l.lastDeliver = deliverAt
+	return deliverAt
+}
+
+// outageEnd now在某次中断内时返回中断结束的时间
+func (l *Link) outageEnd(now time.Time) (time.Time, bool) {
+	if l.begin.IsZero() {
+		l.begin = now
+	}
+	elapsed := now.Sub(l.begin)
+	for _, outage := range l.config.Outages {
+		if elapsed >= outage.Start && elapsed < outage.Start+outage.Duration {
+			return l.begin.Add(outage.Start + outage.Duration), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (l *Link) lost() bool {
+	if l.config.GeP > 0 {
+		// 先按当前状态决定是否丢包，再做状态转移
+		loss := l.config.GeGoodLoss
+		if l.bad {
+			loss = l.config.GeBadLoss
+		}
+		lost := l.rand.Float64() < loss
+		if l.bad {
+			l.bad = l.rand.Float64() >= l.config.GeR
+		} else {
+			l.bad = l.rand.Float64() < l.config.GeP
+		}
+		return lost
+	}
+	return l.config.Loss > 0 && l.rand.Float64() < l.config.Loss
+}
+
+// transmit 按带宽排队，返回发送完成的时间，dropOnQueue时排队超过QueueDelay返回false
+func (l *Link) transmit(size int, now time.Time, dropOnQueue bool) (time.Time, bool) {
+	if l.config.RateKbps <= 0 {
+		return now, true
+	}
+	if l.busyUntil.Before(now) {
+		l.busyUntil = now
+	}
+	if dropOnQueue && l.config.QueueDelay > 0 && l.busyUntil.Sub(now) > l.config.QueueDelay {
+		return now, false
+	}
+	l.busyUntil = l.busyUntil.Add(time.Duration(int64(size) * 8 * int64(time.Millisecond) / l.config.RateKbps))
+	return l.busyUntil, true
+}
+
+func (l *Link) delay() time.Duration {
+	delay := l.config.Delay
+	if l.config.Jitter > 0 {
+		delay += time.Duration(l.rand.Int63n(int64(2*l.config.Jitter))) - l.config.Jitter
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// retransmitDelay 近似tcp的RTO，srtt取两倍单向时延，最小200ms
+func (l *Link) retransmitDelay() time.Duration {
+	rto := 2*l.config.Delay + 4*l.config.Jitter
+	if rto < 200*time.Millisecond {
+		rto = 200 * time.Millisecond
+	}
+	return rto
+}
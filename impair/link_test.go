@@ -0,0 +1,165 @@
+package impair
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type packetResult struct {
+	deliverAt time.Time
+	drop      bool
+}
+
+// sendPackets 每ms发一个包，大小在几种值之间循环
+func sendPackets(link *Link, begin time.Time, count int) []packetResult {
+	sizes := []int{1200, 80, 600, 1350}
+	results := make([]packetResult, count)
+	for i := range results {
+		now := begin.Add(time.Duration(i) * time.Millisecond)
+		results[i].deliverAt, results[i].drop = link.Packet(sizes[i%len(sizes)], now)
+	}
+	return results
+}
+
+func TestLinkSeedReproducible(t *testing.T) {
+	config := Config{
+		Delay:        20 * time.Millisecond,
+		Jitter:       5 * time.Millisecond,
+		Loss:         0.05,
+		Reorder:      0.1,
+		ReorderDelay: 30 * time.Millisecond,
+		RateKbps:     8000,
+		QueueDelay:   50 * time.Millisecond,
+		Seed:         7,
+	}
+	begin := time.Unix(1700000000, 0)
+	first := sendPackets(NewLink(config), begin, 2000)
+	second := sendPackets(NewLink(config), begin, 2000)
+	for i := range first {
+		if first[i].drop != second[i].drop || !first[i].deliverAt.Equal(second[i].deliverAt) {
+			t.Fatalf("packet %d differs with the same seed, %+v != %+v", i, first[i], second[i])
+		}
+	}
+
+	config.Seed = 8
+	other := sendPackets(NewLink(config), begin, 2000)
+	same := true
+	for i := range first {
+		if first[i].drop != other[i].drop || !first[i].deliverAt.Equal(other[i].deliverAt) {
+			same = false
+			break
+		}
+	}
+	if same {
+		t.Error("a different seed gives the same sequence")
+	}
+
+	// 时延在[Delay-Jitter, Delay+Jitter]内，乱序的包再加ReorderDelay，排队不超过QueueDelay
+	maxDelay := config.Delay + config.Jitter + config.ReorderDelay + config.QueueDelay + 2*time.Millisecond
+	for i, result := range first {
+		if result.drop {
+			continue
+		}
+		delay := result.deliverAt.Sub(begin.Add(time.Duration(i) * time.Millisecond))
+		if delay < config.Delay-config.Jitter || delay > maxDelay {
+			t.Fatalf("packet %d delay:%v, want in [%v, %v]", i, delay, config.Delay-config.Jitter, maxDelay)
+		}
+	}
+}
+
+func TestLinkRandomLoss(t *testing.T) {
+	link := NewLink(Config{Loss: 0.1, Seed: 1})
+	results := sendPackets(link, time.Unix(1700000000, 0), 100000)
+	drops := 0
+	for _, result := range results {
+		if result.drop {
+			drops++
+		}
+	}
+	if rate := float64(drops) / float64(len(results)); math.Abs(rate-0.1) > 0.005 {
+		t.Errorf("loss rate:%.4f, want about 0.1", rate)
+	}
+	if stats := link.Stats(); stats.LossDrops != int64(drops) || stats.Packets != int64(len(results)) {
+		t.Errorf("stats:%v, drops:%d", stats, drops)
+	}
+}
+
+func TestLinkGilbertElliott(t *testing.T) {
+	tests := []struct {
+		p, r, goodLoss, badLoss float64
+	}{
+		{0.05, 0.25, 0.01, 0.5},
+		{0.01, 0.1, 0, 1},
+		{0.2, 0.5, 0.02, 0.3},
+	}
+	for _, test := range tests {
+		link := NewLink(Config{GeP: test.p, GeR: test.r, GeGoodLoss: test.goodLoss, GeBadLoss: test.badLoss, Loss: 0.9, Seed: 3})
+		const packets = 200000
+		drops, badPackets, bursts := 0, 0, 0
+		for i := 0; i < packets; i++ {
+			bad := link.bad
+			if bad {
+				badPackets++
+			}
+			if _, drop := link.Packet(100, time.Unix(1700000000, 0)); drop {
+				drops++
+			}
+			if !bad && link.bad {
+				bursts++
+			}
+		}
+		// 稳态时处于bad的概率为p/(p+r)，bad状态平均持续1/r个包，Loss不生效
+		badRatio := test.p / (test.p + test.r)
+		wantLoss := (1-badRatio)*test.goodLoss + badRatio*test.badLoss
+		if rate := float64(drops) / packets; math.Abs(rate-wantLoss) > 0.1*wantLoss {
+			t.Errorf("%+v: loss rate:%.4f, want about %.4f", test, rate, wantLoss)
+		}
+		if ratio := float64(badPackets) / packets; math.Abs(ratio-badRatio) > 0.1*badRatio {
+			t.Errorf("%+v: bad state ratio:%.4f, want about %.4f", test, ratio, badRatio)
+		}
+		if burst := float64(badPackets) / float64(bursts); math.Abs(burst-1/test.r) > 0.1/test.r {
+			t.Errorf("%+v: mean burst:%.2f packets, want about %.2f", test, burst, 1/test.r)
+		}
+	}
+}
+
+func TestLinkRate(t *testing.T) {
+	// 8000kbps时1000字节的包发送需要1ms，同时到达的包依次排队，排队超过5ms后丢弃
+	link := NewLink(Config{Delay: 10 * time.Millisecond, RateKbps: 8000, QueueDelay: 5 * time.Millisecond})
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 10; i++ {
+		deliverAt, drop := link.Packet(1000, now)
+		if i <= 5 {
+			if want := now.Add(time.Duration(i+1)*time.Millisecond + 10*time.Millisecond); drop || !deliverAt.Equal(want) {
+				t.Errorf("packet %d deliver:%v drop:%v, want:%v", i, deliverAt.Sub(now), drop, want.Sub(now))
+			}
+		} else if !drop {
+			t.Errorf("packet %d should be dropped by the queue, deliver:%v", i, deliverAt.Sub(now))
+		}
+	}
+	if stats := link.Stats(); stats.QueueDrops != 4 {
+		t.Errorf("queue drops:%d, want 4", stats.QueueDrops)
+	}
+}
+
+func TestLinkOutage(t *testing.T) {
+	config := Config{Delay: 10 * time.Millisecond, Outages: []Outage{{Start: time.Second, Duration: 2 * time.Second}}}
+	begin := time.Unix(1700000000, 0)
+	packets := NewLink(config)
+	segments := NewLink(config)
+	for _, at := range []time.Duration{0, 500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second} {
+		now := begin.Add(at)
+		inOutage := at >= time.Second && at < 3*time.Second
+		if _, drop := packets.Packet(100, now); drop != inOutage {
+			t.Errorf("packet at %v drop:%v, want:%v", at, drop, inOutage)
+		}
+		want := now.Add(config.Delay)
+		if inOutage {
+			want = begin.Add(3*time.Second + config.Delay)
+		}
+		if deliverAt := segments.Segment(100, now); !deliverAt.Equal(want) {
+			t.Errorf("segment at %v deliver:%v, want:%v", at, deliverAt.Sub(begin), want.Sub(begin))
+		}
+	}
+}
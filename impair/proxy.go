@@ -0,0 +1,250 @@
+package impair
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// segmentSize tcp每次读取的最大字节数，近似一个MSS，丢包和带宽按这个粒度计算
+const segmentSize = 1400
+
+// UdpProxy 转发udp(quic)，每个客户端地址对应一个到目标的socket，所有客户端共用上下行链路
+type UdpProxy struct {
+	Listen      string
+	Target      string
+	Up          *Link // 客户端到服务端
+	Down        *Link // 服务端到客户端
+	IdleTimeout time.Duration
+
+	conn     net.PacketConn
+	lock     sync.Mutex
+	sessions map[string]*udpSession
+}
+
+type udpSession struct {
+	client     net.Addr
+	upstream   *net.UDPConn
+	lastActive time.Time
+}
+
+func NewUdpProxy(listen, target string, up, down *Link) *UdpProxy {
+	return &UdpProxy{
+		Listen:      listen,
+		Target:      target,
+		Up:          up,
+		Down:        down,
+		IdleTimeout: 60 * time.Second,
+		sessions:    make(map[string]*udpSession),
+	}
+}
+
+// Serve 监听Listen并阻塞转发，监听失败或socket关闭时返回
+func (p *UdpProxy) Serve() error {
+	conn, err := net.ListenPacket("udp", p.Listen)
+	if err != nil {
+		return err
+	}
+	return p.ServePacketConn(conn)
+}
+
+// ServePacketConn 在已经监听的socket上转发，用于监听随机端口
+func (p *UdpProxy) ServePacketConn(conn net.PacketConn) error {
+	targetAddr, err := net.ResolveUDPAddr("udp", p.Target)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	p.conn = conn
+	defer p.conn.Close()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		session, err := p.session(addr, targetAddr)
+		if err != nil {
+			log.Printf("udp proxy dial target failed, client:%v, err:%v", addr, err)
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+		deliver(p.Up, data, func(data []byte) {
+			session.upstream.Write(data)
+		})
+	}
+}
+
+func (p *UdpProxy) session(client net.Addr, target *net.UDPAddr) (*udpSession, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if session, ok := p.sessions[client.String()]; ok {
+		session.lastActive = time.Now()
+		return session, nil
+	}
+	upstream, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return nil, err
+	}
+	session := &udpSession{
+		client:     client,
+		upstream:   upstream,
+		lastActive: time.Now(),
+	}
+	p.sessions[client.String()] = session
+	log.Printf("udp proxy new session, client:%v, local:%v", client, upstream.LocalAddr())
+	go p.readUpstream(session)
+	return session, nil
+}
+
+// readUpstream 把目标的回包经下行链路发回客户端，空闲超时后关闭
+func (p *UdpProxy) readUpstream(session *udpSession) {
+	defer session.upstream.Close()
+	buf := make([]byte, 65536)
+	for {
+		session.upstream.SetReadDeadline(time.Now().Add(p.IdleTimeout))
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !p.idle(session) {
+				continue
+			}
+			p.lock.Lock()
+			delete(p.sessions, session.client.String())
+			p.lock.Unlock()
+			log.Printf("udp proxy session closed, client:%v, err:%v", session.client, err)
+			return
+		}
+		data := append([]byte(nil), buf[:n]...)
+		deliver(p.Down, data, func(data []byte) {
+			p.conn.WriteTo(data, session.client)
+		})
+	}
+}
+
+func (p *UdpProxy) idle(session *udpSession) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return time.Since(session.lastActive) >= p.IdleTimeout
+}
+
+// deliver 按链路决定丢弃还是延迟发送，乱序和抖动由各自的定时器自然产生
+func deliver(link *Link, data []byte, write func([]byte)) {
+	deliverAt, drop := link.Packet(len(data), time.Now())
+	if drop {
+		return
+	}
+	time.AfterFunc(time.Until(deliverAt), func() {
+		write(data)
+	})
+}
+
+// TcpProxy 转发tcp(rtmp/rtmps)，每个连接的两个方向分别经过上下行链路。
+// 三次握手在本机完成，不经过模拟时延，比较建连耗时时需要考虑
+type TcpProxy struct {
+	Listen string
+	Target string
+	Up     *Link
+	Down   *Link
+}
+
+func NewTcpProxy(listen, target string, up, down *Link) *TcpProxy {
+	return &TcpProxy{
+		Listen: listen,
+		Target: target,
+		Up:     up,
+		Down:   down,
+	}
+}
+
+// Serve 监听Listen并阻塞接受连接，监听失败时返回
+func (p *TcpProxy) Serve() error {
+	listener, err := net.Listen("tcp", p.Listen)
+	if err != nil {
+		return err
+	}
+	return p.ServeListener(listener)
+}
+
+// ServeListener 在已经监听的listener上接受连接，listener关闭时返回
+func (p *TcpProxy) ServeListener(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *TcpProxy) handle(client net.Conn) {
+	defer client.Close()
+	server, err := net.DialTimeout("tcp", p.Target, 10*time.Second)
+	if err != nil {
+		log.Printf("tcp proxy dial target failed, client:%v, err:%v", client.RemoteAddr(), err)
+		return
+	}
+	defer server.Close()
+	log.Printf("tcp proxy new connection, client:%v", client.RemoteAddr())
+
+	done := make(chan struct{}, 2)
+	go func() {
+		pipe(client, server, p.Up)
+		done <- struct{}{}
+	}()
+	go func() {
+		pipe(server, client, p.Down)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	log.Printf("tcp proxy connection closed, client:%v", client.RemoteAddr())
+}
+
+type segment struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe 从src读取，按链路给出的时间写入dst。队列有上限，带宽受限时反压到src
+func pipe(src net.Conn, dst net.Conn, link *Link) {
+	segments := make(chan segment, 256)
+	go func() {
+		defer close(segments)
+		buf := make([]byte, segmentSize)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				data := append([]byte(nil), buf[:n]...)
+				segments <- segment{data: data, deliverAt: link.Segment(n, time.Now())}
+			}
+			if err != nil {
+				if err != io.EOF {
+					dst.Close()
+				}
+				return
+			}
+		}
+	}()
+
+	for seg := range segments {
+		time.Sleep(time.Until(seg.deliverAt))
+		if _, err := dst.Write(seg.data); err != nil {
+			src.Close()
+			// 读协程可能阻塞在满的队列上，取完剩下的数据让它退出
+			for range segments {
+			}
+			return
+		}
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"quic_demo/impair"
+	"time"
+)
+
+func main() {
+
+	var listen string
+	var target string
+	var udp bool
+	var tcp bool
+	var seed int64
+	var statsInterval int
+	flag.StringVar(&listen, "listen", ":8443", "listen addr, the same port for udp and tcp")
+	flag.StringVar(&target, "target", "", "target server addr, such as 127.0.0.1:443")
+	flag.BoolVar(&udp, "udp", true, "proxy udp (quic)")
+	flag.BoolVar(&tcp, "tcp", true, "proxy tcp (rtmp/rtmps)")
+	flag.Int64Var(&seed, "seed", 1, "random seed, the same seed and packet sequence give the same result")
+	flag.IntVar(&statsInterval, "statsInterval", 5, "stats interval in seconds, 0 to disable")
+	var impairFlags impair.Flags
+	impairFlags.AddFlags()
+	flag.Parse()
+	if target == "" || (!udp && !tcp) {
+		log.Fatalln("target == \"\" || (!udp && !tcp)")
+	}
+
+	config, err := impairFlags.Config()
+	if err != nil {
+		log.Fatalf("impairFlags.Config err:%v", err)
+	}
+	log.Printf("impair proxy, listen:%s, target:%s, config:%+v", listen, target, config)
+
+	// udp和tcp、上行和下行各用一条链路和一个随机数序列，互不影响，便于复现
+	links := make(map[string]*impair.Link)
+	newLink := func(name string, index int64) *impair.Link {
+		linkConfig := config
+		linkConfig.Seed = seed + index
+		links[name] = impair.NewLink(linkConfig)
+		return links[name]
+	}
+
+	errCh := make(chan error, 2)
+	if udp {
+		proxy := impair.NewUdpProxy(listen, target, newLink("udp up", 0), newLink("udp down", 1))
+		go func() {
+			errCh <- proxy.Serve()
+		}()
+	}
+	if tcp {
+		proxy := impair.NewTcpProxy(listen, target, newLink("tcp up", 2), newLink("tcp down", 3))
+		go func() {
+			errCh <- proxy.Serve()
+		}()
+	}
+
+	if statsInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(statsInterval) * time.Second) {
+				for _, name := range []string{"udp up", "udp down", "tcp up", "tcp down"} {
+					if link, ok := links[name]; ok {
+						log.Printf("%s stats, %v", name, link.Stats())
+					}
+				}
+			}
+		}()
+	}
+
+	log.Fatalf("proxy exit, err:%v", <-errCh)
+}
@@ -0,0 +1,167 @@
+package latency
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"time"
+
+	amf "github.com/zhangpeihao/goamf"
+)
+
+// 推流端按间隔在流中插入发送时的墙钟时间和序号，播放端取出后与收到时的墙钟相减得到端到端时延。
+// 推流和播放在同一台机器上时两边是同一个时钟，测到的就是准确的从推流到播放的时延。
+// 两种方式：amf在音视频tag之间插入一个onTextData的script tag，sei在视频帧前面插入一个
+// H.264/H.265的user data unregistered SEI，sei会随视频帧经过转码以外的所有环节
+
+const (
+	ModeAmf = "amf"
+	ModeSei = "sei"
+
+	audioTag  = 8
+	videoTag  = 9
+	scriptTag = 18
+
+	// TextDataName onTextData tag的名字
+	TextDataName = "onTextData"
+)
+
+// Options 推流端插入时间标记的参数
+type Options struct {
+	Mode     string // amf或sei，为空时不插入
+	Interval time.Duration
+}
+
+func (o *Options) AddFlags() {
+	flag.StringVar(&o.Mode, "marker", "", "inject the wall clock time and a sequence number for end-to-end latency, amf (onTextData tag) or sei (h264/h265 user data unregistered), empty for none")
+	flag.DurationVar(&o.Interval, "markerInterval", time.Second, "interval of the latency markers")
+}
+
+// NewInjector Mode为空时返回nil
+func (o Options) NewInjector() (*Injector, error) {
+	switch o.Mode {
+	case "":
+		return nil, nil
+	case ModeAmf, ModeSei:
+	default:
+		return nil, fmt.Errorf("unknown marker mode:%s", o.Mode)
+	}
+	if o.Interval <= 0 {
+		return nil, fmt.Errorf("marker interval should be positive, interval:%v", o.Interval)
+	}
+	return &Injector{Options: o, lengthSize: 4}, nil
+}
+
+// Marker 推流端插入的时间标记
+type Marker struct {
+	Seq      uint64
+	SendTime time.Time
+}
+
+// Injector 在推流的tag中插入Marker，nil时不插入
+type Injector struct {
+	Options
+
+	seq        uint64
+	last       time.Time
+	lengthSize int // sequence header中的NALU长度字段字节数
+}
+
+// Inject 发送一个tag之前调用。到了间隔时amf模式返回需要在这个tag之前发送的onTextData tag，
+// sei模式把SEI插入到下一个H.264/H.265视频帧中返回新的body，其他编码的视频不插入。
+// 没有插入时script为nil，body原样返回
+func (i *Injector) Inject(tagType uint8, body []byte) (script []byte, out []byte) {
+	if i == nil {
+		return nil, body
+	}
+	if tagType == videoTag {
+		if size, ok := nalLengthSize(body); ok {
+			i.lengthSize = size
+		}
+	}
+	now := time.Now()
+	if !i.last.IsZero() && now.Sub(i.last) < i.Interval {
+		return nil, body
+	}
+	marker := Marker{Seq: i.seq, SendTime: now}
+	switch i.Mode {
+	case ModeAmf:
+		if tagType != audioTag && tagType != videoTag {
+			return nil, body
+		}
+		script = EncodeTextData(marker)
+	case ModeSei:
+		// 音频tag第一个字节的低4位是采样率等标志，可能与AVC/HEVC的codec id相同
+		if tagType != videoTag {
+			return nil, body
+		}
+		var ok bool
+		if out, ok = insertSei(body, i.lengthSize, marker); !ok {
+			return nil, body
+		}
+		body = out
+	default:
+		return nil, body
+	}
+	i.seq++
+	i.last = now
+	return script, body
+}
+
+// EncodeTextData 编码为onTextData script tag的body
+func EncodeTextData(marker Marker) []byte {
+	buf := new(bytes.Buffer)
+	amf.WriteString(buf, TextDataName)
+	amf.WriteObject(buf, amf.Object{
+		"text": fmt.Sprintf("latency seq:%d time:%d", marker.Seq, marker.SendTime.UnixNano()/1e3),
+		"seq":  float64(marker.Seq),
+		"time": float64(marker.SendTime.UnixNano()) / 1e6,
+	})
+	return buf.Bytes()
+}
+
+// decodeTextData 只接受带有数值seq和time的onTextData
+func decodeTextData(body []byte) (Marker, bool) {
+	reader := bytes.NewReader(body)
+	name, err := amf.ReadValue(reader)
+	if err != nil || name != TextDataName {
+		return Marker{}, false
+	}
+	value, err := amf.ReadValue(reader)
+	if err != nil {
+		return Marker{}, false
+	}
+	object, ok := value.(amf.Object)
+	if !ok {
+		return Marker{}, false
+	}
+	seq, ok1 := object["seq"].(float64)
+	ms, ok2 := object["time"].(float64)
+	if !ok1 || !ok2 {
+		return Marker{}, false
+	}
+	return Marker{Seq: uint64(seq), SendTime: time.Unix(0, int64(ms*1e6))}, true
+}
+
+// Extractor 从收到的tag中取出Marker
+type Extractor struct {
+	lengthSize int
+}
+
+// Extract script tag按onTextData解析，视频tag查找带有标记的SEI
+func (e *Extractor) Extract(tagType uint8, body []byte) (Marker, bool) {
+	switch tagType {
+	case scriptTag:
+		return decodeTextData(body)
+	case videoTag:
+		if size, ok := nalLengthSize(body); ok {
+			e.lengthSize = size
+			return Marker{}, false
+		}
+		if e.lengthSize == 0 {
+			e.lengthSize = 4
+		}
+		return findSei(body, e.lengthSize)
+	}
+	return Marker{}, false
+}
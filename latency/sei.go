@@ -0,0 +1,238 @@
+package latency
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	codecAvc  = 7
+	codecHevc = 12
+
+	seiUserDataUnregistered = 5
+)
+
+// markerUuid user data unregistered的uuid，用来区分其他SEI
+var markerUuid = []byte("quic_demo-marker")
+
+// nalLengthSize AVC/HEVC sequence header中NALU长度字段的字节数，不是sequence header时ok为false
+func nalLengthSize(body []byte) (int, bool) {
+	if len(body) < 5 || body[1] != 0 {
+		return 0, false
+	}
+	record := body[5:]
+	switch body[0] & 0x0f {
+	case codecAvc:
+		if len(record) > 4 {
+			return int(record[4]&0x03) + 1, true
+		}
+	case codecHevc:
+		if len(record) > 21 {
+			return int(record[21]&0x03) + 1, true
+		}
+	}
+	return 0, false
+}
+
+// nalHeaderSize H.264的NALU头1字节，H.265为2字节
+func nalHeaderSize(codec byte) int {
+	if codec == codecHevc {
+		return 2
+	}
+	return 1
+}
+
+func nalType(codec byte, nal []byte) byte {
+	if codec == codecHevc {
+		return (nal[0] >> 1) & 0x3f
+	}
+	return nal[0] & 0x1f
+}
+
+func isAud(codec byte, nal []byte) bool {
+	if codec == codecHevc {
+		return nalType(codec, nal) == 35
+	}
+	return nalType(codec, nal) == 9
+}
+
+func isSei(codec byte, nal []byte) bool {
+	if codec == codecHevc {
+		t := nalType(codec, nal)
+		return t == 39 || t == 40
+	}
+	return nalType(codec, nal) == 6
+}
+
+// splitNalus 按长度字段拆分视频tag中的NALU，格式不对时ok为false
+func splitNalus(data []byte, lengthSize int) (nalus [][]byte, ok bool) {
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nil, false
+		}
+		size := 0
+		for _, b := range data[:lengthSize] {
+			size = size<<8 | int(b)
+		}
+		data = data[lengthSize:]
+		if size == 0 || size > len(data) {
+			return nil, false
+		}
+		nalus = append(nalus, data[:size])
+		data = data[size:]
+	}
+	return nalus, true
+}
+
+// encodeSei 生成带长度字段的SEI NALU
+func encodeSei(codec byte, lengthSize int, marker Marker) []byte {
+	payload := make([]byte, 0, 32)
+	payload = append(payload, markerUuid...)
+	payload = appendUint64(payload, marker.Seq)
+	payload = appendUint64(payload, uint64(marker.SendTime.UnixNano()/1e3))
+	rbsp := []byte{seiUserDataUnregistered, byte(len(payload))}
+	rbsp = append(rbsp, payload...)
+	rbsp = append(rbsp, 0x80)
+
+	var nal []byte
+	if codec == codecHevc {
+		// prefix SEI，nuh_temporal_id_plus1为1
+		nal = []byte{39 << 1, 0x01}
+	} else {
+		nal = []byte{0x06}
+	}
+	nal = append(nal, escapeRbsp(rbsp)...)
+	length := make([]byte, lengthSize)
+	for i, size := lengthSize-1, len(nal); i >= 0; i, size = i-1, size>>8 {
+		length[i] = byte(size)
+	}
+	return append(length, nal...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// insertSei 在视频帧的第一个NALU之前(有AUD时在AUD之后)插入SEI，sequence header和其他编码返回false
+func insertSei(body []byte, lengthSize int, marker Marker) ([]byte, bool) {
+	if len(body) < 5 || body[1] != 1 {
+		return nil, false
+	}
+	codec := body[0] & 0x0f
+	if codec != codecAvc && codec != codecHevc {
+		return nil, false
+	}
+	nalus, ok := splitNalus(body[5:], lengthSize)
+	if !ok || len(nalus) == 0 {
+		return nil, false
+	}
+	offset := 5
+	if len(nalus[0]) >= nalHeaderSize(codec) && isAud(codec, nalus[0]) {
+		offset += lengthSize + len(nalus[0])
+	}
+	sei := encodeSei(codec, lengthSize, marker)
+	out := make([]byte, 0, len(body)+len(sei))
+	out = append(out, body[:offset]...)
+	out = append(out, sei...)
+	out = append(out, body[offset:]...)
+	return out, true
+}
+
+// findSei 查找视频帧中带有markerUuid的user data unregistered SEI
+func findSei(body []byte, lengthSize int) (Marker, bool) {
+	if len(body) < 5 || body[1] != 1 {
+		return Marker{}, false
+	}
+	codec := body[0] & 0x0f
+	if codec != codecAvc && codec != codecHevc {
+		return Marker{}, false
+	}
+	nalus, ok := splitNalus(body[5:], lengthSize)
+	if !ok {
+		return Marker{}, false
+	}
+	headerSize := nalHeaderSize(codec)
+	for _, nal := range nalus {
+		if len(nal) <= headerSize || !isSei(codec, nal) {
+			continue
+		}
+		if marker, ok := parseSeiMessages(unescapeRbsp(nal[headerSize:])); ok {
+			return marker, true
+		}
+	}
+	return Marker{}, false
+}
+
+// parseSeiMessages 依次解析SEI中的各个message，payloadType和payloadSize都是0xff累加的编码
+func parseSeiMessages(rbsp []byte) (Marker, bool) {
+	readValue := func() (int, bool) {
+		value := 0
+		for len(rbsp) > 0 {
+			b := rbsp[0]
+			rbsp = rbsp[1:]
+			value += int(b)
+			if b != 0xff {
+				return value, true
+			}
+		}
+		return 0, false
+	}
+	// 剩下的只有rbsp_trailing_bits时结束
+	for len(rbsp) > 1 {
+		payloadType, ok1 := readValue()
+		payloadSize, ok2 := readValue()
+		if !ok1 || !ok2 || payloadSize > len(rbsp) {
+			return Marker{}, false
+		}
+		payload := rbsp[:payloadSize]
+		rbsp = rbsp[payloadSize:]
+		if payloadType == seiUserDataUnregistered && len(payload) >= 32 && bytes.Equal(payload[:16], markerUuid) {
+			return Marker{
+				Seq:      binary.BigEndian.Uint64(payload[16:24]),
+				SendTime: time.Unix(0, int64(binary.BigEndian.Uint64(payload[24:32]))*1e3),
+			}, true
+		}
+	}
+	return Marker{}, false
+}
+
+// escapeRbsp 插入防竞争字节：连续两个0之后的0到3前面加0x03
+func escapeRbsp(rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+4)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// unescapeRbsp 去掉防竞争字节
+func unescapeRbsp(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
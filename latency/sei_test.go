@@ -0,0 +1,199 @@
+package latency
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// buildFrame 按长度字段拼出视频tag的body
+func buildFrame(head []byte, lengthSize int, nalus ...[]byte) []byte {
+	body := append([]byte(nil), head...)
+	for _, nal := range nalus {
+		for i := lengthSize - 1; i >= 0; i-- {
+			body = append(body, byte(len(nal)>>(8*uint(i))))
+		}
+		body = append(body, nal...)
+	}
+	return body
+}
+
+func TestEscapeRbsp(t *testing.T) {
+	tests := []struct {
+		rbsp    []byte
+		escaped []byte
+	}{
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0, 0, 0}, []byte{0, 0, 3, 0}},
+		{[]byte{0, 0, 1}, []byte{0, 0, 3, 1}},
+		{[]byte{0, 0, 2}, []byte{0, 0, 3, 2}},
+		{[]byte{0, 0, 3}, []byte{0, 0, 3, 3}},
+		{[]byte{0, 0, 4}, []byte{0, 0, 4}},
+		{[]byte{0, 0, 0, 0, 0}, []byte{0, 0, 3, 0, 0, 3, 0}},
+		{[]byte{0, 1, 0, 0, 0x80}, []byte{0, 1, 0, 0, 0x80}},
+	}
+	for _, test := range tests {
+		if escaped := escapeRbsp(test.rbsp); !bytes.Equal(escaped, test.escaped) {
+			t.Errorf("escapeRbsp(%x):%x, want:%x", test.rbsp, escaped, test.escaped)
+		}
+		if rbsp := unescapeRbsp(test.escaped); !bytes.Equal(rbsp, test.rbsp) {
+			t.Errorf("unescapeRbsp(%x):%x, want:%x", test.escaped, rbsp, test.rbsp)
+		}
+	}
+}
+
+func TestSeiRoundTrip(t *testing.T) {
+	avcAud := []byte{0x09, 0xf0}
+	avcIdr := []byte{0x65, 0x88, 0x84, 0x00, 0x00, 0x03}
+	avcSlice := []byte{0x41, 0x9a, 0x00}
+	hevcAud := []byte{35 << 1, 0x01, 0x50}
+	hevcIdr := []byte{19 << 1, 0x01, 0xaf, 0x00, 0x00}
+	hevcSlice := []byte{1 << 1, 0x01, 0xd0}
+	avcKey := []byte{0x17, 1, 0, 0, 0}
+	avcInter := []byte{0x27, 1, 0, 0, 0x28}
+	hevcKey := []byte{0x1c, 1, 0, 0, 0}
+
+	// seq为0、时间为整秒时payload中有连续的0，需要插入防竞争字节
+	zeroMarker := Marker{Seq: 0, SendTime: time.Unix(1700000000, 0)}
+	marker := Marker{Seq: 1<<40 | 3, SendTime: time.Unix(1700000000, 123456000)}
+
+	tests := []struct {
+		name       string
+		head       []byte
+		lengthSize int
+		nalus      [][]byte
+		aud        bool
+		marker     Marker
+	}{
+		{"avc", avcKey, 4, [][]byte{avcIdr}, false, marker},
+		{"avc with aud", avcInter, 4, [][]byte{avcAud, avcSlice}, true, marker},
+		{"avc escaped", avcKey, 4, [][]byte{avcIdr, avcSlice}, false, zeroMarker},
+		{"avc 2 byte length with aud", avcKey, 2, [][]byte{avcAud, avcIdr}, true, zeroMarker},
+		{"hevc", hevcKey, 4, [][]byte{hevcIdr}, false, marker},
+		{"hevc with aud", hevcKey, 4, [][]byte{hevcAud, hevcIdr, hevcSlice}, true, marker},
+		{"hevc escaped with aud", hevcKey, 4, [][]byte{hevcAud, hevcIdr}, true, zeroMarker},
+	}
+	for _, test := range tests {
+		body := buildFrame(test.head, test.lengthSize, test.nalus...)
+		if _, ok := findSei(body, test.lengthSize); ok {
+			t.Errorf("%s: marker found before inserting", test.name)
+		}
+		out, ok := insertSei(body, test.lengthSize, test.marker)
+		if !ok {
+			t.Errorf("%s: insertSei failed", test.name)
+			continue
+		}
+		got, ok := findSei(out, test.lengthSize)
+		if !ok {
+			t.Errorf("%s: findSei failed, body:%x", test.name, out)
+			continue
+		}
+		if got.Seq != test.marker.Seq || !got.SendTime.Equal(test.marker.SendTime) {
+			t.Errorf("%s: marker:%+v, want:%+v", test.name, got, test.marker)
+		}
+
+		// 原有的NALU保持不变，SEI在第一个NALU之前，有AUD时在AUD之后
+		if !bytes.Equal(out[:5], test.head) {
+			t.Errorf("%s: tag header:%x, want:%x", test.name, out[:5], test.head)
+		}
+		nalus, ok := splitNalus(out[5:], test.lengthSize)
+		if !ok || len(nalus) != len(test.nalus)+1 {
+			t.Errorf("%s: nalus:%d, want:%d", test.name, len(nalus), len(test.nalus)+1)
+			continue
+		}
+		seiIndex := 0
+		if test.aud {
+			seiIndex = 1
+		}
+		codec := test.head[0] & 0x0f
+		if !isSei(codec, nalus[seiIndex]) {
+			t.Errorf("%s: nalu %d is not sei:%x", test.name, seiIndex, nalus[seiIndex])
+		}
+		rest := append(append([][]byte(nil), nalus[:seiIndex]...), nalus[seiIndex+1:]...)
+		for i := range rest {
+			if !bytes.Equal(rest[i], test.nalus[i]) {
+				t.Errorf("%s: nalu %d:%x, want:%x", test.name, i, rest[i], test.nalus[i])
+			}
+		}
+		if test.marker == zeroMarker && !bytes.Contains(nalus[seiIndex], []byte{0, 0, 3}) {
+			t.Errorf("%s: no emulation prevention byte in sei:%x", test.name, nalus[seiIndex])
+		}
+	}
+}
+
+func TestInsertSeiSkipped(t *testing.T) {
+	marker := Marker{Seq: 1, SendTime: time.Unix(1700000000, 0)}
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"avc sequence header", []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f, 0xff, 0xe1}},
+		{"other codec", []byte{0x22, 1, 0, 0, 0, 0, 0, 0, 1, 0x65}},
+		{"short", []byte{0x17, 1, 0}},
+		{"bad length", buildFrame([]byte{0x17, 1, 0, 0, 0}, 4, []byte{0x65, 0x88})[:9]},
+		{"no nalu", []byte{0x17, 1, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		if _, ok := insertSei(test.body, 4, marker); ok {
+			t.Errorf("%s: insertSei should skip", test.name)
+		}
+	}
+}
+
+func TestTextDataRoundTrip(t *testing.T) {
+	marker := Marker{Seq: 42, SendTime: time.Unix(1700000000, 123456000)}
+	got, ok := decodeTextData(EncodeTextData(marker))
+	if !ok {
+		t.Fatal("decodeTextData failed")
+	}
+	// time以毫秒的float64传输，允许1微秒以内的误差
+	if diff := got.SendTime.Sub(marker.SendTime); got.Seq != marker.Seq || diff > time.Microsecond || diff < -time.Microsecond {
+		t.Errorf("marker:%+v, want:%+v", got, marker)
+	}
+
+	var extractor Extractor
+	if got, ok := extractor.Extract(scriptTag, EncodeTextData(marker)); !ok || got.Seq != marker.Seq {
+		t.Errorf("Extract script tag, marker:%+v, ok:%v", got, ok)
+	}
+	if _, ok := decodeTextData([]byte{2, 0, 10, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'}); ok {
+		t.Error("decodeTextData should reject onMetaData")
+	}
+	if _, ok := decodeTextData(nil); ok {
+		t.Error("decodeTextData should reject an empty body")
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	injector, err := Options{Mode: ModeSei, Interval: time.Hour}.NewInjector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2字节长度字段的AVC sequence header
+	sequenceHeader := []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f, 0xfd, 0xe1}
+	if _, out := injector.Inject(videoTag, sequenceHeader); !bytes.Equal(out, sequenceHeader) {
+		t.Errorf("sequence header changed:%x", out)
+	}
+	// 音频tag的第一个字节低4位可能与AVC的codec id相同，不能插入
+	audio := buildFrame([]byte{0xa7, 1, 0, 0, 0}, 2, []byte{0x65, 0x88})
+	if script, out := injector.Inject(audioTag, audio); script != nil || !bytes.Equal(out, audio) {
+		t.Errorf("audio tag changed:%x", out)
+	}
+	frame := buildFrame([]byte{0x17, 1, 0, 0, 0}, 2, []byte{0x65, 0x88, 0x84})
+	_, out := injector.Inject(videoTag, frame)
+	if bytes.Equal(out, frame) {
+		t.Fatal("sei not inserted")
+	}
+	// 间隔没到时不再插入
+	if _, again := injector.Inject(videoTag, frame); !bytes.Equal(again, frame) {
+		t.Error("sei inserted before the interval")
+	}
+
+	var extractor Extractor
+	if _, ok := extractor.Extract(videoTag, sequenceHeader); ok {
+		t.Error("marker found in the sequence header")
+	}
+	marker, ok := extractor.Extract(videoTag, out)
+	if !ok || marker.Seq != 0 {
+		t.Errorf("marker:%+v, ok:%v", marker, ok)
+	}
+}
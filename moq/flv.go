@@ -0,0 +1,102 @@
+package moq
+
+import (
+	"bytes"
+	"quic_demo/flv"
+	"quic_demo/rtmpServer"
+)
+
+// FLV到MoQ的映射：每个视频关键帧开始一个新group，group的前几个对象是当前的metadata和
+// sequence header，之后每个tag一个对象，对象payload是带PreviousTagSize的完整flv tag。
+// 订阅者从任意group开始都能解码
+
+const (
+	headerMetadata = iota
+	headerVideo
+	headerAudio
+	headerCount
+)
+
+func headerSlot(tag *flv.TagInfo) int {
+	switch {
+	case rtmpServer.IsMetaData(tag):
+		return headerMetadata
+	case rtmpServer.IsSequenceHeader(tag) && tag.TagType == flv.VIDEO_TAG:
+		return headerVideo
+	case rtmpServer.IsSequenceHeader(tag):
+		return headerAudio
+	}
+	return -1
+}
+
+func encodeTag(tag *flv.TagInfo) []byte {
+	buf := &bytes.Buffer{}
+	flv.WriteTag(buf, tag)
+	return buf.Bytes()
+}
+
+// TagWriter 把flv tag按GOP写入track
+type TagWriter struct {
+	track   *Track
+	headers [headerCount][]byte
+	started bool
+	group   uint64
+}
+
+func NewTagWriter(track *Track) *TagWriter {
+	return &TagWriter{track: track}
+}
+
+// WriteTag 第一个关键帧之前的音频在group 0
+func (w *TagWriter) WriteTag(tag *flv.TagInfo) error {
+	payload := encodeTag(tag)
+	if slot := headerSlot(tag); slot >= 0 {
+		w.headers[slot] = payload
+		if !w.started {
+			return nil
+		}
+		return w.track.WriteObject(w.group, payload)
+	}
+	if rtmpServer.IsKeyFrame(tag) || !w.started {
+		if w.started {
+			w.group++
+		}
+		w.started = true
+		for _, header := range w.headers {
+			if header == nil {
+				continue
+			}
+			if err := w.track.WriteObject(w.group, header); err != nil {
+				return err
+			}
+		}
+	}
+	return w.track.WriteObject(w.group, payload)
+}
+
+func (w *TagWriter) Close() {
+	w.track.Close()
+}
+
+// ReadTags 把对象解析为flv tag，每个group开头重复的metadata和sequence header只在变化时输出
+func ReadTags(objects <-chan Object) <-chan *flv.TagInfo {
+	tags := make(chan *flv.TagInfo, 64)
+	go func() {
+		defer close(tags)
+		var headers [headerCount][]byte
+		for obj := range objects {
+			tag, err := (&flv.FlvParse{Reader: bytes.NewReader(obj.Payload)}).ReadTag()
+			if err != nil {
+				continue
+			}
+			if slot := headerSlot(tag); slot >= 0 {
+				if bytes.Equal(headers[slot], obj.Payload) {
+					continue
+				}
+				headers[slot] = obj.Payload
+			}
+			tags <- tag
+		}
+	}()
+	return tags
+}
@@ -0,0 +1,510 @@
+package moq
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"io"
+)
+
+// 按draft-ietf-moq-transport-04实现的最小子集：控制消息、STREAM_HEADER_GROUP和对象，
+// 不支持datagram对象、track流和订阅范围
+
+const MoqAlpn = "moq-00"
+
+const Draft04 = 0xff000004
+
+const (
+	msgSubscribe         = 0x03
+	msgSubscribeOk       = 0x04
+	msgSubscribeError    = 0x05
+	msgAnnounce          = 0x06
+	msgAnnounceOk        = 0x07
+	msgAnnounceError     = 0x08
+	msgUnannounce        = 0x09
+	msgUnsubscribe       = 0x0a
+	msgSubscribeDone     = 0x0b
+	msgGoAway            = 0x10
+	msgClientSetup       = 0x40
+	msgServerSetup       = 0x41
+	msgStreamHeaderGroup = 0x51
+)
+
+// setup参数
+const (
+	paramRole = 0x00
+	paramPath = 0x01
+)
+
+const (
+	RolePublisher  = 0x01
+	RoleSubscriber = 0x02
+	RolePubSub     = 0x03
+)
+
+// 订阅过滤类型，只支持从最新的group或object开始
+const (
+	filterLatestGroup   = 0x01
+	filterLatestObject  = 0x02
+	filterAbsoluteStart = 0x03
+	filterAbsoluteRange = 0x04
+)
+
+// ANNOUNCE_ERROR错误码
+const (
+	CodeAnnounceInternalError = 0x00
+)
+
+// SUBSCRIBE_ERROR错误码
+const (
+	CodeSubscribeInternalError   = 0x00
+	CodeSubscribeTrackNotExist   = 0x02
+	CodeSubscribeFilterNotExists = 0x04
+)
+
+// SUBSCRIBE_DONE状态码
+const (
+	CodeDoneUnsubscribed  = 0x00
+	CodeDoneInternalError = 0x01
+	CodeDoneTrackEnded    = 0x03
+	CodeDoneGoingAway     = 0x05
+)
+
+type clientSetup struct {
+	versions []uint64
+	role     uint64
+}
+
+type serverSetup struct {
+	version uint64
+	role    uint64
+}
+
+type announce struct {
+	namespace string
+}
+
+type announceOk struct {
+	namespace string
+}
+
+type announceError struct {
+	namespace string
+	code      uint64
+	reason    string
+}
+
+type unannounce struct {
+	namespace string
+}
+
+type subscribe struct {
+	id        uint64
+	alias     uint64
+	namespace string
+	name      string
+	filter    uint64
+}
+
+type subscribeOk struct {
+	id            uint64
+	expires       uint64
+	contentExists bool
+	largestGroup  uint64
+	largestObject uint64
+}
+
+type subscribeError struct {
+	id     uint64
+	code   uint64
+	reason string
+	alias  uint64
+}
+
+type unsubscribe struct {
+	id uint64
+}
+
+type subscribeDone struct {
+	id            uint64
+	code          uint64
+	reason        string
+	contentExists bool
+	finalGroup    uint64
+	finalObject   uint64
+}
+
+type goAway struct {
+	url string
+}
+
+// groupHeader STREAM_HEADER_GROUP，每个group一条单向流
+type groupHeader struct {
+	subscribeId uint64
+	alias       uint64
+	group       uint64
+	sendOrder   uint64
+}
+
+type encoder interface {
+	encode(buf *bytes.Buffer)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	quicvarint.Write(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func writeBool(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+func (m *clientSetup) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgClientSetup)
+	quicvarint.Write(buf, uint64(len(m.versions)))
+	for _, version := range m.versions {
+		quicvarint.Write(buf, version)
+	}
+	quicvarint.Write(buf, 1)
+	quicvarint.Write(buf, paramRole)
+	quicvarint.Write(buf, uint64(quicvarint.Len(m.role)))
+	quicvarint.Write(buf, m.role)
+}
+
+func (m *serverSetup) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgServerSetup)
+	quicvarint.Write(buf, m.version)
+	quicvarint.Write(buf, 1)
+	quicvarint.Write(buf, paramRole)
+	quicvarint.Write(buf, uint64(quicvarint.Len(m.role)))
+	quicvarint.Write(buf, m.role)
+}
+
+func (m *announce) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgAnnounce)
+	writeString(buf, m.namespace)
+	quicvarint.Write(buf, 0)
+}
+
+func (m *announceOk) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgAnnounceOk)
+	writeString(buf, m.namespace)
+}
+
+func (m *announceError) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgAnnounceError)
+	writeString(buf, m.namespace)
+	quicvarint.Write(buf, m.code)
+	writeString(buf, m.reason)
+}
+
+func (m *unannounce) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgUnannounce)
+	writeString(buf, m.namespace)
+}
+
+func (m *subscribe) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgSubscribe)
+	quicvarint.Write(buf, m.id)
+	quicvarint.Write(buf, m.alias)
+	writeString(buf, m.namespace)
+	writeString(buf, m.name)
+	quicvarint.Write(buf, m.filter)
+	quicvarint.Write(buf, 0)
+}
+
+func (m *subscribeOk) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgSubscribeOk)
+	quicvarint.Write(buf, m.id)
+	quicvarint.Write(buf, m.expires)
+	writeBool(buf, m.contentExists)
+	if m.contentExists {
+		quicvarint.Write(buf, m.largestGroup)
+		quicvarint.Write(buf, m.largestObject)
+	}
+}
+
+func (m *subscribeError) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgSubscribeError)
+	quicvarint.Write(buf, m.id)
+	quicvarint.Write(buf, m.code)
+	writeString(buf, m.reason)
+	quicvarint.Write(buf, m.alias)
+}
+
+func (m *unsubscribe) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgUnsubscribe)
+	quicvarint.Write(buf, m.id)
+}
+
+func (m *subscribeDone) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgSubscribeDone)
+	quicvarint.Write(buf, m.id)
+	quicvarint.Write(buf, m.code)
+	writeString(buf, m.reason)
+	writeBool(buf, m.contentExists)
+	if m.contentExists {
+		quicvarint.Write(buf, m.finalGroup)
+		quicvarint.Write(buf, m.finalObject)
+	}
+}
+
+func (m *groupHeader) encode(buf *bytes.Buffer) {
+	quicvarint.Write(buf, msgStreamHeaderGroup)
+	quicvarint.Write(buf, m.subscribeId)
+	quicvarint.Write(buf, m.alias)
+	quicvarint.Write(buf, m.group)
+	quicvarint.Write(buf, m.sendOrder)
+}
+
+// encodeObject group流上的一个对象：object id、payload长度和payload
+func encodeObject(buf *bytes.Buffer, objectId uint64, payload []byte) {
+	quicvarint.Write(buf, objectId)
+	quicvarint.Write(buf, uint64(len(payload)))
+	if len(payload) == 0 {
+		// 长度为0时带object status，0为正常对象
+		quicvarint.Write(buf, 0)
+	}
+	buf.Write(payload)
+}
+
+// reader 读取varint、字符串和字节
+type reader struct {
+	quicvarint.Reader
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{Reader: quicvarint.NewReader(r)}
+}
+
+func (r *reader) varint() (uint64, error) {
+	return quicvarint.Read(r.Reader)
+}
+
+func (r *reader) bytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > 1<<24 {
+		return nil, fmt.Errorf("field too long, length:%d", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r.Reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *reader) string() (string, error) {
+	buf, err := r.bytes()
+	return string(buf), err
+}
+
+func (r *reader) bool() (bool, error) {
+	b, err := r.ReadByte()
+	return b != 0, err
+}
+
+// params 读取参数列表，返回role参数，其余参数忽略
+func (r *reader) params() (uint64, error) {
+	count, err := r.varint()
+	if err != nil {
+		return 0, err
+	}
+	role := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		key, err := r.varint()
+		if err != nil {
+			return 0, err
+		}
+		value, err := r.bytes()
+		if err != nil {
+			return 0, err
+		}
+		if key == paramRole && len(value) > 0 {
+			if role, err = quicvarint.Read(bytes.NewReader(value)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return role, nil
+}
+
+// readMessage 读取一个控制消息，各字段按顺序读取，遇到错误直接返回
+func (r *reader) readMessage() (interface{}, error) {
+	msgType, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	var errs errReader
+	switch msgType {
+	case msgClientSetup:
+		m := &clientSetup{}
+		count := errs.varint(r)
+		for i := uint64(0); i < count && errs.err == nil; i++ {
+			m.versions = append(m.versions, errs.varint(r))
+		}
+		m.role = errs.params(r)
+		return m, errs.err
+	case msgServerSetup:
+		m := &serverSetup{}
+		m.version = errs.varint(r)
+		m.role = errs.params(r)
+		return m, errs.err
+	case msgAnnounce:
+		m := &announce{namespace: errs.string(r)}
+		errs.params(r)
+		return m, errs.err
+	case msgAnnounceOk:
+		return &announceOk{namespace: errs.string(r)}, errs.err
+	case msgAnnounceError:
+		m := &announceError{namespace: errs.string(r)}
+		m.code = errs.varint(r)
+		m.reason = errs.string(r)
+		return m, errs.err
+	case msgUnannounce:
+		return &unannounce{namespace: errs.string(r)}, errs.err
+	case msgSubscribe:
+		m := &subscribe{}
+		m.id = errs.varint(r)
+		m.alias = errs.varint(r)
+		m.namespace = errs.string(r)
+		m.name = errs.string(r)
+		m.filter = errs.varint(r)
+		switch m.filter {
+		case filterAbsoluteStart:
+			errs.varint(r)
+			errs.varint(r)
+		case filterAbsoluteRange:
+			errs.varint(r)
+			errs.varint(r)
+			errs.varint(r)
+			errs.varint(r)
+		}
+		errs.params(r)
+		return m, errs.err
+	case msgSubscribeOk:
+		m := &subscribeOk{}
+		m.id = errs.varint(r)
+		m.expires = errs.varint(r)
+		m.contentExists = errs.bool(r)
+		if m.contentExists {
+			m.largestGroup = errs.varint(r)
+			m.largestObject = errs.varint(r)
+		}
+		return m, errs.err
+	case msgSubscribeError:
+		m := &subscribeError{}
+		m.id = errs.varint(r)
+		m.code = errs.varint(r)
+		m.reason = errs.string(r)
+		m.alias = errs.varint(r)
+		return m, errs.err
+	case msgUnsubscribe:
+		return &unsubscribe{id: errs.varint(r)}, errs.err
+	case msgSubscribeDone:
+		m := &subscribeDone{}
+		m.id = errs.varint(r)
+		m.code = errs.varint(r)
+		m.reason = errs.string(r)
+		m.contentExists = errs.bool(r)
+		if m.contentExists {
+			m.finalGroup = errs.varint(r)
+			m.finalObject = errs.varint(r)
+		}
+		return m, errs.err
+	case msgGoAway:
+		return &goAway{url: errs.string(r)}, errs.err
+	}
+	return nil, fmt.Errorf("unknown message type:%#x", msgType)
+}
+
+// readGroupHeader 读取单向流开头的STREAM_HEADER_GROUP
+func (r *reader) readGroupHeader() (*groupHeader, error) {
+	msgType, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if msgType != msgStreamHeaderGroup {
+		return nil, fmt.Errorf("unsupported stream type:%#x", msgType)
+	}
+	var errs errReader
+	h := &groupHeader{}
+	h.subscribeId = errs.varint(r)
+	h.alias = errs.varint(r)
+	h.group = errs.varint(r)
+	h.sendOrder = errs.varint(r)
+	return h, errs.err
+}
+
+// readObject 读取group流上的下一个对象，在对象边界上流结束时返回io.EOF
+func (r *reader) readObject() (uint64, []byte, error) {
+	objectId, err := r.varint()
+	if err != nil {
+		return 0, nil, err
+	}
+	// 读到object id之后流结束说明对象不完整
+	payload, err := r.bytes()
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if len(payload) == 0 {
+		if _, err := r.varint(); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+	}
+	return objectId, payload, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// errReader 记录第一个错误，之后的读取都跳过，避免每个字段都判断错误
+type errReader struct {
+	err error
+}
+
+func (e *errReader) varint(r *reader) uint64 {
+	if e.err != nil {
+		return 0
+	}
+	var v uint64
+	v, e.err = r.varint()
+	return v
+}
+
+func (e *errReader) string(r *reader) string {
+	if e.err != nil {
+		return ""
+	}
+	var s string
+	s, e.err = r.string()
+	return s
+}
+
+func (e *errReader) bool(r *reader) bool {
+	if e.err != nil {
+		return false
+	}
+	var b bool
+	b, e.err = r.bool()
+	return b
+}
+
+func (e *errReader) params(r *reader) uint64 {
+	if e.err != nil {
+		return 0
+	}
+	var role uint64
+	role, e.err = r.params()
+	return role
+}
@@ -0,0 +1,173 @@
+package moq
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message encoder
+	}{
+		{"client setup", &clientSetup{versions: []uint64{Draft04, 0xff000003}, role: RoleSubscriber}},
+		{"server setup", &serverSetup{version: Draft04, role: RolePublisher}},
+		{"announce", &announce{namespace: "live"}},
+		{"announce ok", &announceOk{namespace: "live"}},
+		{"announce error", &announceError{namespace: "live", code: CodeAnnounceInternalError, reason: "duplicate"}},
+		{"unannounce", &unannounce{namespace: "live"}},
+		{"subscribe", &subscribe{id: 1, alias: 2, namespace: "live", name: "test", filter: filterLatestGroup}},
+		{"subscribe ok", &subscribeOk{id: 1, expires: 0}},
+		{"subscribe ok with content", &subscribeOk{id: 1, expires: 3000, contentExists: true, largestGroup: 1 << 20, largestObject: 99}},
+		{"subscribe error", &subscribeError{id: 1, code: CodeSubscribeTrackNotExist, reason: "track not exist", alias: 2}},
+		{"unsubscribe", &unsubscribe{id: 1 << 40}},
+		{"subscribe done", &subscribeDone{id: 1, code: CodeDoneTrackEnded, reason: "ended"}},
+		{"subscribe done with content", &subscribeDone{id: 1, code: CodeDoneGoingAway, reason: "", contentExists: true, finalGroup: 5, finalObject: 6}},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		test.message.encode(buf)
+		data := buf.Bytes()
+		message, err := newReader(bytes.NewReader(data)).readMessage()
+		if err != nil {
+			t.Errorf("%s: read failed, err:%v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(message, test.message) {
+			t.Errorf("%s: message:%+v, want:%+v", test.name, message, test.message)
+		}
+		// 任何截断的消息都要返回错误
+		for i := 0; i < len(data); i++ {
+			if message, err := newReader(bytes.NewReader(data[:i])).readMessage(); err == nil {
+				t.Errorf("%s: read of %d/%d bytes should fail, message:%+v", test.name, i, len(data), message)
+			}
+		}
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, msgGoAway)
+	writeString(buf, "moq://example.com/live")
+	message, err := newReader(buf).readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(message, &goAway{url: "moq://example.com/live"}) {
+		t.Errorf("message:%+v", message)
+	}
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	tooLong := &bytes.Buffer{}
+	quicvarint.Write(tooLong, msgAnnounce)
+	quicvarint.Write(tooLong, 1<<24+1)
+	tooLong.WriteString("live")
+
+	unknown := &bytes.Buffer{}
+	quicvarint.Write(unknown, 0x3f)
+	quicvarint.Write(unknown, 1)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		errMsg string
+	}{
+		{"oversized string", tooLong.Bytes(), "field too long"},
+		{"unknown type", unknown.Bytes(), "unknown message type"},
+		{"group header on control stream", []byte{0x40, msgStreamHeaderGroup, 1, 2, 3, 4}, "unknown message type"},
+	}
+	for _, test := range tests {
+		_, err := newReader(bytes.NewReader(test.data)).readMessage()
+		if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf("%s: err:%v, want:%s", test.name, err, test.errMsg)
+		}
+	}
+}
+
+func TestGroupHeaderRoundTrip(t *testing.T) {
+	tests := []*groupHeader{
+		{subscribeId: 0, alias: 0, group: 0, sendOrder: 0},
+		{subscribeId: 1, alias: 2, group: 1 << 30, sendOrder: 1<<62 - 1},
+	}
+	for _, want := range tests {
+		buf := &bytes.Buffer{}
+		want.encode(buf)
+		data := buf.Bytes()
+		h, err := newReader(bytes.NewReader(data)).readGroupHeader()
+		if err != nil {
+			t.Errorf("read failed, err:%v", err)
+			continue
+		}
+		if *h != *want {
+			t.Errorf("header:%+v, want:%+v", *h, *want)
+		}
+		for i := 0; i < len(data); i++ {
+			if _, err := newReader(bytes.NewReader(data[:i])).readGroupHeader(); err == nil {
+				t.Errorf("read of %d/%d bytes should fail", i, len(data))
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	(&announce{namespace: "live"}).encode(buf)
+	if _, err := newReader(buf).readGroupHeader(); err == nil || !strings.Contains(err.Error(), "unsupported stream type") {
+		t.Errorf("control message as group header, err:%v", err)
+	}
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	tests := []struct {
+		objectId uint64
+		payload  []byte
+	}{
+		{0, []byte{9, 0, 0, 0}},
+		{1, []byte{}},
+		{2, bytes.Repeat([]byte{0xab}, 100000)},
+	}
+	buf := &bytes.Buffer{}
+	for _, test := range tests {
+		encodeObject(buf, test.objectId, test.payload)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+	reader := newReader(buf)
+	for _, want := range tests {
+		objectId, payload, err := reader.readObject()
+		if err != nil {
+			t.Fatalf("read failed, err:%v", err)
+		}
+		if objectId != want.objectId || !bytes.Equal(payload, want.payload) {
+			t.Errorf("object %d, payload len:%d, want object %d, payload len:%d", objectId, len(payload), want.objectId, len(want.payload))
+		}
+	}
+	if _, _, err := reader.readObject(); err != io.EOF {
+		t.Errorf("read after the last object, err:%v, want EOF", err)
+	}
+
+	// 截断在对象中间时返回错误
+	first := len(data) - 100000
+	for _, i := range []int{1, 2, 5, first + 1, first + 2, len(data) - 1} {
+		reader := newReader(bytes.NewReader(data[:i]))
+		var err error
+		for err == nil {
+			_, _, err = reader.readObject()
+		}
+		if err == io.EOF {
+			t.Errorf("read of %d/%d bytes should fail with an unexpected EOF", i, len(data))
+		}
+	}
+}
+
+func TestReadObjectOversized(t *testing.T) {
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, 0)
+	quicvarint.Write(buf, 1<<24+1)
+	if _, _, err := newReader(buf).readObject(); err == nil || !strings.Contains(err.Error(), "field too long") {
+		t.Errorf("err:%v, want field too long", err)
+	}
+}
@@ -0,0 +1,169 @@
+package moq
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"log"
+	"sync"
+	"time"
+)
+
+// Relay 本地MoQ relay：发布端ANNOUNCE namespace，订阅端SUBSCRIBE时向发布端转发订阅，
+// 同一个track的多个订阅者共用一个上游订阅，最后一个订阅者离开时取消上游订阅
+type Relay struct {
+	// MaxDelay 上游订阅中较新的group到达后等待旧group的最长时间
+	MaxDelay time.Duration
+
+	lock      sync.Mutex
+	announces map[string]*Session
+	tracks    map[string]*relayTrack
+}
+
+// relayTrack ready关闭后track和err可用
+type relayTrack struct {
+	track *Track
+	err   error
+	ready chan struct{}
+}
+
+func NewRelay() *Relay {
+	return &Relay{
+		MaxDelay:  500 * time.Millisecond,
+		announces: make(map[string]*Session),
+		tracks:    make(map[string]*relayTrack),
+	}
+}
+
+// Listen 监听quic，alpn为moq-00
+func Listen(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlyListener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{MoqAlpn}
+	listener, err := quic.ListenAddrEarly(addr, tlsConfig, QuicConfig(quicConfig))
+	if err != nil {
+		return nil, fmt.Errorf("quic.ListenAddrEarly failed, addr:%s, err:%v", addr, err)
+	}
+	return listener, nil
+}
+
+func (r *Relay) ListenAndServe(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) error {
+	listener, err := Listen(addr, tlsConfig, quicConfig)
+	if err != nil {
+		return err
+	}
+	return r.Serve(listener)
+}
+
+// Serve 循环accept，直到listener被关闭
+func (r *Relay) Serve(listener quic.EarlyListener) error {
+	defer listener.Close()
+	for {
+		quicSession, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go r.serveSession(quicSession)
+	}
+}
+
+func (r *Relay) serveSession(quicSession quic.Session) {
+	session := NewSession(quicSession)
+	session.Tracks = r
+	session.OnAnnounce = r.announce
+	session.OnUnannounce = r.unannounce
+	session.OnClose = r.sessionClosed
+	ctx, cancel := context.WithTimeout(quicSession.Context(), 10*time.Second)
+	defer cancel()
+	if err := session.Accept(ctx, RolePubSub); err != nil {
+		log.Printf("moq setup failed, remote:%v, err:%v", quicSession.RemoteAddr(), err)
+		session.Close()
+		return
+	}
+	log.Printf("moq session, remote:%v, role:%d", quicSession.RemoteAddr(), session.PeerRole)
+}
+
+func (r *Relay) announce(session *Session, namespace string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if publisher, ok := r.announces[namespace]; ok && publisher != session {
+		return fmt.Errorf("namespace is announced, namespace:%s", namespace)
+	}
+	r.announces[namespace] = session
+	log.Printf("moq announce, remote:%v, namespace:%s", session.RemoteAddr(), namespace)
+	return nil
+}
+
+func (r *Relay) unannounce(session *Session, namespace string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.announces[namespace] == session {
+		delete(r.announces, namespace)
+	}
+}
+
+// sessionClosed 发布端断开后它的上游订阅随之结束，对应track向订阅者发送SUBSCRIBE_DONE
+func (r *Relay) sessionClosed(session *Session) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for namespace, publisher := range r.announces {
+		if publisher == session {
+			delete(r.announces, namespace)
+		}
+	}
+	log.Printf("moq session closed, remote:%v, err:%v", session.RemoteAddr(), session.err)
+}
+
+// Track 查找或建立track，第一个订阅者到来时向发布端订阅
+func (r *Relay) Track(session *Session, namespace string, name string) (*Track, error) {
+	key := namespace + "/" + name
+	r.lock.Lock()
+	rt, ok := r.tracks[key]
+	if ok {
+		r.lock.Unlock()
+		<-rt.ready
+		return rt.track, rt.err
+	}
+	publisher := r.announces[namespace]
+	if publisher == nil {
+		r.lock.Unlock()
+		return nil, fmt.Errorf("namespace not announced, namespace:%s", namespace)
+	}
+	rt = &relayTrack{ready: make(chan struct{})}
+	r.tracks[key] = rt
+	r.lock.Unlock()
+
+	// 向上游订阅时不持有锁，同一个track的其它订阅者等待ready
+	upstream, err := publisher.Subscribe(namespace, name, r.MaxDelay)
+	if err != nil {
+		rt.err = err
+		r.removeTrack(key, rt)
+		close(rt.ready)
+		return nil, err
+	}
+	rt.track = NewTrack(namespace, name)
+	rt.track.onIdle = func() {
+		r.removeTrack(key, rt)
+		rt.track.Close()
+		upstream.Unsubscribe()
+	}
+	close(rt.ready)
+
+	go func() {
+		for obj := range upstream.Objects {
+			rt.track.WriteObject(obj.Group, obj.Payload)
+		}
+		r.removeTrack(key, rt)
+		rt.track.Close()
+		log.Printf("moq relay track end, track:%s, upstream:%v, downstream:%v", key, upstream.Stats(), rt.track.Stats())
+	}()
+	return rt.track, nil
+}
+
+func (r *Relay) removeTrack(key string, rt *relayTrack) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.tracks[key] == rt {
+		delete(r.tracks, key)
+	}
+}
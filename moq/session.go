@@ -0,0 +1,427 @@
+package moq
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"log"
+	"quic_demo/quicConn"
+	"sync"
+	"time"
+)
+
+// maxUniStreams 每个group一条单向流，GOP较短或订阅者较多时需要足够的流数
+const maxUniStreams = 1000
+
+// TrackProvider 查找本端可以被订阅的track
+type TrackProvider interface {
+	Track(session *Session, namespace string, name string) (*Track, error)
+}
+
+// QuicConfig 返回放宽单向流数的配置
+func QuicConfig(quicConfig *quic.Config) *quic.Config {
+	if quicConfig == nil {
+		quicConfig = &quic.Config{}
+	}
+	quicConfig = quicConfig.Clone()
+	if quicConfig.MaxIncomingUniStreams < maxUniStreams {
+		quicConfig.MaxIncomingUniStreams = maxUniStreams
+	}
+	return quicConfig
+}
+
+// Dial 以alpn moq-00建立quic连接并完成setup
+func Dial(ctx context.Context, addr string, tlsConfig *tls.Config, quicConfig *quic.Config, role uint64) (*Session, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{MoqAlpn}
+	quicSession, err := quic.DialAddrEarlyContext(ctx, addr, tlsConfig, QuicConfig(quicConfig))
+	if err != nil {
+		return nil, fmt.Errorf("quic.DialAddrEarlyContext failed, addr:%s, err:%v", addr, err)
+	}
+	session := NewSession(quicSession)
+	if err := session.Connect(ctx, role); err != nil {
+		quicSession.CloseWithError(quicConn.CodeNoError, "")
+		return nil, err
+	}
+	return session, nil
+}
+
+// Session 一个MoQ会话：quic session加一条双向控制流。
+// 同一个Session既可以发布track(响应对端的SUBSCRIBE)，也可以订阅对端的track
+type Session struct {
+	// Tracks 查找对端订阅的track，为nil时使用Publish注册的本地track
+	Tracks TrackProvider
+	// OnAnnounce 收到ANNOUNCE时调用，返回错误时回复ANNOUNCE_ERROR，为nil时拒绝所有ANNOUNCE
+	OnAnnounce func(s *Session, namespace string) error
+	// OnUnannounce 收到UNANNOUNCE时调用
+	OnUnannounce func(s *Session, namespace string)
+	// OnClose session结束时调用
+	OnClose func(s *Session)
+
+	// PeerRole 对端在setup中声明的role
+	PeerRole uint64
+
+	quic     quic.Session
+	control  quic.Stream
+	sendLock sync.Mutex
+
+	lock            sync.Mutex
+	local           map[string]*Track
+	nextSubscribeId uint64
+	subscriptions   map[uint64]*Subscription
+	served          map[uint64]*servedSubscription
+	announces       map[string]chan error
+	closed          chan struct{}
+	err             error
+}
+
+func NewSession(quicSession quic.Session) *Session {
+	return &Session{
+		quic:          quicSession,
+		local:         make(map[string]*Track),
+		subscriptions: make(map[uint64]*Subscription),
+		served:        make(map[uint64]*servedSubscription),
+		announces:     make(map[string]chan error),
+		closed:        make(chan struct{}),
+	}
+}
+
+// Connect 客户端打开控制流并完成CLIENT_SETUP/SERVER_SETUP，之后在后台处理控制消息
+func (s *Session) Connect(ctx context.Context, role uint64) error {
+	stream, err := s.quic.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("quicSession.OpenStreamSync failed, err:%v", err)
+	}
+	s.control = stream
+	if err := s.send(&clientSetup{versions: []uint64{Draft04}, role: role}); err != nil {
+		return err
+	}
+	r := newReader(stream)
+	msg, err := r.readMessage()
+	if err != nil {
+		return fmt.Errorf("read SERVER_SETUP failed, err:%v", err)
+	}
+	setup, ok := msg.(*serverSetup)
+	if !ok {
+		return fmt.Errorf("expect SERVER_SETUP, got:%T", msg)
+	}
+	if setup.version != Draft04 {
+		return fmt.Errorf("unsupported version:%#x", setup.version)
+	}
+	s.PeerRole = setup.role
+	go s.run(r)
+	return nil
+}
+
+// Accept 服务端接受控制流并回复SERVER_SETUP，之后在后台处理控制消息
+func (s *Session) Accept(ctx context.Context, role uint64) error {
+	stream, err := s.quic.AcceptStream(ctx)
+	if err != nil {
+		return fmt.Errorf("quicSession.AcceptStream failed, err:%v", err)
+	}
+	s.control = stream
+	r := newReader(stream)
+	msg, err := r.readMessage()
+	if err != nil {
+		return fmt.Errorf("read CLIENT_SETUP failed, err:%v", err)
+	}
+	setup, ok := msg.(*clientSetup)
+	if !ok {
+		return fmt.Errorf("expect CLIENT_SETUP, got:%T", msg)
+	}
+	supported := false
+	for _, version := range setup.versions {
+		supported = supported || version == Draft04
+	}
+	if !supported {
+		return fmt.Errorf("unsupported versions:%#x", setup.versions)
+	}
+	s.PeerRole = setup.role
+	if err := s.send(&serverSetup{version: Draft04, role: role}); err != nil {
+		return err
+	}
+	go s.run(r)
+	return nil
+}
+
+func (s *Session) RemoteAddr() string {
+	return s.quic.RemoteAddr().String()
+}
+
+// Done session结束时关闭
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// Err session结束的原因
+func (s *Session) Err() error {
+	<-s.closed
+	return s.err
+}
+
+func (s *Session) Close() error {
+	return s.quic.CloseWithError(quicConn.CodeNoError, "")
+}
+
+func (s *Session) send(msg encoder) error {
+	buf := &bytes.Buffer{}
+	msg.encode(buf)
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if _, err := s.control.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write control message failed, err:%v", err)
+	}
+	return nil
+}
+
+// Publish 注册一个本地track，对端订阅时从这个track读取对象
+func (s *Session) Publish(namespace string, name string) *Track {
+	track := NewTrack(namespace, name)
+	s.lock.Lock()
+	s.local[namespace+"/"+name] = track
+	s.lock.Unlock()
+	return track
+}
+
+// Announce 发送ANNOUNCE并等待ANNOUNCE_OK
+func (s *Session) Announce(namespace string) error {
+	result := make(chan error, 1)
+	s.lock.Lock()
+	s.announces[namespace] = result
+	s.lock.Unlock()
+	if err := s.send(&announce{namespace: namespace}); err != nil {
+		return err
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-s.closed:
+		return fmt.Errorf("session closed, err:%v", s.err)
+	}
+}
+
+// Subscribe 订阅对端的track，从最新group开始，maxDelay为较新的group到达后等待旧group的最长时间
+func (s *Session) Subscribe(namespace string, name string, maxDelay time.Duration) (*Subscription, error) {
+	s.lock.Lock()
+	id := s.nextSubscribeId
+	s.nextSubscribeId++
+	sub := newSubscription(s, id, namespace, name, maxDelay)
+	s.subscriptions[id] = sub
+	s.lock.Unlock()
+
+	if err := s.send(&subscribe{id: id, alias: id, namespace: namespace, name: name, filter: filterLatestGroup}); err != nil {
+		s.removeSubscription(id)
+		return nil, err
+	}
+	select {
+	case err := <-sub.ready:
+		if err != nil {
+			s.removeSubscription(id)
+			return nil, err
+		}
+	case <-s.closed:
+		return nil, fmt.Errorf("session closed, err:%v", s.err)
+	}
+	go sub.run()
+	return sub, nil
+}
+
+func (s *Session) removeSubscription(id uint64) {
+	s.lock.Lock()
+	delete(s.subscriptions, id)
+	s.lock.Unlock()
+}
+
+func (s *Session) removeServed(id uint64) {
+	s.lock.Lock()
+	delete(s.served, id)
+	s.lock.Unlock()
+}
+
+// run 处理控制消息和group流，控制流或session出错时结束
+func (s *Session) run(r *reader) {
+	go s.acceptGroups()
+	var err error
+	for err == nil {
+		var msg interface{}
+		if msg, err = r.readMessage(); err != nil {
+			break
+		}
+		err = s.handle(msg)
+	}
+	s.close(err)
+}
+
+func (s *Session) close(err error) {
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			err = nil
+		} else if _, ok := err.(*quic.ApplicationError); !ok {
+			// 协议错误时关闭整个session
+			s.quic.CloseWithError(quicConn.CodeInternalError, err.Error())
+		}
+	}
+	s.lock.Lock()
+	s.err = err
+	served := s.served
+	s.served = make(map[uint64]*servedSubscription)
+	s.lock.Unlock()
+	close(s.closed)
+	for _, sub := range served {
+		sub.track.removeSubscriber(sub)
+	}
+	s.quic.CloseWithError(quicConn.CodeNoError, "")
+	if s.OnClose != nil {
+		s.OnClose(s)
+	}
+}
+
+func (s *Session) handle(msg interface{}) error {
+	switch m := msg.(type) {
+	case *announce:
+		if s.OnAnnounce == nil {
+			return s.send(&announceError{namespace: m.namespace, code: CodeAnnounceInternalError, reason: "announce not supported"})
+		}
+		if err := s.OnAnnounce(s, m.namespace); err != nil {
+			return s.send(&announceError{namespace: m.namespace, code: CodeAnnounceInternalError, reason: err.Error()})
+		}
+		return s.send(&announceOk{namespace: m.namespace})
+	case *announceOk:
+		s.announceResult(m.namespace, nil)
+	case *announceError:
+		s.announceResult(m.namespace, fmt.Errorf("announce failed, code:%d, reason:%s", m.code, m.reason))
+	case *unannounce:
+		if s.OnUnannounce != nil {
+			s.OnUnannounce(s, m.namespace)
+		}
+	case *subscribe:
+		// relay向上游订阅时会等待SUBSCRIBE_OK，不能阻塞控制流
+		go s.serveSubscribe(m)
+	case *unsubscribe:
+		s.lock.Lock()
+		sub := s.served[m.id]
+		s.lock.Unlock()
+		if sub != nil {
+			go sub.finish(CodeDoneUnsubscribed, "unsubscribed")
+		}
+	case *subscribeOk:
+		if sub := s.subscription(m.id); sub != nil {
+			// 重复的或Subscribe已经返回后才到的回复直接丢弃，不能阻塞控制流
+			select {
+			case sub.ready <- nil:
+			default:
+			}
+		}
+	case *subscribeError:
+		if sub := s.subscription(m.id); sub != nil {
+			select {
+			case sub.ready <- fmt.Errorf("subscribe failed, code:%d, reason:%s", m.code, m.reason):
+			default:
+			}
+		}
+	case *subscribeDone:
+		if sub := s.subscription(m.id); sub != nil {
+			sub.done(m)
+		}
+	case *goAway:
+		log.Printf("moq GOAWAY received, remote:%v, url:%s", s.quic.RemoteAddr(), m.url)
+	default:
+		return fmt.Errorf("unexpected message:%T", msg)
+	}
+	return nil
+}
+
+func (s *Session) announceResult(namespace string, err error) {
+	s.lock.Lock()
+	result := s.announces[namespace]
+	delete(s.announces, namespace)
+	s.lock.Unlock()
+	if result != nil {
+		result <- err
+	}
+}
+
+func (s *Session) subscription(id uint64) *Subscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.subscriptions[id]
+}
+
+func (s *Session) findTrack(namespace string, name string) (*Track, error) {
+	if s.Tracks != nil {
+		return s.Tracks.Track(s, namespace, name)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	track := s.local[namespace+"/"+name]
+	if track == nil {
+		return nil, fmt.Errorf("track not exist")
+	}
+	return track, nil
+}
+
+func (s *Session) serveSubscribe(m *subscribe) {
+	if m.filter != filterLatestGroup && m.filter != filterLatestObject {
+		s.send(&subscribeError{id: m.id, code: CodeSubscribeFilterNotExists, reason: "filter not supported", alias: m.alias})
+		return
+	}
+	track, err := s.findTrack(m.namespace, m.name)
+	if err != nil {
+		s.send(&subscribeError{id: m.id, code: CodeSubscribeTrackNotExist, reason: err.Error(), alias: m.alias})
+		return
+	}
+	sub := &servedSubscription{session: s, track: track, id: m.id, alias: m.alias}
+	s.lock.Lock()
+	if _, ok := s.served[m.id]; ok {
+		s.lock.Unlock()
+		s.send(&subscribeError{id: m.id, code: CodeSubscribeInternalError, reason: "duplicate subscribe id", alias: m.alias})
+		return
+	}
+	s.served[m.id] = sub
+	s.lock.Unlock()
+
+	// 加入track和写SUBSCRIBE_OK在同一把发送锁内，SUBSCRIBE_OK里的最新group与实际发送的一致。
+	// group流可能先于SUBSCRIBE_OK到达，对端在发送SUBSCRIBE之前已登记订阅
+	s.sendLock.Lock()
+	ok, err := track.addSubscriber(sub, m.filter == filterLatestGroup)
+	if err == nil {
+		buf := &bytes.Buffer{}
+		ok.encode(buf)
+		_, err = s.control.Write(buf.Bytes())
+	}
+	s.sendLock.Unlock()
+	if err != nil {
+		s.removeServed(m.id)
+		track.removeSubscriber(sub)
+		s.send(&subscribeError{id: m.id, code: CodeSubscribeInternalError, reason: err.Error(), alias: m.alias})
+		return
+	}
+	log.Printf("moq subscribe, remote:%v, track:%s/%s, id:%d", s.quic.RemoteAddr(), m.namespace, m.name, m.id)
+}
+
+// acceptGroups 接受group单向流并交给对应的订阅
+func (s *Session) acceptGroups() {
+	for {
+		stream, err := s.quic.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			r := newReader(stream)
+			header, err := r.readGroupHeader()
+			if err != nil {
+				stream.CancelRead(quicConn.CodeCanceled)
+				return
+			}
+			sub := s.subscription(header.subscribeId)
+			if sub == nil {
+				stream.CancelRead(quicConn.CodeCanceled)
+				return
+			}
+			sub.readGroup(header.group, stream, r)
+		}()
+	}
+}
@@ -0,0 +1,239 @@
+package moq
+
+import (
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"quic_demo/quicConn"
+	"sync"
+	"time"
+)
+
+// SubscriptionStats 订阅端统计
+type SubscriptionStats struct {
+	Groups     int64
+	Objects    int64
+	Bytes      int64
+	Canceled   int64 // 较新的group等待超过maxDelay后取消的旧group数
+	LateGroups int64 // 比当前group旧、到达后直接取消的group数
+}
+
+func (s SubscriptionStats) String() string {
+	return fmt.Sprintf("groups:%d, objects:%d, bytes:%d, canceled:%d, late groups:%d",
+		s.Groups, s.Objects, s.Bytes, s.Canceled, s.LateGroups)
+}
+
+// Subscription 本端发起的一个订阅，Objects按group顺序输出对象，订阅结束或session关闭后关闭
+type Subscription struct {
+	Namespace string
+	Name      string
+	Objects   chan Object
+
+	session  *Session
+	id       uint64
+	maxDelay time.Duration
+	ready    chan error
+	events   chan groupEvent
+	final    chan *subscribeDone
+	exited   chan struct{}
+
+	lock  sync.Mutex
+	stats SubscriptionStats
+}
+
+// groupEvent group流的打开、对象和结束
+type groupEvent struct {
+	group  uint64
+	stream quic.ReceiveStream
+	object *Object
+	end    bool
+}
+
+// groupState 一个正在接收的group，非当前group的对象先缓存
+type groupState struct {
+	stream   quic.ReceiveStream
+	pending  []Object
+	ended    bool
+	canceled bool
+	since    time.Time
+}
+
+func newSubscription(session *Session, id uint64, namespace string, name string, maxDelay time.Duration) *Subscription {
+	return &Subscription{
+		Namespace: namespace,
+		Name:      name,
+		Objects:   make(chan Object, 256),
+		session:   session,
+		id:        id,
+		maxDelay:  maxDelay,
+		ready:     make(chan error, 1),
+		events:    make(chan groupEvent, 256),
+		final:     make(chan *subscribeDone, 1),
+		exited:    make(chan struct{}),
+	}
+}
+
+func (s *Subscription) Stats() SubscriptionStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// Unsubscribe 发送UNSUBSCRIBE，发布端写完已打开的group后回复SUBSCRIBE_DONE
+func (s *Subscription) Unsubscribe() error {
+	return s.session.send(&unsubscribe{id: s.id})
+}
+
+func (s *Subscription) done(m *subscribeDone) {
+	select {
+	case s.final <- m:
+	default:
+	}
+}
+
+func (s *Subscription) event(e groupEvent) bool {
+	select {
+	case s.events <- e:
+		return true
+	case <-s.exited:
+		return false
+	}
+}
+
+// readGroup 读取一条group流上的全部对象
+func (s *Subscription) readGroup(group uint64, stream quic.ReceiveStream, r *reader) {
+	if !s.event(groupEvent{group: group, stream: stream}) {
+		stream.CancelRead(quicConn.CodeCanceled)
+		return
+	}
+	for {
+		objectId, payload, err := r.readObject()
+		if err != nil {
+			break
+		}
+		if !s.event(groupEvent{group: group, object: &Object{Group: group, Id: objectId, Payload: payload}}) {
+			stream.CancelRead(quicConn.CodeCanceled)
+			return
+		}
+	}
+	s.event(groupEvent{group: group, end: true})
+}
+
+// run 按group顺序输出对象。当前group未结束而较新的group已等待超过maxDelay时，
+// 取消当前group的流，从较新的group继续；比当前group旧的流到达后直接取消
+func (s *Subscription) run() {
+	defer s.session.removeSubscription(s.id)
+	defer close(s.Objects)
+	defer close(s.exited)
+
+	groups := make(map[uint64]*groupState)
+	started := false
+	current := uint64(0)
+	var final *subscribeDone
+	finalCh := s.final
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	output := func(obj Object) {
+		s.lock.Lock()
+		s.stats.Objects++
+		s.stats.Bytes += int64(len(obj.Payload))
+		s.lock.Unlock()
+		select {
+		case s.Objects <- obj:
+		case <-s.session.closed:
+		}
+	}
+	// advance 当前group结束或被取消后，切到下一个较新的group并输出它缓存的对象
+	var advance func()
+	advance = func() {
+		next, found := uint64(0), false
+		for group, state := range groups {
+			if group > current && !state.canceled && (!found || group < next) {
+				next, found = group, true
+			}
+		}
+		if !found {
+			return
+		}
+		current = next
+		state := groups[current]
+		for _, obj := range state.pending {
+			output(obj)
+		}
+		state.pending = nil
+		if state.ended {
+			delete(groups, current)
+			advance()
+		}
+	}
+
+	for {
+		if final != nil && len(groups) == 0 && (!final.contentExists || (started && current >= final.finalGroup)) {
+			return
+		}
+		select {
+		case e := <-s.events:
+			state := groups[e.group]
+			switch {
+			case e.stream != nil:
+				state = &groupState{stream: e.stream, since: time.Now()}
+				groups[e.group] = state
+				s.lock.Lock()
+				s.stats.Groups++
+				if started && e.group < current {
+					state.canceled = true
+					s.stats.LateGroups++
+				}
+				s.lock.Unlock()
+				if state.canceled {
+					e.stream.CancelRead(quicConn.CodeCanceled)
+				} else if !started || (e.group > current && groups[current] == nil) {
+					started = true
+					current = e.group
+				}
+			case state == nil:
+			case e.object != nil:
+				if state.canceled {
+					break
+				}
+				if e.group == current {
+					output(*e.object)
+				} else {
+					state.pending = append(state.pending, *e.object)
+				}
+			case e.end:
+				state.ended = true
+				if state.canceled {
+					delete(groups, e.group)
+				} else if e.group == current {
+					delete(groups, e.group)
+					advance()
+				}
+			}
+		case <-ticker.C:
+			state := groups[current]
+			if s.maxDelay <= 0 || state == nil || state.canceled {
+				break
+			}
+			for group, newer := range groups {
+				if group > current && !newer.canceled && time.Since(newer.since) > s.maxDelay {
+					state.canceled = true
+					state.stream.CancelRead(quicConn.CodeCanceled)
+					s.lock.Lock()
+					s.stats.Canceled++
+					s.lock.Unlock()
+					if state.ended {
+						delete(groups, current)
+					}
+					advance()
+					break
+				}
+			}
+		case final = <-finalCh:
+			finalCh = nil
+		case <-s.session.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package moq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"quic_demo/quicConn"
+	"sync"
+	"sync/atomic"
+)
+
+// maxQueuedObjects 每个订阅者当前group排队的对象上限，满了之后丢弃这个group剩下的对象
+const maxQueuedObjects = 1024
+
+var errTrackClosed = errors.New("track closed")
+
+// Object 一个MoQ对象，Id在group内从0开始
+type Object struct {
+	Group   uint64
+	Id      uint64
+	Payload []byte
+}
+
+// TrackStats track的发送统计
+type TrackStats struct {
+	Groups      int64
+	Objects     int64
+	Bytes       int64
+	Subscribers int64 // 累计订阅者数
+	Dropped     int64 // 订阅者过慢被丢弃的group数
+}
+
+func (s TrackStats) String() string {
+	return fmt.Sprintf("groups:%d, objects:%d, bytes:%d, subscribers:%d, dropped:%d",
+		s.Groups, s.Objects, s.Bytes, s.Subscribers, s.Dropped)
+}
+
+// Track 一路可被订阅的track。缓存最新group的全部对象，新订阅者从最新group的第一个对象开始，
+// 每个订阅者的每个group一条单向流
+type Track struct {
+	Namespace string
+	Name      string
+
+	lock        sync.Mutex
+	started     bool
+	group       uint64
+	objects     [][]byte // 当前group已写入的对象
+	subscribers map[*servedSubscription]struct{}
+	closed      bool
+	stats       TrackStats
+	// onIdle 最后一个订阅者离开时调用，relay用来取消上游订阅
+	onIdle func()
+}
+
+func NewTrack(namespace string, name string) *Track {
+	return &Track{
+		Namespace:   namespace,
+		Name:        name,
+		subscribers: make(map[*servedSubscription]struct{}),
+	}
+}
+
+// WriteObject 写入一个对象，Group变化时开始新group，对象的Id按写入顺序重新编号
+func (t *Track) WriteObject(group uint64, payload []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return errTrackClosed
+	}
+	if !t.started || group != t.group {
+		t.started = true
+		t.group = group
+		t.objects = nil
+		t.stats.Groups++
+		for sub := range t.subscribers {
+			sub.startGroup(group)
+		}
+	}
+	obj := Object{Group: group, Id: uint64(len(t.objects)), Payload: payload}
+	t.objects = append(t.objects, payload)
+	t.stats.Objects++
+	t.stats.Bytes += int64(len(payload))
+	for sub := range t.subscribers {
+		sub.writeObject(obj)
+	}
+	return nil
+}
+
+// Close 结束track，所有订阅者的group流写完后发送SUBSCRIBE_DONE
+func (t *Track) Close() {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	t.closed = true
+	subscribers := t.subscribers
+	t.subscribers = make(map[*servedSubscription]struct{})
+	t.lock.Unlock()
+	for sub := range subscribers {
+		go sub.finish(CodeDoneTrackEnded, "track ended")
+	}
+}
+
+func (t *Track) Stats() TrackStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stats
+}
+
+// addSubscriber 加入订阅者，latestGroup时重放缓存的当前group，否则从下一个对象开始
+func (t *Track) addSubscriber(sub *servedSubscription, latestGroup bool) (*subscribeOk, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil, errTrackClosed
+	}
+	t.subscribers[sub] = struct{}{}
+	t.stats.Subscribers++
+	ok := &subscribeOk{id: sub.id, contentExists: t.started}
+	if t.started {
+		ok.largestGroup = t.group
+		ok.largestObject = uint64(len(t.objects))
+		if len(t.objects) > 0 {
+			ok.largestObject--
+		}
+		sub.startGroup(t.group)
+		if latestGroup {
+			for i, payload := range t.objects {
+				sub.writeObject(Object{Group: t.group, Id: uint64(i), Payload: payload})
+			}
+		}
+	}
+	return ok, nil
+}
+
+// removeSubscriber 移除订阅者，最后一个订阅者离开时调用onIdle
+func (t *Track) removeSubscriber(sub *servedSubscription) {
+	t.lock.Lock()
+	if _, ok := t.subscribers[sub]; !ok {
+		t.lock.Unlock()
+		return
+	}
+	delete(t.subscribers, sub)
+	idle := len(t.subscribers) == 0 && !t.closed && t.onIdle != nil
+	t.lock.Unlock()
+	if idle {
+		t.onIdle()
+	}
+}
+
+// servedSubscription 对端发来的一个订阅，在订阅者的session上按group打开单向流
+type servedSubscription struct {
+	session *Session
+	track   *Track
+	id      uint64
+	alias   uint64
+
+	// 以下字段由track的锁保护
+	current *groupWriter
+	dropped int64
+
+	writers    sync.WaitGroup
+	finishOnce sync.Once
+}
+
+// groupWriter 一条group流和它的发送队列
+type groupWriter struct {
+	group   uint64
+	objects chan Object
+	aborted int32
+}
+
+func (s *servedSubscription) startGroup(group uint64) {
+	s.finishGroup()
+	w := &groupWriter{group: group, objects: make(chan Object, maxQueuedObjects)}
+	s.current = w
+	header := &groupHeader{subscribeId: s.id, alias: s.alias, group: group}
+	s.writers.Add(1)
+	go func() {
+		defer s.writers.Done()
+		s.writeGroup(header, w)
+		// 取消或失败后丢掉队列里剩下的对象
+		for range w.objects {
+		}
+	}()
+}
+
+func (s *servedSubscription) finishGroup() {
+	if s.current != nil {
+		close(s.current.objects)
+		s.current = nil
+	}
+}
+
+// writeObject 队列满时放弃当前group，订阅者从下一个group继续
+func (s *servedSubscription) writeObject(obj Object) {
+	w := s.current
+	if w == nil || w.group != obj.Group {
+		return
+	}
+	select {
+	case w.objects <- obj:
+	default:
+		atomic.StoreInt32(&w.aborted, 1)
+		s.finishGroup()
+		s.dropped++
+		s.track.stats.Dropped++
+	}
+}
+
+func (s *servedSubscription) writeGroup(header *groupHeader, w *groupWriter) {
+	stream, err := s.session.quic.OpenUniStreamSync(s.session.quic.Context())
+	if err != nil {
+		return
+	}
+	buf := &bytes.Buffer{}
+	header.encode(buf)
+	if _, err := stream.Write(buf.Bytes()); err != nil {
+		stream.CancelWrite(quicConn.CodeCanceled)
+		return
+	}
+	for obj := range w.objects {
+		if atomic.LoadInt32(&w.aborted) != 0 {
+			break
+		}
+		buf.Reset()
+		encodeObject(buf, obj.Id, obj.Payload)
+		if _, err := stream.Write(buf.Bytes()); err != nil {
+			// 订阅者取消了这个group
+			stream.CancelWrite(quicConn.CodeCanceled)
+			return
+		}
+	}
+	if atomic.LoadInt32(&w.aborted) != 0 {
+		stream.CancelWrite(quicConn.CodeCanceled)
+		return
+	}
+	stream.Close()
+}
+
+// finish 结束订阅：从track移除，等group流写完后发送SUBSCRIBE_DONE
+func (s *servedSubscription) finish(code uint64, reason string) {
+	s.finishOnce.Do(func() {
+		s.track.removeSubscriber(s)
+		s.track.lock.Lock()
+		s.finishGroup()
+		done := &subscribeDone{id: s.id, code: code, reason: reason, contentExists: s.track.started}
+		if s.track.started {
+			done.finalGroup = s.track.group
+			done.finalObject = uint64(len(s.track.objects))
+			if done.finalObject > 0 {
+				done.finalObject--
+			}
+		}
+		dropped := s.dropped
+		s.track.lock.Unlock()
+		s.writers.Wait()
+		s.session.removeServed(s.id)
+		if err := s.session.send(done); err != nil {
+			return
+		}
+		log.Printf("moq subscription done, remote:%v, track:%s/%s, id:%d, dropped groups:%d",
+			s.session.quic.RemoteAddr(), s.track.Namespace, s.track.Name, s.id, dropped)
+	})
+}
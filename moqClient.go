@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/zhangpeihao/goflv"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"quic_demo/analytics"
+	"quic_demo/httpFlv"
+	"quic_demo/moq"
+	"quic_demo/quicConn"
+	"quic_demo/resolver"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+
+	var streamUrl string
+	var port int
+	var mode string
+	var fileName string
+	var loop bool
+	var outFile string
+	var versions string
+	var maxDelay time.Duration
+	var statsInterval int
+	flag.StringVar(&streamUrl, "url", "", "track url, https://domain/namespace/track, e.g. https://domain/live/stream")
+	flag.IntVar(&port, "port", 443, "relay port, default 443")
+	flag.StringVar(&mode, "mode", "play", "play or publish")
+	flag.StringVar(&fileName, "fileName", "", "flv file to publish")
+	flag.BoolVar(&loop, "loop", false, "publish the file in a loop")
+	flag.StringVar(&outFile, "outFile", "", "record the played track into this flv file, empty to disable")
+	flag.StringVar(&versions, "versions", "v1", "quic versions, v1,draft29, the first is used for the initial packet")
+	flag.DurationVar(&maxDelay, "maxDelay", 500*time.Millisecond, "how long the player waits for an old group once a newer group arrives")
+	flag.IntVar(&statsInterval, "statsInterval", 5, "stats interval in seconds, 0 to disable")
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
+	flag.Parse()
+	if streamUrl == "" || (mode != "play" && mode != "publish") || (mode == "publish" && fileName == "") {
+		log.Fatalln("url == \"\" || (mode != \"play\" && mode != \"publish\") || (mode == \"publish\" && fileName == \"\")")
+	}
+
+	url2, err := url.Parse(streamUrl)
+	if err != nil {
+		log.Fatalf("url.Parse failed, err:%v", err)
+	}
+	namespace, name := path.Split(strings.TrimSuffix(url2.Path, ".flv"))
+	namespace = strings.Trim(namespace, "/")
+	if namespace == "" || name == "" {
+		log.Fatalf("url path should be /namespace/track, path:%s", url2.Path)
+	}
+	if url2.Port() != "" {
+		if port, err = strconv.Atoi(url2.Port()); err != nil {
+			log.Fatalf("strconv.Atoi failed, port:%s, err:%v", url2.Port(), err)
+		}
+	}
+
+	domain := url2.Hostname()
+	addrs, err := addrOptions.Lookup(domain)
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	quicVersions, err := quicConn.ParseVersions(versions)
+	if err != nil {
+		log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+	}
+	tlsConfig, err := tlsOptions.QuicClientConfig(domain)
+	if err != nil {
+		log.Fatalf("tlsOptions.QuicClientConfig err:%v", err)
+	}
+
+	role := uint64(moq.RoleSubscriber)
+	if mode == "publish" {
+		role = moq.RolePublisher
+	}
+	quicAddr := net.JoinHostPort(addrs.Ips[0], strconv.Itoa(port))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	session, err := moq.Dial(ctx, quicAddr, tlsConfig, &quic.Config{Versions: quicVersions}, role)
+	cancel()
+	if err != nil {
+		log.Fatalf("moq.Dial err:%v", err)
+	}
+	defer session.Close()
+
+	if mode == "publish" {
+		publish(session, namespace, name, fileName, loop, statsInterval)
+	} else {
+		play(session, namespace, name, outFile, maxDelay, statsInterval)
+	}
+}
+
+func publish(session *moq.Session, namespace string, name string, fileName string, loop bool, statsInterval int) {
+	track := session.Publish(namespace, name)
+	writer := moq.NewTagWriter(track)
+	defer writer.Close()
+	if err := session.Announce(namespace); err != nil {
+		log.Fatalf("session.Announce err:%v", err)
+	}
+
+	// FileSource按时间戳实时读文件
+	source := &httpFlv.FileSource{FileName: fileName, Loop: loop}
+	tags, cancel, err := source.Subscribe(namespace + "/" + name)
+	if err != nil {
+		log.Fatalf("source.Subscribe err:%v", err)
+	}
+	defer cancel()
+
+	if statsInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(statsInterval) * time.Second) {
+				log.Printf("publish stats, %v", track.Stats())
+			}
+		}()
+	}
+	for {
+		select {
+		case tag, ok := <-tags:
+			if !ok {
+				fmt.Printf("publish end, %v\n", track.Stats())
+				return
+			}
+			if err := writer.WriteTag(tag); err != nil {
+				log.Fatalf("writer.WriteTag err:%v", err)
+			}
+		case <-session.Done():
+			log.Fatalf("session closed, %v, err:%v", track.Stats(), session.Err())
+		}
+	}
+}
+
+func play(session *moq.Session, namespace string, name string, outFile string, maxDelay time.Duration, statsInterval int) {
+	subscription, err := session.Subscribe(namespace, name, maxDelay)
+	if err != nil {
+		log.Fatalf("session.Subscribe err:%v", err)
+	}
+
+	// 与RtmpPlay相同的录制方式
+	var file *flv.File
+	if outFile != "" {
+		if file, err = flv.CreateFile(outFile); err != nil {
+			log.Fatalf("flv.CreateFile err:%v", err)
+		}
+		defer file.Close()
+	}
+
+	if statsInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(statsInterval) * time.Second) {
+				log.Printf("play stats, %v", subscription.Stats())
+			}
+		}()
+	}
+	// 推流端插入了时间标记时输出端到端时延
+	latencyMeter := analytics.NewLatencyMeter()
+	for tag := range moq.ReadTags(subscription.Objects) {
+		if file != nil {
+			if err := file.WriteTag(tag.Body, tag.TagType, tag.Timestamp); err != nil {
+				log.Fatalf("file.WriteTag err:%v", err)
+			}
+		}
+		if sample, ok := latencyMeter.Add(tag.TagType, tag.Body); ok {
+			fmt.Printf("latency, %s, pts:%d\n", sample, tag.Timestamp)
+		}
+	}
+	fmt.Printf("play end, %v\n", subscription.Stats())
+	if stats := latencyMeter.Stats(); stats.Samples > 0 {
+		fmt.Printf("latency ms, %s\n", stats)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"github.com/lucas-clemente/quic-go"
+	"log"
+	"quic_demo/moq"
+	"quic_demo/quicConn"
+	"time"
+)
+
+func main() {
+
+	var addr string
+	var certFile string
+	var keyFile string
+	var versions string
+	var maxDelay time.Duration
+	flag.StringVar(&addr, "addr", ":443", "moq relay listen addr")
+	flag.StringVar(&certFile, "cert", "", "cert file, self-signed if empty")
+	flag.StringVar(&keyFile, "key", "", "key file")
+	flag.StringVar(&versions, "versions", "v1,draft29", "supported quic versions, comma separated")
+	flag.DurationVar(&maxDelay, "maxDelay", 500*time.Millisecond, "how long the relay waits for an old group from the publisher once a newer group arrives")
+	flag.Parse()
+
+	tlsConfig, err := quicConn.LoadServerTlsConfig(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("quicConn.LoadServerTlsConfig err:%v", err)
+	}
+	quicVersions, err := quicConn.ParseVersions(versions)
+	if err != nil {
+		log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+	}
+
+	relay := moq.NewRelay()
+	relay.MaxDelay = maxDelay
+	log.Printf("moq relay listen on %s", addr)
+	log.Fatalf("relay.ListenAndServe err:%v", relay.ListenAndServe(addr, tlsConfig, &quic.Config{Versions: quicVersions}))
+}
@@ -0,0 +1,206 @@
+package quicConn
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"quic_demo/timing"
+	"strings"
+	"sync/atomic"
+)
+
+// http协议选择
+const (
+	HttpProtoAuto = "auto" // tls上按alpn协商h2或http/1.1，明文为http/1.1
+	HttpProtoH1   = "h1"
+	HttpProtoH2   = "h2"  // tls上的http/2，协商不到h2时报错
+	HttpProtoH2c  = "h2c" // 明文http/2(prior knowledge)，url需要是http
+	HttpProtoH3   = "h3"
+)
+
+// ParseHttpProto 检查协议名，空串为auto
+func ParseHttpProto(proto string) (string, error) {
+	switch proto = strings.ToLower(proto); proto {
+	case "":
+		return HttpProtoAuto, nil
+	case HttpProtoAuto, HttpProtoH1, HttpProtoH2, HttpProtoH2c, HttpProtoH3:
+		return proto, nil
+	}
+	return "", fmt.Errorf("unknown http protocol:%s", proto)
+}
+
+// HttpTransport 按指定协议创建http.RoundTripper，连接拨到Addr，url中的域名只用于sni和Host
+type HttpTransport struct {
+	Proto string
+	Addr  string // ip:port
+	// Host url中的host:port，只有拨向这个地址的连接改拨到Addr，重定向到其他地址时正常拨号。
+	// 为空时所有连接都拨到Addr
+	Host       string
+	TLSConfig  *tls.Config
+	QuicConfig *quic.Config // 只用于h3
+	H3Alpn     []string     // 只用于h3，为空时按QuicConfig的第一个版本选择
+	Timing     *timing.Recorder
+	// SingleConn 所有请求复用一条连接，h1时请求排队，h2/h2c超过服务端的并发流上限时等待而不是新建连接
+	SingleConn bool
+
+	// H3Session h3时最近一次建立的quic session
+	H3Session quic.EarlySession
+	dials     int32
+}
+
+// Dials 建立过的tcp连接或quic session数
+func (t *HttpTransport) Dials() int {
+	return int(atomic.LoadInt32(&t.dials))
+}
+
+// RoundTripper h1/h2/auto返回*http.Transport，h2c和SingleConn的h2返回*http2.Transport，h3返回*http3.RoundTripper。
+// 用完后调用CloseIdleConnections或Close
+func (t *HttpTransport) RoundTripper() (http.RoundTripper, error) {
+	dialer := &net.Dialer{}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// 带上ctx才能触发httptrace的ConnectStart/ConnectDone
+		atomic.AddInt32(&t.dials, 1)
+		return dialer.DialContext(ctx, network, t.dialAddr(addr))
+	}
+	switch t.Proto {
+	case HttpProtoH2:
+		if t.SingleConn {
+			// http.Transport并发发起的第一批请求可能各自建连，x/net的http2.Transport对同一地址只拨一次
+			return &http2.Transport{
+				TLSClientConfig:            t.TLSConfig.Clone(),
+				StrictMaxConcurrentStreams: true,
+				DialTLS:                    t.dialH2,
+			}, nil
+		}
+		fallthrough
+	case HttpProtoAuto, HttpProtoH1:
+		transport := &http.Transport{
+			TLSClientConfig: t.TLSConfig.Clone(),
+			DialContext:     dial,
+		}
+		if t.Proto == HttpProtoH1 {
+			// TLSNextProto非nil且为空时不会升级到http/2
+			transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+			if t.SingleConn {
+				transport.MaxConnsPerHost = 1
+			}
+		} else {
+			// 设置了DialContext后http.Transport默认不再尝试http/2
+			transport.ForceAttemptHTTP2 = true
+		}
+		return transport, nil
+	case HttpProtoH2c:
+		return &http2.Transport{
+			AllowHTTP:                  true,
+			StrictMaxConcurrentStreams: t.SingleConn,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				t.Timing.Start(timing.PhaseTcpConnect)
+				conn, err := dial(context.Background(), network, addr)
+				if err == nil {
+					t.Timing.End(timing.PhaseTcpConnect)
+				}
+				return conn, err
+			},
+		}, nil
+	case HttpProtoH3:
+		quicConfig := t.QuicConfig
+		if quicConfig == nil {
+			quicConfig = &quic.Config{}
+		}
+		alpn := t.H3Alpn
+		if len(alpn) == 0 {
+			alpn = []string{H3Alpn}
+			if len(quicConfig.Versions) > 0 {
+				alpn = []string{H3AlpnForVersion(quicConfig.Versions[0])}
+			}
+		}
+		return &http3.RoundTripper{
+			TLSClientConfig: t.TLSConfig.Clone(),
+			QuicConfig:      quicConfig,
+			Dial: func(network, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlySession, error) {
+				// http3.RoundTripper按版本覆盖了NextProtos，这里换成指定的alpn
+				tlsCfg.NextProtos = alpn
+				if tlsCfg.ServerName == "" {
+					tlsCfg.ServerName, _, _ = net.SplitHostPort(addr)
+				}
+				t.Timing.Start(timing.PhaseQuicHandshake)
+				atomic.AddInt32(&t.dials, 1)
+				session, err := quic.DialAddrEarly(t.dialAddr(addr), tlsCfg, cfg)
+				if err != nil {
+					return nil, err
+				}
+				t.H3Session = session
+				go func() {
+					if WaitHandshake(session) {
+						t.Timing.End(timing.PhaseQuicHandshake)
+					}
+				}()
+				return session, nil
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown http protocol:%s", t.Proto)
+}
+
+// dialAddr 请求的addr(host:port)与Host相同或Host为空时返回Addr，否则返回addr
+func (t *HttpTransport) dialAddr(addr string) string {
+	if t.Host == "" || strings.EqualFold(addr, t.Host) {
+		return t.Addr
+	}
+	return addr
+}
+
+// dialH2 SingleConn的h2连接，tcp连接和tls握手的耗时写入Timing
+func (t *HttpTransport) dialH2(network, addr string, cfg *tls.Config) (net.Conn, error) {
+	atomic.AddInt32(&t.dials, 1)
+	t.Timing.Start(timing.PhaseTcpConnect)
+	conn, err := net.Dial(network, t.dialAddr(addr))
+	if err != nil {
+		return nil, err
+	}
+	t.Timing.End(timing.PhaseTcpConnect)
+	tlsConn := tls.Client(conn, cfg)
+	t.Timing.Start(timing.PhaseTlsHandshake)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.Timing.End(timing.PhaseTlsHandshake)
+	if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("server did not negotiate h2, alpn:%q", protocol)
+	}
+	return tlsConn, nil
+}
+
+// CheckScheme h2c只能用于http，h2和h3只能用于https
+func (t *HttpTransport) CheckScheme(scheme string) error {
+	switch {
+	case t.Proto == HttpProtoH2c && scheme != "http":
+		return fmt.Errorf("h2c needs an http url, scheme:%s", scheme)
+	case (t.Proto == HttpProtoH2 || t.Proto == HttpProtoH3) && scheme != "https":
+		return fmt.Errorf("%s needs an https url, scheme:%s", t.Proto, scheme)
+	}
+	return nil
+}
+
+// CheckResponse 指定了h2时确认实际协商到了http/2
+func (t *HttpTransport) CheckResponse(resp *http.Response) error {
+	if t.Proto == HttpProtoH2 && resp.ProtoMajor != 2 {
+		return fmt.Errorf("server did not negotiate h2, proto:%s", NegotiatedHttpProto(resp))
+	}
+	return nil
+}
+
+// NegotiatedHttpProto 返回响应实际使用的协议，tls上附带alpn，如"HTTP/2.0 (alpn h2)"
+func NegotiatedHttpProto(resp *http.Response) string {
+	if resp.TLS != nil && resp.TLS.NegotiatedProtocol != "" {
+		return fmt.Sprintf("%s (alpn %s)", resp.Proto, resp.TLS.NegotiatedProtocol)
+	}
+	return resp.Proto
+}
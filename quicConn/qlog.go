@@ -0,0 +1,44 @@
+package quicConn
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/lucas-clemente/quic-go/qlog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type bufferedWriteCloser struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func (b *bufferedWriteCloser) Close() error {
+	if err := b.Writer.Flush(); err != nil {
+		b.file.Close()
+		return err
+	}
+	return b.file.Close()
+}
+
+// newQlogTracer 在dir下创建qlog文件，文件名为"时间_client/server_odcid.qlog"，session关闭时写完
+func newQlogTracer(dir string, p logging.Perspective, odcid logging.ConnectionID) (logging.ConnectionTracer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	role := "server"
+	if p == logging.PerspectiveClient {
+		role = "client"
+	}
+	fileName := filepath.Join(dir, fmt.Sprintf("%s_%s_%x.qlog", time.Now().Format("20060102150405"), role, []byte(odcid)))
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return qlog.NewConnectionTracer(&bufferedWriteCloser{
+		Writer: bufio.NewWriter(file),
+		file:   file,
+	}, p, odcid), nil
+}
@@ -0,0 +1,76 @@
+package quicConn
+
+import (
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"strconv"
+	"strings"
+)
+
+const (
+	H3Alpn        = "h3"
+	H3Draft29Alpn = "h3-29"
+)
+
+var versionNames = map[string]quic.VersionNumber{
+	"v1":       quic.Version1,
+	"1":        quic.Version1,
+	"rfc9000":  quic.Version1,
+	"draft29":  quic.VersionDraft29,
+	"draft-29": quic.VersionDraft29,
+	"29":       quic.VersionDraft29,
+}
+
+// ParseVersions 解析逗号分隔的quic版本列表，如"v1,draft29"，也可以直接写版本号"0xff00001d"。
+// 客户端用第一个版本发起连接，服务端返回版本协商包时从列表中选择
+func ParseVersions(versions string) ([]quic.VersionNumber, error) {
+	var result []quic.VersionNumber
+	for _, name := range strings.Split(versions, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if version, found := versionNames[name]; found {
+			result = append(result, version)
+			continue
+		}
+		number, err := strconv.ParseUint(name, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unknown quic version:%s", name)
+		}
+		result = append(result, quic.VersionNumber(number))
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("empty quic version list")
+	}
+	return result, nil
+}
+
+// ParseAlpn 解析逗号分隔的alpn列表
+func ParseAlpn(alpn string) []string {
+	var result []string
+	for _, proto := range strings.Split(alpn, ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			result = append(result, proto)
+		}
+	}
+	return result
+}
+
+// H3AlpnForVersion 返回quic版本对应的http/3 alpn
+func H3AlpnForVersion(version quic.VersionNumber) string {
+	if version == quic.VersionDraft29 {
+		return H3Draft29Alpn
+	}
+	return H3Alpn
+}
+
+// WaitHandshake 等待握手完成，session在握手完成前关闭时返回false
+func WaitHandshake(session quic.EarlySession) bool {
+	select {
+	case <-session.HandshakeComplete().Done():
+		return true
+	case <-session.Context().Done():
+		return false
+	}
+}
@@ -1,35 +1,157 @@
 package quicConn
 
 import (
+	"errors"
+	"fmt"
 	"github.com/lucas-clemente/quic-go"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 应用层错误码，用于CloseWithError/CancelRead/CancelWrite
+const (
+	CodeNoError       = 0x0
+	CodeInternalError = 0x1
+	CodeCanceled      = 0x2
+	CodeTimeout       = 0x3
+)
+
+// CloseError 对端(或本端)关闭连接/流的原因
+type CloseError struct {
+	Remote bool   // 是否由对端发起
+	Stream bool   // true: 流被取消(RESET_STREAM/STOP_SENDING), false: 连接被关闭
+	Code   uint64 // 应用层错误码或传输层错误码
+	Reason string // 对端携带的关闭原因
+	Err    error  // 原始错误
+}
+
+func (e *CloseError) Error() string {
+	who := "local"
+	if e.Remote {
+		who = "remote"
+	}
+	if e.Stream {
+		return fmt.Sprintf("quic stream canceled by %s, code:%#x", who, e.Code)
+	}
+	return fmt.Sprintf("quic session closed by %s, code:%#x, reason:%s", who, e.Code, e.Reason)
+}
+
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
 type QuicConn struct {
 	QuicSession quic.Session
 	QuicStream  quic.Stream
+	// Linger 独占session正常关闭时，发送FIN后等待读方向结束的最长时间，0时立即关闭session。
+	// 关闭session会丢掉还未确认的数据，对端收到FIN后关闭流时本端的数据已经全部送达
+	Linger time.Duration
+
+	ownSession bool // Close时是否同时关闭session，多路复用时session由QuicSessionMux管理
+	closeOnce  sync.Once
+	closeErr   error
+	// 本端取消过读/写，之后读写返回的流错误是本端引起的
+	readCanceled  int32
+	writeCanceled int32
+	onClose       func()        // 关闭后调用，可以为nil
+	readDone      chan struct{} // Read返回错误(包括io.EOF)后关闭
+	readDoneOnce  sync.Once
 }
 
 func NewQuicConn(quicSession quic.Session, quicStream quic.Stream) *QuicConn {
 	return &QuicConn{
 		QuicSession: quicSession,
 		QuicStream:  quicStream,
+		ownSession:  true,
+		readDone:    make(chan struct{}),
+	}
+}
+
+// NewQuicStreamConn 只封装session上的一条流，Close时不关闭session
+func NewQuicStreamConn(quicSession quic.Session, quicStream quic.Stream) *QuicConn {
+	return &QuicConn{
+		QuicSession: quicSession,
+		QuicStream:  quicStream,
+		readDone:    make(chan struct{}),
 	}
 }
 
 func (q *QuicConn) Read(b []byte) (n int, err error) {
-	return q.QuicStream.Read(b)
+	n, err = q.QuicStream.Read(b)
+	if err != nil {
+		q.readDoneOnce.Do(func() { close(q.readDone) })
+	}
+	return n, wrapError(err, atomic.LoadInt32(&q.readCanceled) == 0)
 }
 
 func (q *QuicConn) Write(b []byte) (n int, err error) {
-	return q.QuicStream.Write(b)
+	n, err = q.QuicStream.Write(b)
+	return n, wrapError(err, atomic.LoadInt32(&q.writeCanceled) == 0)
 }
 
+// Close 发送FIN，如果独占session则同时关闭session
 func (q *QuicConn) Close() error {
+	return q.CloseWithError(CodeNoError, "")
+}
+
+// CloseWithError 以指定的应用层错误码关闭session，reason会发送给对端。
+// code为0时先发送FIN，Linger大于0时等读方向结束(最多Linger)后再关闭session；
+// 非0时立即关闭。共享session时只关闭本条流：code非0时以该错误码取消读写，否则发送FIN
+func (q *QuicConn) CloseWithError(code uint64, reason string) error {
+	q.closeOnce.Do(func() {
+		if q.onClose != nil {
+			defer q.onClose()
+		}
+		if !q.ownSession {
+			if code != CodeNoError {
+				q.CancelRead(code)
+				q.CancelWrite(code)
+				return
+			}
+			q.closeErr = q.QuicStream.Close()
+			return
+		}
+		if code == CodeNoError {
+			q.QuicStream.Close()
+			q.wait(q.Linger)
+		}
+		q.closeErr = q.QuicSession.CloseWithError(quic.ApplicationErrorCode(code), reason)
+	})
+	return q.closeErr
+}
+
+// wait 等待正在读这条流的协程读到结尾或出错，最多linger。本身不读取数据，没有协程在读时只会等到超时
+func (q *QuicConn) wait(linger time.Duration) {
+	if linger <= 0 {
+		return
+	}
+	timer := time.NewTimer(linger)
+	defer timer.Stop()
+	select {
+	case <-q.readDone:
+	case <-timer.C:
+	}
+}
+
+// CloseWrite 只关闭写方向(发送FIN)，仍可继续读
+func (q *QuicConn) CloseWrite() error {
 	return q.QuicStream.Close()
 }
 
+// CancelRead 要求对端停止发送(STOP_SENDING)
+func (q *QuicConn) CancelRead(code uint64) {
+	atomic.StoreInt32(&q.readCanceled, 1)
+	q.QuicStream.CancelRead(quic.StreamErrorCode(code))
+}
+
+// CancelWrite 放弃未发送完的数据(RESET_STREAM)
+func (q *QuicConn) CancelWrite(code uint64) {
+	atomic.StoreInt32(&q.writeCanceled, 1)
+	q.QuicStream.CancelWrite(quic.StreamErrorCode(code))
+}
+
 func (q *QuicConn) LocalAddr() net.Addr {
 	return q.QuicSession.LocalAddr()
 }
@@ -49,3 +171,39 @@ func (q *QuicConn) SetReadDeadline(t time.Time) error {
 func (q *QuicConn) SetWriteDeadline(t time.Time) error {
 	return q.QuicStream.SetWriteDeadline(t)
 }
+
+// wrapError 将quic-go的关闭类错误转换为CloseError，其他错误(io.EOF、超时等)原样返回。
+// 流错误是否由对端发起由调用方判断：本端没有取消过这个方向时才是对端的RESET_STREAM/STOP_SENDING
+func wrapError(err error, remoteStream bool) error {
+	if err == nil {
+		return nil
+	}
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		return &CloseError{
+			Remote: appErr.Remote,
+			Code:   uint64(appErr.ErrorCode),
+			Reason: appErr.ErrorMessage,
+			Err:    err,
+		}
+	}
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) {
+		return &CloseError{
+			Remote: transportErr.Remote,
+			Code:   uint64(transportErr.ErrorCode),
+			Reason: transportErr.ErrorMessage,
+			Err:    err,
+		}
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		return &CloseError{
+			Remote: remoteStream,
+			Stream: true,
+			Code:   uint64(streamErr.ErrorCode),
+			Err:    err,
+		}
+	}
+	return err
+}
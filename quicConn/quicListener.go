@@ -0,0 +1,215 @@
+package quicConn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"log"
+	"net"
+	"sync"
+)
+
+const RtmpOverQuicAlpn = "rtmp over quic"
+
+var ErrListenerClosed = errors.New("listener is closed")
+
+// Listener 实现net.Listener，可以同时监听quic、tcp和tls。
+// quic上每个session的每条双向流都作为一个net.Conn返回
+type Listener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock          sync.Mutex
+	addrs         []net.Addr
+	netListeners  []net.Listener
+	quicListeners []quic.EarlyListener
+	sessions      map[*QuicSessionMux]struct{}
+}
+
+func NewListener() *Listener {
+	return &Listener{
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+		sessions: make(map[*QuicSessionMux]struct{}),
+	}
+}
+
+// Listen 创建Listener并监听network(quic/tcp/tls)指定的传输层
+func Listen(network string, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (*Listener, error) {
+	l := NewListener()
+	if err := l.Listen(network, addr, tlsConfig, quicConfig); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Listen 增加一个传输层监听，tcp不需要tlsConfig。
+// quic的tlsConfig未设置NextProtos时使用"rtmp over quic"
+func (l *Listener) Listen(network string, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) error {
+	switch network {
+	case "quic":
+		if tlsConfig == nil {
+			return fmt.Errorf("quic listener need tls config")
+		}
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = []string{RtmpOverQuicAlpn}
+		}
+		// 接受0-RTT，客户端恢复会话时rtmp握手可以随第一个包发过来
+		quicListener, err := quic.ListenAddrEarly(addr, tlsConfig, quicConfig)
+		if err != nil {
+			return fmt.Errorf("quic.ListenAddrEarly failed, addr:%s, err:%v", addr, err)
+		}
+		l.lock.Lock()
+		l.quicListeners = append(l.quicListeners, quicListener)
+		l.addrs = append(l.addrs, quicListener.Addr())
+		l.lock.Unlock()
+		// quicConfig.Tracer为*Tracer时，打印每个session协商的版本和alpn
+		var tracer *Tracer
+		if quicConfig != nil {
+			tracer, _ = quicConfig.Tracer.(*Tracer)
+		}
+		go l.acceptSessions(quicListener, tracer)
+	case "tcp", "tls":
+		netListener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("net.Listen failed, addr:%s, err:%v", addr, err)
+		}
+		if network == "tls" {
+			if tlsConfig == nil {
+				netListener.Close()
+				return fmt.Errorf("tls listener need tls config")
+			}
+			netListener = tls.NewListener(netListener, tlsConfig)
+		}
+		l.lock.Lock()
+		l.netListeners = append(l.netListeners, netListener)
+		l.addrs = append(l.addrs, netListener.Addr())
+		l.lock.Unlock()
+		go l.acceptConns(netListener)
+	default:
+		return fmt.Errorf("unknown network:%s", network)
+	}
+	return nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		for _, netListener := range l.netListeners {
+			netListener.Close()
+		}
+		for _, quicListener := range l.quicListeners {
+			quicListener.Close()
+		}
+		for mux := range l.sessions {
+			mux.Close()
+		}
+	})
+	return nil
+}
+
+// Addr 返回第一个监听地址
+func (l *Listener) Addr() net.Addr {
+	addrs := l.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Addrs 返回所有监听地址，顺序与Listen调用顺序一致
+func (l *Listener) Addrs() []net.Addr {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	addrs := make([]net.Addr, len(l.addrs))
+	copy(addrs, l.addrs)
+	return addrs
+}
+
+func (l *Listener) acceptConns(netListener net.Listener) {
+	for {
+		conn, err := netListener.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+			default:
+				log.Printf("netListener.Accept failed, addr:%v, err:%v", netListener.Addr(), err)
+			}
+			return
+		}
+		if !l.deliver(conn) {
+			return
+		}
+	}
+}
+
+func (l *Listener) acceptSessions(quicListener quic.EarlyListener, tracer *Tracer) {
+	for {
+		quicSession, err := quicListener.Accept(context.Background())
+		if err != nil {
+			select {
+			case <-l.closed:
+			default:
+				log.Printf("quicListener.Accept failed, addr:%v, err:%v", quicListener.Addr(), err)
+			}
+			return
+		}
+		if tracer != nil {
+			go func() {
+				select {
+				case <-quicSession.HandshakeComplete().Done():
+					log.Printf("quic session accepted, remote:%v, %s", quicSession.RemoteAddr(), tracer.SessionInfo(quicSession))
+				case <-quicSession.Context().Done():
+				}
+			}()
+		}
+		go l.acceptStreams(NewQuicSessionMux(quicSession))
+	}
+}
+
+func (l *Listener) acceptStreams(mux *QuicSessionMux) {
+	l.lock.Lock()
+	l.sessions[mux] = struct{}{}
+	l.lock.Unlock()
+	defer func() {
+		l.lock.Lock()
+		delete(l.sessions, mux)
+		l.lock.Unlock()
+	}()
+
+	for {
+		conn, err := mux.AcceptConn(mux.QuicSession.Context())
+		if err != nil {
+			// session已关闭
+			return
+		}
+		if !l.deliver(conn) {
+			return
+		}
+	}
+}
+
+func (l *Listener) deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		conn.Close()
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package quicConn
+
+import (
+	"context"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"sync"
+	"time"
+)
+
+// QuicSessionMux 在一个quic.Session上打开/接收多条双向流，每条流封装为一个QuicConn
+type QuicSessionMux struct {
+	QuicSession quic.Session
+	// Linger 正常关闭时，所有流发送FIN后等待各自读方向结束的总时长上限，与QuicConn.Linger相同，
+	// 0时立即关闭session，还未确认的数据会丢失
+	Linger time.Duration
+
+	lock  sync.Mutex
+	conns map[quic.StreamID]*QuicConn // 关闭后移除
+}
+
+func NewQuicSessionMux(quicSession quic.Session) *QuicSessionMux {
+	return &QuicSessionMux{
+		QuicSession: quicSession,
+		conns:       make(map[quic.StreamID]*QuicConn),
+	}
+}
+
+// OpenConn 打开一条新的双向流，达到对端流数上限时阻塞等待
+func (m *QuicSessionMux) OpenConn(ctx context.Context) (*QuicConn, error) {
+	quicStream, err := m.QuicSession.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("quicSession.OpenStreamSync failed, err:%w", wrapError(err, false))
+	}
+	return m.add(quicStream), nil
+}
+
+// AcceptConn 接收对端打开的下一条双向流
+func (m *QuicSessionMux) AcceptConn(ctx context.Context) (*QuicConn, error) {
+	quicStream, err := m.QuicSession.AcceptStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("quicSession.AcceptStream failed, err:%w", wrapError(err, false))
+	}
+	return m.add(quicStream), nil
+}
+
+// Conns 返回当前已打开且还没有Close的所有流
+func (m *QuicSessionMux) Conns() []*QuicConn {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	conns := make([]*QuicConn, 0, len(m.conns))
+	for _, conn := range m.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Close 关闭所有流和session
+func (m *QuicSessionMux) Close() error {
+	return m.CloseWithError(CodeNoError, "")
+}
+
+// CloseWithError code为0时所有流发送FIN，Linger大于0时等各条流的读方向结束(共最多Linger)后再关闭session；
+// 非0时以该错误码取消所有流并立即关闭
+func (m *QuicSessionMux) CloseWithError(code uint64, reason string) error {
+	conns := m.Conns()
+	for _, conn := range conns {
+		conn.CloseWithError(code, reason)
+	}
+	if code == CodeNoError {
+		deadline := time.Now().Add(m.Linger)
+		for _, conn := range conns {
+			conn.wait(time.Until(deadline))
+		}
+	}
+	return m.QuicSession.CloseWithError(quic.ApplicationErrorCode(code), reason)
+}
+
+func (m *QuicSessionMux) add(quicStream quic.Stream) *QuicConn {
+	conn := NewQuicStreamConn(m.QuicSession, quicStream)
+	id := quicStream.StreamID()
+	conn.onClose = func() {
+		m.lock.Lock()
+		delete(m.conns, id)
+		m.lock.Unlock()
+	}
+	m.lock.Lock()
+	m.conns[id] = conn
+	m.lock.Unlock()
+	return conn
+}
@@ -0,0 +1,342 @@
+package quicConn
+
+import (
+	"context"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tracer 记录每个quic session协商的版本和传输统计，通过quic.Config.Tracer设置，
+// 用session.Context()中的quic.SessionTracingKey关联session
+type Tracer struct {
+	// QlogDir 不为空时每个session在该目录下写一个qlog文件
+	QlogDir string
+
+	lock  sync.Mutex
+	conns map[uint64]*connectionTracer
+	// 已关闭的session保留最后的统计，关闭后仍可以查询，最多保留maxClosedSessions个
+	closed      map[uint64]*connectionTracer
+	closedOrder []uint64
+}
+
+const maxClosedSessions = 64
+
+func NewTracer() *Tracer {
+	return &Tracer{
+		conns:  make(map[uint64]*connectionTracer),
+		closed: make(map[uint64]*connectionTracer),
+	}
+}
+
+func (t *Tracer) TracerForConnection(ctx context.Context, p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	id, ok := ctx.Value(quic.SessionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	connTracer := &connectionTracer{}
+	connTracer.onClose = func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if t.conns[id] != connTracer {
+			return
+		}
+		delete(t.conns, id)
+		t.closed[id] = connTracer
+		t.closedOrder = append(t.closedOrder, id)
+		if len(t.closedOrder) > maxClosedSessions {
+			delete(t.closed, t.closedOrder[0])
+			t.closedOrder = t.closedOrder[1:]
+		}
+	}
+	t.lock.Lock()
+	t.conns[id] = connTracer
+	t.lock.Unlock()
+
+	if t.QlogDir == "" {
+		return connTracer
+	}
+	qlogTracer, err := newQlogTracer(t.QlogDir, p, odcid)
+	if err != nil {
+		log.Printf("create qlog failed, dir:%s, err:%v", t.QlogDir, err)
+		return connTracer
+	}
+	return logging.NewMultiplexedConnectionTracer(connTracer, qlogTracer)
+}
+
+func (t *Tracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+
+func (t *Tracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+func (t *Tracer) get(session quic.Session) *connectionTracer {
+	if session == nil {
+		return nil
+	}
+	id, ok := session.Context().Value(quic.SessionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if connTracer, ok := t.conns[id]; ok {
+		return connTracer
+	}
+	return t.closed[id]
+}
+
+// SessionInfo session协商的结果
+type SessionInfo struct {
+	Version quic.VersionNumber
+	// VersionNegotiation 是否经过了版本协商，即服务端不支持客户端的第一个版本
+	VersionNegotiation bool
+	Alpn               string
+	// Resumed 是否用session ticket恢复了会话
+	Resumed bool
+	// Sent0RTT 是否发送了0-RTT数据，Used0RTT 服务端是否接受了0-RTT
+	Sent0RTT bool
+	Used0RTT bool
+	// Handshake 从发出第一个包到握手完成的耗时
+	Handshake time.Duration
+}
+
+// Saved 0-RTT被接受时，应用数据不用等待握手完成，节省的就是握手的耗时
+func (info SessionInfo) Saved() time.Duration {
+	if info.Used0RTT {
+		return info.Handshake
+	}
+	return 0
+}
+
+// Rejected0RTT 发送了0-RTT数据但被服务端拒绝，已打开的流都会失败，需要在握手完成后重试
+func (info SessionInfo) Rejected0RTT() bool {
+	return info.Sent0RTT && !info.Used0RTT
+}
+
+func (info SessionInfo) String() string {
+	return fmt.Sprintf("quic version:%s(0x%x), version negotiation:%t, alpn:%s, handshake:%dms, resumed:%t, 0-rtt sent:%t, 0-rtt accepted:%t, saved:%dms",
+		info.Version, uint32(info.Version), info.VersionNegotiation, info.Alpn, info.Handshake.Milliseconds(),
+		info.Resumed, info.Sent0RTT, info.Used0RTT, info.Saved().Milliseconds())
+}
+
+// SessionInfo 返回session协商的版本和alpn，握手完成后调用
+func (t *Tracer) SessionInfo(session quic.Session) SessionInfo {
+	state := session.ConnectionState().TLS
+	info := SessionInfo{
+		Alpn:     state.NegotiatedProtocol,
+		Resumed:  state.DidResume,
+		Used0RTT: state.Used0RTT,
+	}
+	if connTracer := t.get(session); connTracer != nil {
+		connTracer.lock.Lock()
+		info.Version = connTracer.version
+		info.VersionNegotiation = connTracer.versionNegotiation
+		info.Sent0RTT = connTracer.sent0RTT
+		if !connTracer.handshakeAt.IsZero() {
+			info.Handshake = connTracer.handshakeAt.Sub(connTracer.startedAt)
+		}
+		connTracer.lock.Unlock()
+	}
+	return info
+}
+
+// Stats 返回session当前的传输统计，session关闭后返回关闭时的统计
+func (t *Tracer) Stats(session quic.Session) SessionStats {
+	connTracer := t.get(session)
+	if connTracer == nil {
+		return SessionStats{}
+	}
+	connTracer.lock.Lock()
+	defer connTracer.lock.Unlock()
+	return connTracer.stats
+}
+
+// SessionStats quic传输统计
+type SessionStats struct {
+	MinRtt        time.Duration
+	SmoothedRtt   time.Duration
+	LatestRtt     time.Duration
+	Cwnd          int64
+	BytesInFlight int64
+
+	PacketsSent     int64
+	BytesSent       int64
+	PacketsReceived int64
+	BytesReceived   int64
+	PacketsLost     int64
+	// RetransmittedBytes 重传的stream数据，发送的stream帧与已发送的区间重叠即为重传
+	RetransmittedBytes int64
+	PtoCount           uint32
+}
+
+// LossRate 丢包率
+func (s SessionStats) LossRate() float64 {
+	if s.PacketsSent == 0 {
+		return 0
+	}
+	return float64(s.PacketsLost) / float64(s.PacketsSent)
+}
+
+func (s SessionStats) String() string {
+	return fmt.Sprintf("quic rtt min:%dms, smoothed:%dms, latest:%dms, cwnd:%d, in flight:%d, "+
+		"sent:%d(%dB), received:%d(%dB), lost:%d(%.2f%%), retransmitted:%dB, pto:%d",
+		s.MinRtt.Milliseconds(), s.SmoothedRtt.Milliseconds(), s.LatestRtt.Milliseconds(), s.Cwnd, s.BytesInFlight,
+		s.PacketsSent, s.BytesSent, s.PacketsReceived, s.BytesReceived, s.PacketsLost, s.LossRate()*100,
+		s.RetransmittedBytes, s.PtoCount)
+}
+
+type connectionTracer struct {
+	nullConnectionTracer
+	lock               sync.Mutex
+	version            quic.VersionNumber
+	versionNegotiation bool
+	sent0RTT           bool
+	startedAt          time.Time
+	handshakeAt        time.Time
+	onClose            func()
+
+	stats SessionStats
+	// streamOffsets 每条流已发送数据的最大偏移，用于统计重传
+	streamOffsets map[logging.StreamID]logging.ByteCount
+}
+
+func (c *connectionTracer) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.startedAt = time.Now()
+}
+
+func (c *connectionTracer) SentPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, ack *logging.AckFrame, frames []logging.Frame) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if logging.PacketTypeFromHeader(&hdr.Header) == logging.PacketType0RTT {
+		c.sent0RTT = true
+	}
+	c.stats.PacketsSent++
+	c.stats.BytesSent += int64(size)
+	for _, frame := range frames {
+		streamFrame, ok := frame.(*logging.StreamFrame)
+		if !ok {
+			continue
+		}
+		if c.streamOffsets == nil {
+			c.streamOffsets = make(map[logging.StreamID]logging.ByteCount)
+		}
+		end := streamFrame.Offset + streamFrame.Length
+		sent := c.streamOffsets[streamFrame.StreamID]
+		if streamFrame.Offset < sent {
+			overlap := sent - streamFrame.Offset
+			if overlap > streamFrame.Length {
+				overlap = streamFrame.Length
+			}
+			c.stats.RetransmittedBytes += int64(overlap)
+		}
+		if end > sent {
+			c.streamOffsets[streamFrame.StreamID] = end
+		}
+	}
+}
+
+func (c *connectionTracer) ReceivedPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats.PacketsReceived++
+	c.stats.BytesReceived += int64(size)
+}
+
+func (c *connectionTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats.MinRtt = rttStats.MinRTT()
+	c.stats.SmoothedRtt = rttStats.SmoothedRTT()
+	c.stats.LatestRtt = rttStats.LatestRTT()
+	c.stats.Cwnd = int64(cwnd)
+	c.stats.BytesInFlight = int64(bytesInFlight)
+}
+
+func (c *connectionTracer) LostPacket(level logging.EncryptionLevel, pn logging.PacketNumber, reason logging.PacketLossReason) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats.PacketsLost++
+}
+
+func (c *connectionTracer) UpdatedPTOCount(value uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if value > 0 {
+		c.stats.PtoCount++
+	}
+}
+
+// UpdatedKeyFromTLS 拿到1-RTT密钥即握手完成
+func (c *connectionTracer) UpdatedKeyFromTLS(level logging.EncryptionLevel, p logging.Perspective) {
+	if level != logging.Encryption1RTT {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.handshakeAt.IsZero() {
+		c.handshakeAt = time.Now()
+	}
+}
+
+func (c *connectionTracer) NegotiatedVersion(chosen logging.VersionNumber, clientVersions, serverVersions []logging.VersionNumber) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.version = chosen
+}
+
+func (c *connectionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.versionNegotiation = true
+}
+
+func (c *connectionTracer) Close() {
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// nullConnectionTracer 空实现，嵌入后只需要实现关心的事件
+type nullConnectionTracer struct{}
+
+func (nullConnectionTracer) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+}
+func (nullConnectionTracer) NegotiatedVersion(chosen logging.VersionNumber, clientVersions, serverVersions []logging.VersionNumber) {
+}
+func (nullConnectionTracer) ClosedConnection(error)                                   {}
+func (nullConnectionTracer) SentTransportParameters(*logging.TransportParameters)     {}
+func (nullConnectionTracer) ReceivedTransportParameters(*logging.TransportParameters) {}
+func (nullConnectionTracer) RestoredTransportParameters(*logging.TransportParameters) {}
+func (nullConnectionTracer) SentPacket(*logging.ExtendedHeader, logging.ByteCount, *logging.AckFrame, []logging.Frame) {
+}
+func (nullConnectionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+}
+func (nullConnectionTracer) ReceivedRetry(*logging.Header) {}
+func (nullConnectionTracer) ReceivedPacket(*logging.ExtendedHeader, logging.ByteCount, []logging.Frame) {
+}
+func (nullConnectionTracer) BufferedPacket(logging.PacketType) {}
+func (nullConnectionTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+func (nullConnectionTracer) UpdatedMetrics(*logging.RTTStats, logging.ByteCount, logging.ByteCount, int) {
+}
+func (nullConnectionTracer) AcknowledgedPacket(logging.EncryptionLevel, logging.PacketNumber) {}
+func (nullConnectionTracer) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+}
+func (nullConnectionTracer) UpdatedCongestionState(logging.CongestionState)                 {}
+func (nullConnectionTracer) UpdatedPTOCount(uint32)                                         {}
+func (nullConnectionTracer) UpdatedKeyFromTLS(logging.EncryptionLevel, logging.Perspective) {}
+func (nullConnectionTracer) UpdatedKey(logging.KeyPhase, bool)                              {}
+func (nullConnectionTracer) DroppedEncryptionLevel(logging.EncryptionLevel)                 {}
+func (nullConnectionTracer) DroppedKey(logging.KeyPhase)                                    {}
+func (nullConnectionTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {
+}
+func (nullConnectionTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel) {}
+func (nullConnectionTracer) LossTimerCanceled()                                          {}
+func (nullConnectionTracer) Close()                                                      {}
+func (nullConnectionTracer) Debug(name, msg string)                                      {}
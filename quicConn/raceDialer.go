@@ -0,0 +1,263 @@
+package quicConn
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"net"
+	"quic_demo/timing"
+	"strconv"
+	"time"
+)
+
+// RaceDialer quic与tcp(或tcp+tls)赛跑建连，类似Happy Eyeballs，用于udp可能被封的网络。
+// quic先发，HeadStart内quic没有连上(或已失败)才开始tcp；tcp先连上时再等quic Grace，
+// Grace内quic连上仍然用quic，Grace为0时谁先连上用谁
+type RaceDialer struct {
+	Enabled   bool
+	TcpPort   int  // tcp端口，0时与quic相同
+	Tls       bool // tcp上是否做tls
+	HeadStart time.Duration
+	Grace     time.Duration
+
+	QuicAddr      string
+	TcpAddr       string // 为空时使用QuicAddr的ip和TcpPort
+	QuicTlsConfig *tls.Config
+	QuicConfig    *quic.Config
+	TlsConfig     *tls.Config
+	Timing        *timing.Recorder
+}
+
+// AddFlags 在flag.CommandLine上注册赛跑相关参数，useTls为tcp上是否默认做tls
+func (d *RaceDialer) AddFlags(useTls bool) {
+	flag.BoolVar(&d.Enabled, "race", false, "race quic against tcp, fall back to tcp when udp is blocked")
+	flag.IntVar(&d.TcpPort, "tcpPort", 0, "tcp port for the race, default the quic port")
+	flag.BoolVar(&d.Tls, "tcpTls", useTls, "use tls on the tcp connection of the race")
+	flag.DurationVar(&d.HeadStart, "headStart", 250*time.Millisecond, "head start of quic before tcp is dialed")
+	flag.DurationVar(&d.Grace, "grace", 0, "after tcp connects, still use quic if it connects within this time")
+}
+
+// RaceResult 赛跑结果，Session和Conn只有一个不为空
+type RaceResult struct {
+	Session   quic.EarlySession
+	Conn      net.Conn
+	Transport string // quic/tcp/tcp+tls
+	Reason    string
+	QuicErr   error
+	TcpErr    error
+	QuicMs    float64 // quic握手耗时，未完成为0
+	TcpMs     float64 // tcp(含tls)建连耗时，未开始或未完成为0
+}
+
+func (r *RaceResult) String() string {
+	return fmt.Sprintf("race winner:%s, reason:%s, quic:%.1fms, tcp:%.1fms, quic err:%v, tcp err:%v",
+		r.Transport, r.Reason, r.QuicMs, r.TcpMs, r.QuicErr, r.TcpErr)
+}
+
+type raceAttempt struct {
+	session quic.EarlySession
+	conn    net.Conn
+	err     error
+	ms      float64
+}
+
+func (d *RaceDialer) tcpTransport() string {
+	if d.TlsConfig != nil {
+		return "tcp+tls"
+	}
+	return "tcp"
+}
+
+func (d *RaceDialer) dialQuic(ctx context.Context) raceAttempt {
+	begin := time.Now()
+	d.Timing.Start(timing.PhaseQuicHandshake)
+	session, err := quic.DialAddrEarlyContext(ctx, d.QuicAddr, d.QuicTlsConfig, d.QuicConfig)
+	if err != nil {
+		return raceAttempt{err: err}
+	}
+	// 要等握手完成才算连上，0-RTT的数据可能被拒绝
+	select {
+	case <-session.HandshakeComplete().Done():
+	case <-session.Context().Done():
+		return raceAttempt{err: fmt.Errorf("quic handshake failed, err:%v", session.Context().Err())}
+	case <-ctx.Done():
+		session.CloseWithError(CodeCanceled, "lost the race")
+		return raceAttempt{err: ctx.Err()}
+	}
+	d.Timing.End(timing.PhaseQuicHandshake)
+	return raceAttempt{session: session, ms: msSince(begin)}
+}
+
+func (d *RaceDialer) dialTcp(ctx context.Context) raceAttempt {
+	begin := time.Now()
+	dialer := net.Dialer{}
+	d.Timing.Start(timing.PhaseTcpConnect)
+	conn, err := dialer.DialContext(ctx, "tcp", d.TcpAddr)
+	if err != nil {
+		return raceAttempt{err: err}
+	}
+	d.Timing.End(timing.PhaseTcpConnect)
+	if d.TlsConfig != nil {
+		// 握手跟随ctx：quic赢了或赛跑超时后关闭连接，避免握手一直阻塞
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func(conn net.Conn) {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-stop:
+			}
+		}(conn)
+		d.Timing.Start(timing.PhaseTlsHandshake)
+		tlsConn := tls.Client(conn, d.TlsConfig)
+		err := tlsConn.Handshake()
+		close(stop)
+		<-exited
+		// 握手完成的同时ctx结束时连接可能已被关闭
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return raceAttempt{err: err}
+		}
+		d.Timing.End(timing.PhaseTlsHandshake)
+		conn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return raceAttempt{conn: conn, ms: msSince(begin)}
+}
+
+// Dial 开始赛跑，返回赢的一方，输的一方连上后会被关闭
+func (d *RaceDialer) Dial(ctx context.Context) (*RaceResult, error) {
+	if d.TcpAddr == "" {
+		host, port, err := net.SplitHostPort(d.QuicAddr)
+		if err != nil {
+			return nil, err
+		}
+		if d.TcpPort != 0 {
+			port = strconv.Itoa(d.TcpPort)
+		}
+		d.TcpAddr = net.JoinHostPort(host, port)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	quicCh := make(chan raceAttempt, 1)
+	tcpCh := make(chan raceAttempt, 1)
+	go func() {
+		quicCh <- d.dialQuic(ctx)
+	}()
+	tcpStarted := false
+	startTcp := func() {
+		if !tcpStarted {
+			tcpStarted = true
+			go func() {
+				tcpCh <- d.dialTcp(ctx)
+			}()
+		}
+	}
+	headStart := time.NewTimer(d.HeadStart)
+	defer headStart.Stop()
+
+	result := &RaceResult{}
+	quicDone, tcpDone := false, false
+	var tcpConn net.Conn
+	var grace <-chan time.Time
+
+	// 返回前关闭还在进行中的一方
+	finish := func(reason string) (*RaceResult, error) {
+		result.Reason = reason
+		if result.Session != nil {
+			result.Transport = "quic"
+			if tcpStarted && !tcpDone {
+				go closeAttempt(tcpCh)
+			}
+		} else {
+			result.Transport = d.tcpTransport()
+			result.Conn = tcpConn
+			if !quicDone {
+				go closeAttempt(quicCh)
+			}
+		}
+		if d.Timing != nil {
+			d.Timing.Transport = result.Transport
+		}
+		return result, nil
+	}
+
+	for {
+		select {
+		case <-headStart.C:
+			startTcp()
+		case attempt := <-quicCh:
+			quicDone = true
+			if attempt.err == nil {
+				result.Session, result.QuicMs = attempt.session, attempt.ms
+				if tcpConn != nil {
+					tcpConn.Close()
+					return finish("quic connected within the grace period")
+				}
+				if !tcpStarted {
+					return finish("quic connected within the head start")
+				}
+				return finish("quic connected first")
+			}
+			result.QuicErr = attempt.err
+			if tcpConn != nil {
+				return finish("quic failed during the grace period")
+			}
+			if tcpDone {
+				return nil, fmt.Errorf("quic and tcp both failed, %v", result)
+			}
+			startTcp()
+		case attempt := <-tcpCh:
+			tcpDone = true
+			if attempt.err != nil {
+				result.TcpErr = attempt.err
+				if quicDone {
+					return nil, fmt.Errorf("quic and tcp both failed, %v", result)
+				}
+				continue
+			}
+			tcpConn, result.TcpMs = attempt.conn, attempt.ms
+			if quicDone {
+				return finish("quic failed")
+			}
+			if d.Grace <= 0 {
+				return finish("tcp connected first")
+			}
+			grace = time.After(d.Grace)
+		case <-grace:
+			return finish("quic not connected within the grace period")
+		case <-ctx.Done():
+			if tcpConn != nil {
+				tcpConn.Close()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func closeAttempt(ch <-chan raceAttempt) {
+	attempt := <-ch
+	if attempt.session != nil {
+		attempt.session.CloseWithError(CodeCanceled, "lost the race")
+	}
+	if attempt.conn != nil {
+		attempt.conn.Close()
+	}
+}
+
+func msSince(begin time.Time) float64 {
+	return float64(time.Since(begin)) / float64(time.Millisecond)
+}
@@ -0,0 +1,295 @@
+package quicConn
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RebindPacketConn 客户端的udp socket，Rebind时换成一个新端口的socket，
+// 用于模拟NAT重绑定或wifi切换到蜂窝网络。quic-go通过ReadFrom/WriteTo收发，不使用读超时
+type RebindPacketConn struct {
+	packets   chan rebindPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock        sync.Mutex
+	current     net.PacketConn
+	conns       []net.PacketConn
+	rebindAt    time.Time
+	oldAddr     net.Addr
+	firstPacket time.Duration // rebind后新socket第一次收到包的耗时
+}
+
+type rebindPacket struct {
+	data []byte
+	addr net.Addr
+	conn net.PacketConn
+}
+
+// NewRebindPacketConn 在随机端口上监听udp
+func NewRebindPacketConn() (*RebindPacketConn, error) {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	c := &RebindPacketConn{
+		packets: make(chan rebindPacket, 256),
+		closed:  make(chan struct{}),
+		current: conn,
+		conns:   []net.PacketConn{conn},
+	}
+	go c.readLoop(conn)
+	return c, nil
+}
+
+func (c *RebindPacketConn) readLoop(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case c.packets <- rebindPacket{data: append([]byte(nil), buf[:n]...), addr: addr, conn: conn}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *RebindPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		c.lock.Lock()
+		if packet.conn == c.current && !c.rebindAt.IsZero() && c.firstPacket == 0 {
+			c.firstPacket = time.Since(c.rebindAt)
+		}
+		c.lock.Unlock()
+		return copy(p, packet.data), packet.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *RebindPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.lock.Lock()
+	conn := c.current
+	c.lock.Unlock()
+	return conn.WriteTo(p, addr)
+}
+
+// Rebind 之后从新socket发包。keepOld为0时立即关闭旧socket(断开后再连)，
+// 否则旧socket继续收包keepOld后再关闭(先连后断)
+func (c *RebindPacketConn) Rebind(keepOld time.Duration) error {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	old := c.current
+	c.current = conn
+	c.conns = append(c.conns, conn)
+	c.rebindAt = time.Now()
+	c.oldAddr = old.LocalAddr()
+	c.firstPacket = 0
+	c.lock.Unlock()
+	go c.readLoop(conn)
+	if keepOld > 0 {
+		time.AfterFunc(keepOld, func() {
+			old.Close()
+		})
+	} else {
+		old.Close()
+	}
+	return nil
+}
+
+func (c *RebindPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for _, conn := range c.conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+func (c *RebindPacketConn) LocalAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.current.LocalAddr()
+}
+
+func (c *RebindPacketConn) SetDeadline(t time.Time) error {
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 不支持，quic-go不会调用
+func (c *RebindPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *RebindPacketConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.current.SetWriteDeadline(t)
+}
+
+// RebindTest 连接迁移测试，After后替换客户端socket，观察Observe后输出流是否存活、媒体中断多久
+// quic-go的服务端按建连时的地址回包，KeepOld为0(旧端口立即失效)时通常无法存活，KeepOld足够长时可以
+type RebindTest struct {
+	After   time.Duration
+	KeepOld time.Duration
+	Observe time.Duration
+	// SendSide 推流端为true。推流端的OnTag在tag写入quic流的缓冲后就返回，tag间隔只反映本地发送节奏，
+	// 不代表数据到达对端，不能作为媒体中断时长
+	SendSide bool
+
+	conn      *RebindPacketConn
+	lock      sync.Mutex
+	rebindAt  time.Time
+	lastTag   time.Time
+	maxGap    time.Duration
+	tagsAfter int64
+}
+
+// AddFlags 在flag.CommandLine上注册迁移测试参数
+func (t *RebindTest) AddFlags() {
+	flag.DurationVar(&t.After, "rebindAfter", 0, "swap the client udp socket after this time to simulate nat rebinding, 0 to disable")
+	flag.DurationVar(&t.KeepOld, "rebindKeepOld", 0, "keep receiving on the old socket for this time after the swap, 0 closes it at once")
+	flag.DurationVar(&t.Observe, "rebindObserve", 10*time.Second, "report the rebinding result after this time")
+}
+
+func (t *RebindTest) Enabled() bool {
+	return t.After > 0
+}
+
+// DialEarly 在可替换的socket上建立quic连接
+func (t *RebindTest) DialEarly(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlySession, error) {
+	remoteAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := NewRebindPacketConn()
+	if err != nil {
+		return nil, err
+	}
+	session, err := quic.DialEarly(conn, remoteAddr, host, tlsConfig, quicConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.conn = conn
+	// quic.DialEarly不会关闭传入的socket
+	go func() {
+		<-session.Context().Done()
+		conn.Close()
+	}()
+	return session, nil
+}
+
+// OnTag 记录收发tag的时间，用作RtmpPublisher/RtmpPlay的OnTag
+func (t *RebindTest) OnTag(tagType uint8, timestamp uint32, body []byte) {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.rebindAt.IsZero() {
+		t.tagsAfter++
+		last := t.lastTag
+		if last.Before(t.rebindAt) {
+			last = t.rebindAt
+		}
+		if gap := now.Sub(last); gap > t.maxGap {
+			t.maxGap = gap
+		}
+	}
+	t.lastTag = now
+}
+
+// RebindResult 迁移测试结果
+type RebindResult struct {
+	OldAddr     net.Addr
+	NewAddr     net.Addr
+	KeepOld     time.Duration
+	FirstPacket time.Duration // 新socket第一次收到包的耗时，0表示没有收到
+	MaxGap      time.Duration // rebind后最长的tag间隔，播放端为媒体中断时长，推流端只是本地发送的间隔
+	TagsAfter   int64
+	SendSide    bool
+	Survived    bool
+	Err         error
+}
+
+func (r RebindResult) String() string {
+	gapName := "media stall"
+	if r.SendSide {
+		gapName = "send-side tag gap"
+	}
+	return fmt.Sprintf("rebind result, old:%v, new:%v, keepOld:%v, survived:%v, first packet on new socket:%v, %s:%v, tags after:%d, err:%v",
+		r.OldAddr, r.NewAddr, r.KeepOld, r.Survived, r.FirstPacket, gapName, r.MaxGap, r.TagsAfter, r.Err)
+}
+
+// Run After后替换socket，Observe后返回结果，session提前结束时也返回
+func (t *RebindTest) Run(session quic.Session) RebindResult {
+	result := RebindResult{KeepOld: t.KeepOld, SendSide: t.SendSide}
+	select {
+	case <-time.After(t.After):
+	case <-session.Context().Done():
+		result.Err = fmt.Errorf("session closed before rebinding")
+		return result
+	}
+	if err := t.conn.Rebind(t.KeepOld); err != nil {
+		result.Err = err
+		return result
+	}
+	t.lock.Lock()
+	t.rebindAt = time.Now()
+	t.lock.Unlock()
+	log.Printf("rebind client socket, old:%v, new:%v", t.conn.oldLocalAddr(), t.conn.LocalAddr())
+
+	select {
+	case <-time.After(t.Observe):
+	case <-session.Context().Done():
+	}
+	result.OldAddr = t.conn.oldLocalAddr()
+	result.NewAddr = t.conn.LocalAddr()
+	result.FirstPacket = t.conn.firstPacketAfterRebind()
+	t.lock.Lock()
+	result.TagsAfter = t.tagsAfter
+	result.MaxGap = t.maxGap
+	// 观察结束时还没有新的tag，中断一直持续到现在
+	last := t.lastTag
+	if last.Before(t.rebindAt) {
+		last = t.rebindAt
+	}
+	if gap := time.Since(last); gap > result.MaxGap {
+		result.MaxGap = gap
+	}
+	t.lock.Unlock()
+	result.Err = session.Context().Err()
+	result.Survived = result.Err == nil && result.TagsAfter > 0
+	return result
+}
+
+func (c *RebindPacketConn) oldLocalAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.oldAddr
+}
+
+func (c *RebindPacketConn) firstPacketAfterRebind() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.firstPacket
+}
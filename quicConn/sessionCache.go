@@ -0,0 +1,212 @@
+package quicConn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// clientSessionState 与go1.16/go1.17中tls.ClientSessionState的内存布局一致，
+// 标准库没有提供session的序列化接口，qtls也是用同样的方式转换的
+type clientSessionState struct {
+	sessionTicket      []uint8
+	vers               uint16
+	cipherSuite        uint16
+	masterSecret       []byte
+	serverCertificates []*x509.Certificate
+	verifiedChains     [][]*x509.Certificate
+	receivedAt         time.Time
+	ocspResponse       []byte
+	scts               [][]byte
+	nonce              []byte
+	useBy              time.Time
+	ageAdd             uint32
+}
+
+// sessionEntry 写入文件的session，证书保存为DER
+type sessionEntry struct {
+	SessionTicket      []byte     `json:"sessionTicket"`
+	Vers               uint16     `json:"vers"`
+	CipherSuite        uint16     `json:"cipherSuite"`
+	MasterSecret       []byte     `json:"masterSecret"`
+	ServerCertificates [][]byte   `json:"serverCertificates"`
+	VerifiedChains     [][][]byte `json:"verifiedChains"`
+	ReceivedAt         time.Time  `json:"receivedAt"`
+	OcspResponse       []byte     `json:"ocspResponse"`
+	Scts               [][]byte   `json:"scts"`
+	Nonce              []byte     `json:"nonce"`
+	UseBy              time.Time  `json:"useBy"`
+	AgeAdd             uint32     `json:"ageAdd"`
+}
+
+// canPersistSession 当前go版本的tls.ClientSessionState布局是否与clientSessionState一致
+func canPersistSession() bool {
+	a := reflect.TypeOf(tls.ClientSessionState{})
+	b := reflect.TypeOf(clientSessionState{})
+	if a.NumField() != b.NumField() {
+		return false
+	}
+	for i := 0; i < a.NumField(); i++ {
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Name != fb.Name || fa.Type != fb.Type || fa.Offset != fb.Offset {
+			return false
+		}
+	}
+	return a.Size() == b.Size()
+}
+
+// FileSessionCache 实现tls.ClientSessionCache，session ticket保存到文件，
+// 下次运行时可以直接恢复会话并发送0-RTT数据。文件中包含会话密钥，注意保管
+type FileSessionCache struct {
+	FileName string
+
+	lock     sync.Mutex
+	sessions map[string]*tls.ClientSessionState
+	entries  map[string]*sessionEntry
+}
+
+// NewFileSessionCache 从文件加载session，文件不存在时返回空的cache。
+// 当前go版本不支持序列化时只在内存中缓存
+func NewFileSessionCache(fileName string) (*FileSessionCache, error) {
+	cache := &FileSessionCache{
+		FileName: fileName,
+		sessions: make(map[string]*tls.ClientSessionState),
+		entries:  make(map[string]*sessionEntry),
+	}
+	if fileName == "" {
+		return cache, nil
+	}
+	if !canPersistSession() {
+		log.Printf("tls.ClientSessionState layout changed, session cache is kept in memory only")
+		return cache, nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, fmt.Errorf("read session cache failed, file:%s, err:%v", fileName, err)
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, fmt.Errorf("parse session cache failed, file:%s, err:%v", fileName, err)
+	}
+	for key, entry := range cache.entries {
+		session, err := entry.decode()
+		if err != nil || time.Now().After(entry.UseBy) {
+			delete(cache.entries, key)
+			continue
+		}
+		cache.sessions[key] = session
+	}
+	return cache, nil
+}
+
+func (c *FileSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	session, ok := c.sessions[sessionKey]
+	return session, ok
+}
+
+// Put 保存session并写入文件，session为nil时删除
+func (c *FileSessionCache) Put(sessionKey string, session *tls.ClientSessionState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if session == nil {
+		delete(c.sessions, sessionKey)
+		delete(c.entries, sessionKey)
+	} else {
+		c.sessions[sessionKey] = session
+		if c.FileName != "" && canPersistSession() {
+			c.entries[sessionKey] = encodeSession(session)
+		}
+	}
+	if err := c.save(); err != nil {
+		log.Printf("save session cache failed, err:%v", err)
+	}
+}
+
+func (c *FileSessionCache) save() error {
+	if c.FileName == "" || !canPersistSession() {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再改名，避免写到一半退出导致文件损坏
+	tmpName := c.FileName + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, c.FileName)
+}
+
+func encodeSession(session *tls.ClientSessionState) *sessionEntry {
+	state := (*clientSessionState)(unsafe.Pointer(session))
+	entry := &sessionEntry{
+		SessionTicket: state.sessionTicket,
+		Vers:          state.vers,
+		CipherSuite:   state.cipherSuite,
+		MasterSecret:  state.masterSecret,
+		ReceivedAt:    state.receivedAt,
+		OcspResponse:  state.ocspResponse,
+		Scts:          state.scts,
+		Nonce:         state.nonce,
+		UseBy:         state.useBy,
+		AgeAdd:        state.ageAdd,
+	}
+	for _, cert := range state.serverCertificates {
+		entry.ServerCertificates = append(entry.ServerCertificates, cert.Raw)
+	}
+	for _, chain := range state.verifiedChains {
+		var rawChain [][]byte
+		for _, cert := range chain {
+			rawChain = append(rawChain, cert.Raw)
+		}
+		entry.VerifiedChains = append(entry.VerifiedChains, rawChain)
+	}
+	return entry
+}
+
+func (entry *sessionEntry) decode() (*tls.ClientSessionState, error) {
+	state := &clientSessionState{
+		sessionTicket: entry.SessionTicket,
+		vers:          entry.Vers,
+		cipherSuite:   entry.CipherSuite,
+		masterSecret:  entry.MasterSecret,
+		receivedAt:    entry.ReceivedAt,
+		ocspResponse:  entry.OcspResponse,
+		scts:          entry.Scts,
+		nonce:         entry.Nonce,
+		useBy:         entry.UseBy,
+		ageAdd:        entry.AgeAdd,
+	}
+	for _, raw := range entry.ServerCertificates {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		state.serverCertificates = append(state.serverCertificates, cert)
+	}
+	for _, rawChain := range entry.VerifiedChains {
+		var chain []*x509.Certificate
+		for _, raw := range rawChain {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, cert)
+		}
+		state.verifiedChains = append(state.verifiedChains, chain)
+	}
+	return (*tls.ClientSessionState)(unsafe.Pointer(state)), nil
+}
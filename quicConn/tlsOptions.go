@@ -0,0 +1,126 @@
+package quicConn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TlsOptions 客户端tls参数，tls、quic和http/3的拨号共用
+type TlsOptions struct {
+	CaFile     string // 自定义CA证书(PEM)，为空时使用系统CA
+	CertFile   string // 客户端证书，用于mTLS
+	KeyFile    string
+	Insecure   bool   // 不校验服务端证书，仅用于实验环境
+	ServerName string // SNI，为空时使用url中的域名
+	MinVersion string // 1.0/1.1/1.2/1.3，quic固定使用1.3
+	MaxVersion string
+	KeyLogFile string // 按NSS格式记录会话密钥，用于wireshark解密，默认取环境变量SSLKEYLOGFILE
+
+	// key log文件只打开一次，多次生成的tls.Config共用同一个writer
+	keyLogOnce sync.Once
+	keyLog     io.Writer
+	keyLogErr  error
+}
+
+// AddFlags 在flag.CommandLine上注册tls相关参数
+func (o *TlsOptions) AddFlags() {
+	flag.StringVar(&o.CaFile, "caFile", "", "ca bundle file to verify the server, system roots if empty")
+	flag.StringVar(&o.CertFile, "clientCert", "", "client cert file for mTLS")
+	flag.StringVar(&o.KeyFile, "clientKey", "", "client key file for mTLS")
+	flag.BoolVar(&o.Insecure, "insecure", false, "skip server certificate verification, lab only")
+	flag.StringVar(&o.ServerName, "sni", "", "tls server name, default the url host")
+	flag.StringVar(&o.MinVersion, "tlsMin", "", "min tls version, 1.0/1.1/1.2/1.3")
+	flag.StringVar(&o.MaxVersion, "tlsMax", "", "max tls version, 1.0/1.1/1.2/1.3, quic always uses 1.3")
+	flag.StringVar(&o.KeyLogFile, "keyLogFile", os.Getenv("SSLKEYLOGFILE"), "write tls secrets in NSS key log format, default $SSLKEYLOGFILE")
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTlsVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown tls version:%s", version)
+}
+
+// ClientConfig 生成客户端tls.Config，ServerName未指定时使用defaultServerName
+func (o *TlsOptions) ClientConfig(defaultServerName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         defaultServerName,
+		InsecureSkipVerify: o.Insecure,
+	}
+	if o.ServerName != "" {
+		config.ServerName = o.ServerName
+	}
+
+	if o.CaFile != "" {
+		pem, err := ioutil.ReadFile(o.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file failed, file:%s, err:%v", o.CaFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca file, file:%s", o.CaFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.LoadX509KeyPair failed, cert:%s, key:%s, err:%v", o.CertFile, o.KeyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	var err error
+	if config.MinVersion, err = parseTlsVersion(o.MinVersion); err != nil {
+		return nil, err
+	}
+	if config.MaxVersion, err = parseTlsVersion(o.MaxVersion); err != nil {
+		return nil, err
+	}
+
+	if o.KeyLogFile != "" {
+		o.keyLogOnce.Do(func() {
+			keyLog, err := os.OpenFile(o.KeyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				o.keyLogErr = fmt.Errorf("open key log file failed, file:%s, err:%v", o.KeyLogFile, err)
+				return
+			}
+			o.keyLog = keyLog
+		})
+		if o.keyLogErr != nil {
+			return nil, o.keyLogErr
+		}
+		config.KeyLogWriter = o.keyLog
+	}
+	return config, nil
+}
+
+// QuicClientConfig 同ClientConfig，quic只支持tls1.3，指定了更低的最大版本时报错
+func (o *TlsOptions) QuicClientConfig(defaultServerName string) (*tls.Config, error) {
+	config, err := o.ClientConfig(defaultServerName)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxVersion != 0 && config.MaxVersion < tls.VersionTLS13 {
+		return nil, fmt.Errorf("quic requires tls 1.3, tlsMax:%s", o.MaxVersion)
+	}
+	return config, nil
+}
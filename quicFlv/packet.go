@@ -0,0 +1,95 @@
+package quicFlv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"quic_demo/flv"
+)
+
+const DatagramFlvAlpn = "flv over quic datagram"
+
+// datagramHeaderLen 每个datagram的头：
+// seq(4) reliableSeq(4) fragIndex(2) fragCount(2) tagType(1) timestamp(4)
+const datagramHeaderLen = 17
+
+// DefaultMaxPayload 每个datagram携带的tag数据上限，quic-go的DATAGRAM帧最大1220字节，
+// 还要留出quic包头、帧头和加密开销
+const DefaultMaxPayload = 1000
+
+// datagramHeader tag分片的头。reliableSeq为发出这个tag之前最后一个走可靠流的tag的序号，
+// 接收端据此判断缺失的序号能否跳过
+type datagramHeader struct {
+	seq         uint32
+	reliableSeq uint32
+	fragIndex   uint16
+	fragCount   uint16
+	tagType     byte
+	timestamp   uint32
+}
+
+func (h *datagramHeader) encode(payload []byte) []byte {
+	buf := make([]byte, datagramHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(buf[0:], h.seq)
+	binary.BigEndian.PutUint32(buf[4:], h.reliableSeq)
+	binary.BigEndian.PutUint16(buf[8:], h.fragIndex)
+	binary.BigEndian.PutUint16(buf[10:], h.fragCount)
+	buf[12] = h.tagType
+	binary.BigEndian.PutUint32(buf[13:], h.timestamp)
+	copy(buf[datagramHeaderLen:], payload)
+	return buf
+}
+
+func decodeDatagram(data []byte) (*datagramHeader, []byte, error) {
+	if len(data) < datagramHeaderLen {
+		return nil, nil, fmt.Errorf("datagram too short, len:%d", len(data))
+	}
+	h := &datagramHeader{
+		seq:         binary.BigEndian.Uint32(data[0:]),
+		reliableSeq: binary.BigEndian.Uint32(data[4:]),
+		fragIndex:   binary.BigEndian.Uint16(data[8:]),
+		fragCount:   binary.BigEndian.Uint16(data[10:]),
+		tagType:     data[12],
+		timestamp:   binary.BigEndian.Uint32(data[13:]),
+	}
+	if h.fragCount == 0 || h.fragIndex >= h.fragCount {
+		return nil, nil, fmt.Errorf("invalid fragment, index:%d, count:%d", h.fragIndex, h.fragCount)
+	}
+	return h, data[datagramHeaderLen:], nil
+}
+
+// writeReliable 在控制流或单向流上写一个tag：seq(4)后面跟一个完整的flv tag
+func writeReliable(writer io.Writer, seq uint32, tag *flv.TagInfo) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, seq)
+	if _, err := writer.Write(buf); err != nil {
+		return fmt.Errorf("write seq failed, err:%v", err)
+	}
+	return flv.WriteTag(writer, tag)
+}
+
+// reliableReader 读取writeReliable写入的tag
+type reliableReader struct {
+	reader   *bufio.Reader
+	flvParse *flv.FlvParse
+}
+
+func newReliableReader(reader *bufio.Reader) *reliableReader {
+	return &reliableReader{
+		reader:   reader,
+		flvParse: &flv.FlvParse{Reader: reader},
+	}
+}
+
+func (r *reliableReader) read() (uint32, *flv.TagInfo, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		return 0, nil, err
+	}
+	tag, err := r.flvParse.ReadTag()
+	if err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(buf), tag, nil
+}
@@ -0,0 +1,105 @@
+package quicFlv
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"quic_demo/flv"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  datagramHeader
+		payload []byte
+	}{
+		{"single", datagramHeader{seq: 1, reliableSeq: 0, fragIndex: 0, fragCount: 1, tagType: flv.VIDEO_TAG, timestamp: 40}, []byte{0x17, 1, 0, 0, 0}},
+		{"last fragment", datagramHeader{seq: 7, reliableSeq: 5, fragIndex: 2, fragCount: 3, tagType: flv.AUDIO_TAG, timestamp: 1000}, []byte{0xaf, 1}},
+		{"empty payload", datagramHeader{seq: 2, reliableSeq: 2, fragIndex: 0, fragCount: 1, tagType: flv.SCRIPT_DATA_TAG}, []byte{}},
+		{"max values", datagramHeader{seq: 0xffffffff, reliableSeq: 0xfffffffe, fragIndex: 0xfffe, fragCount: 0xffff, tagType: 0xff, timestamp: 0xffffffff}, bytes.Repeat([]byte{0xab}, DefaultMaxPayload)},
+	}
+	for _, test := range tests {
+		data := test.header.encode(test.payload)
+		if len(data) != datagramHeaderLen+len(test.payload) {
+			t.Errorf("%s: encoded length:%d", test.name, len(data))
+			continue
+		}
+		h, payload, err := decodeDatagram(data)
+		if err != nil {
+			t.Errorf("%s: decode failed, err:%v", test.name, err)
+			continue
+		}
+		if *h != test.header {
+			t.Errorf("%s: header:%+v, want:%+v", test.name, *h, test.header)
+		}
+		if !bytes.Equal(payload, test.payload) {
+			t.Errorf("%s: payload:%x, want:%x", test.name, payload, test.payload)
+		}
+	}
+}
+
+func TestDecodeDatagramInvalid(t *testing.T) {
+	valid := (&datagramHeader{seq: 1, fragIndex: 0, fragCount: 1, tagType: flv.VIDEO_TAG}).encode(nil)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", valid[:datagramHeaderLen-1]},
+		{"zero fragment count", (&datagramHeader{fragIndex: 0, fragCount: 0}).encode([]byte{1})},
+		{"index equals count", (&datagramHeader{fragIndex: 2, fragCount: 2}).encode([]byte{1})},
+		{"index beyond count", (&datagramHeader{fragIndex: 0xffff, fragCount: 1}).encode([]byte{1})},
+	}
+	for _, test := range tests {
+		if h, _, err := decodeDatagram(test.data); err == nil {
+			t.Errorf("%s: decode should fail, header:%+v", test.name, *h)
+		}
+	}
+}
+
+func TestReliableRoundTrip(t *testing.T) {
+	tags := []struct {
+		seq uint32
+		tag *flv.TagInfo
+	}{
+		{0, &flv.TagInfo{TagType: flv.SCRIPT_DATA_TAG, Body: []byte{2, 0, 0}}},
+		{1, &flv.TagInfo{TagType: flv.VIDEO_TAG, Timestamp: 40, Body: []byte{0x17, 1, 0, 0, 0, 0x65}}},
+		{0xffffffff, &flv.TagInfo{TagType: flv.AUDIO_TAG, Timestamp: 0x01020304, Body: []byte{0xaf, 1, 0x21}}},
+	}
+	buf := &bytes.Buffer{}
+	for _, tag := range tags {
+		if err := writeReliable(buf, tag.seq, tag.tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := newReliableReader(bufio.NewReader(buf))
+	for _, want := range tags {
+		seq, tag, err := reader.read()
+		if err != nil {
+			t.Fatalf("read failed, err:%v", err)
+		}
+		if seq != want.seq || tag.TagType != want.tag.TagType || tag.Timestamp != want.tag.Timestamp || !reflect.DeepEqual(tag.Body, want.tag.Body) {
+			t.Errorf("seq:%d tag:%+v, want seq:%d tag:%+v", seq, *tag, want.seq, *want.tag)
+		}
+	}
+	if _, _, err := reader.read(); err != io.EOF {
+		t.Errorf("read after the last tag, err:%v, want EOF", err)
+	}
+}
+
+func TestReliableTruncated(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeReliable(buf, 3, &flv.TagInfo{TagType: flv.VIDEO_TAG, Body: []byte{0x27, 1, 0, 0, 0}}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for i := 1; i < len(data); i++ {
+		reader := newReliableReader(bufio.NewReader(bytes.NewReader(data[:i])))
+		if _, _, err := reader.read(); err == nil {
+			t.Errorf("read of %d/%d bytes should fail", i, len(data))
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package quicFlv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"log"
+	"quic_demo/flv"
+	"quic_demo/quicConn"
+	"quic_demo/rtmpServer"
+	"sync"
+	"time"
+)
+
+// ReceiverStats 接收端统计
+type ReceiverStats struct {
+	Tags          int64 // 按序输出的tag数
+	ReliableTags  int64 // 从控制流收到的tag数
+	Datagrams     int64
+	Streams       int64 // 按GOP或按帧分流时收到的单向流数
+	Canceled      int64 // 收到更新的关键帧后取消的旧流数
+	Lost          int64 // 等待超过MaxDelay后跳过的序号数
+	LateFragments int64 // 序号已被跳过或已输出后才到达的分片，分流时为tag
+	Discarded     int64 // 丢帧后等待下一个关键帧期间丢弃的视频tag
+	Bytes         int64
+}
+
+func (s ReceiverStats) String() string {
+	return fmt.Sprintf("tags:%d, reliable:%d, datagrams:%d, streams:%d, canceled:%d, lost:%d, late fragments:%d, discarded:%d, bytes:%d",
+		s.Tags, s.ReliableTags, s.Datagrams, s.Streams, s.Canceled, s.Lost, s.LateFragments, s.Discarded, s.Bytes)
+}
+
+// Receiver 从datagram(或按GOP、按帧的单向流)和控制流接收tag，按序号输出到Tags。
+// 缺失的序号等待MaxDelay后跳过，之后到达的分片直接丢弃；丢失视频帧后丢弃视频直到下一个关键帧。
+// 分流时输出新GOP的关键帧后取消还没收完的旧GOP的流
+type Receiver struct {
+	// Tags 按序输出的tag，session或可靠流结束时被关闭
+	Tags chan *flv.TagInfo
+
+	maxDelay  time.Duration
+	datagrams chan datagram
+	reliables chan reliableTag
+	streams   chan streamEvent
+	closed    chan struct{}
+
+	lock  sync.Mutex
+	stats ReceiverStats
+	err   error
+}
+
+type datagram struct {
+	header  *datagramHeader
+	payload []byte
+}
+
+type reliableTag struct {
+	seq     uint32
+	tag     *flv.TagInfo
+	gop     uint32
+	control bool // 是否来自控制流
+}
+
+// streamEvent 单向流开始或结束
+type streamEvent struct {
+	stream      quic.ReceiveStream
+	gop         uint32
+	reliableSeq uint32
+	done        bool
+}
+
+type pendingTag struct {
+	tag *flv.TagInfo
+	gop uint32
+}
+
+// reassembly 一个tag正在重组的分片
+type reassembly struct {
+	tagType   byte
+	timestamp uint32
+	parts     [][]byte
+	received  int
+}
+
+func newReceiver(maxDelay time.Duration) *Receiver {
+	return &Receiver{
+		Tags:      make(chan *flv.TagInfo, 1024),
+		maxDelay:  maxDelay,
+		datagrams: make(chan datagram, 256),
+		reliables: make(chan reliableTag, 16),
+		streams:   make(chan streamEvent, 16),
+		closed:    make(chan struct{}),
+	}
+}
+
+// NewReceiver stream为控制流，datagram从session上接收，maxDelay为缺失序号的最长等待时间
+func NewReceiver(session quic.Session, stream *bufio.Reader, maxDelay time.Duration) *Receiver {
+	r := newReceiver(maxDelay)
+	go r.readDatagrams(session)
+	go r.readReliable(newReliableReader(stream))
+	go r.run()
+	return r
+}
+
+// NewStreamReceiver 接收StreamSender按GOP或按帧打开的单向流，stream为控制流
+func NewStreamReceiver(session quic.Session, stream *bufio.Reader, maxDelay time.Duration) *Receiver {
+	r := newReceiver(maxDelay)
+	go r.acceptStreams(session)
+	go r.readReliable(newReliableReader(stream))
+	go r.run()
+	return r
+}
+
+func (r *Receiver) Stats() ReceiverStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stats
+}
+
+// Err Tags关闭之后返回结束原因
+func (r *Receiver) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *Receiver) finish(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil {
+		r.err = err
+		close(r.closed)
+	}
+}
+
+func (r *Receiver) readDatagrams(session quic.Session) {
+	for {
+		data, err := session.ReceiveMessage()
+		if err != nil {
+			r.finish(fmt.Errorf("quicSession.ReceiveMessage failed, err:%v", err))
+			return
+		}
+		header, payload, err := decodeDatagram(data)
+		if err != nil {
+			log.Printf("decodeDatagram failed, err:%v", err)
+			continue
+		}
+		select {
+		case r.datagrams <- datagram{header: header, payload: payload}:
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+func (r *Receiver) readReliable(reader *reliableReader) {
+	for {
+		seq, tag, err := reader.read()
+		if err != nil {
+			r.finish(fmt.Errorf("read reliable tag failed, err:%v", err))
+			return
+		}
+		select {
+		case r.reliables <- reliableTag{seq: seq, tag: tag, control: true}:
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// acceptStreams session关闭时控制流也会读失败，这里直接返回
+func (r *Receiver) acceptStreams(session quic.Session) {
+	for {
+		stream, err := session.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go r.readStream(stream)
+	}
+}
+
+// readStream 单向流以gop(4)和reliableSeq(4)开头，后面是writeReliable写入的tag
+func (r *Receiver) readStream(stream quic.ReceiveStream) {
+	reader := bufio.NewReader(stream)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	event := streamEvent{
+		stream:      stream,
+		gop:         binary.BigEndian.Uint32(header),
+		reliableSeq: binary.BigEndian.Uint32(header[4:]),
+	}
+	select {
+	case r.streams <- event:
+	case <-r.closed:
+		return
+	}
+	defer func() {
+		event.done = true
+		select {
+		case r.streams <- event:
+		case <-r.closed:
+		}
+	}()
+
+	tags := newReliableReader(reader)
+	for {
+		seq, tag, err := tags.read()
+		if err != nil {
+			return
+		}
+		select {
+		case r.reliables <- reliableTag{seq: seq, tag: tag, gop: event.gop}:
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+func (r *Receiver) run() {
+	defer close(r.Tags)
+
+	interval := r.maxDelay / 4
+	if interval < 5*time.Millisecond {
+		interval = 5 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		next              = uint32(1) // 下一个要输出的序号
+		maxSeen           uint32
+		reliableReceived  uint32 // 控制流上收到的最大序号，控制流有序，小于它的控制tag都已收到
+		reliableAnnounced uint32 // datagram或单向流中带的最大reliableSeq
+		waitSince         time.Time
+		waitKeyframe      bool
+		currentGop        uint32
+		pending           = make(map[uint32]pendingTag)
+		fragments         = make(map[uint32]*reassembly)
+		streams           = make(map[quic.ReceiveStream]uint32)
+	)
+
+	// cancelStale 取消比currentGop旧的流，已经排队的数据不再需要
+	cancelStale := func() {
+		for stream, gop := range streams {
+			if gop < currentGop {
+				stream.CancelRead(quicConn.CodeCanceled)
+				delete(streams, stream)
+				r.lock.Lock()
+				r.stats.Canceled++
+				r.lock.Unlock()
+			}
+		}
+	}
+
+	output := func(p pendingTag) bool {
+		tag := p.tag
+		if rtmpServer.IsKeyFrame(tag) {
+			gop := p.gop
+			if gop == 0 {
+				// datagram和控制流上的tag不带GOP，按关键帧计数
+				gop = currentGop + 1
+			}
+			if gop > currentGop {
+				currentGop = gop
+				cancelStale()
+			}
+		}
+		if waitKeyframe && tag.TagType == flv.VIDEO_TAG && !rtmpServer.IsSequenceHeader(tag) {
+			if !rtmpServer.IsKeyFrame(tag) {
+				r.lock.Lock()
+				r.stats.Discarded++
+				r.lock.Unlock()
+				return true
+			}
+			waitKeyframe = false
+		}
+		select {
+		case r.Tags <- tag:
+		case <-r.closed:
+			return false
+		}
+		r.lock.Lock()
+		r.stats.Tags++
+		r.stats.Bytes += int64(len(tag.Body))
+		r.lock.Unlock()
+		return true
+	}
+
+	// canSkip 缺失的序号不会是还在可靠流上传输的tag
+	canSkip := func(seq uint32) bool {
+		return seq <= reliableReceived || seq > reliableAnnounced
+	}
+
+	flush := func(now time.Time) bool {
+		for {
+			if p, ok := pending[next]; ok {
+				delete(pending, next)
+				next++
+				waitSince = time.Time{}
+				if !output(p) {
+					return false
+				}
+				continue
+			}
+			if maxSeen < next {
+				return true
+			}
+			// 后面的tag已经到了，当前序号缺失，从第一次发现缺失开始计时。
+			// 连续跳过多个序号时不重新计时，避免等待时间累加
+			if waitSince.IsZero() {
+				waitSince = now
+			}
+			if now.Sub(waitSince) < r.maxDelay || !canSkip(next) {
+				return true
+			}
+			// 不知道丢的是什么tag时也按视频处理
+			if f, ok := fragments[next]; !ok || f.tagType == flv.VIDEO_TAG {
+				waitKeyframe = true
+			}
+			delete(fragments, next)
+			next++
+			r.lock.Lock()
+			r.stats.Lost++
+			r.lock.Unlock()
+		}
+	}
+
+	for {
+		select {
+		case d := <-r.datagrams:
+			h := d.header
+			r.lock.Lock()
+			r.stats.Datagrams++
+			if h.seq < next {
+				r.stats.LateFragments++
+			}
+			r.lock.Unlock()
+			if h.reliableSeq > reliableAnnounced {
+				reliableAnnounced = h.reliableSeq
+			}
+			if h.seq < next {
+				break
+			}
+			if h.seq > maxSeen {
+				maxSeen = h.seq
+			}
+			// 已经重组完成等待输出的tag，重复的分片不再新建重组
+			if _, done := pending[h.seq]; done {
+				break
+			}
+			f, ok := fragments[h.seq]
+			if !ok {
+				f = &reassembly{
+					tagType:   h.tagType,
+					timestamp: h.timestamp,
+					parts:     make([][]byte, h.fragCount),
+				}
+				fragments[h.seq] = f
+			}
+			if int(h.fragIndex) >= len(f.parts) || f.parts[h.fragIndex] != nil {
+				break
+			}
+			f.parts[h.fragIndex] = d.payload
+			f.received++
+			if f.received < len(f.parts) {
+				break
+			}
+			delete(fragments, h.seq)
+			body := make([]byte, 0, len(f.parts)*len(f.parts[0]))
+			for _, part := range f.parts {
+				body = append(body, part...)
+			}
+			pending[h.seq] = pendingTag{tag: &flv.TagInfo{
+				TagType:   f.tagType,
+				DataSize:  uint32(len(body)),
+				Timestamp: f.timestamp,
+				Body:      body,
+			}}
+		case t := <-r.reliables:
+			r.lock.Lock()
+			if t.control {
+				r.stats.ReliableTags++
+			} else if t.seq < next {
+				r.stats.LateFragments++
+			}
+			r.lock.Unlock()
+			if t.control {
+				reliableReceived = t.seq
+			}
+			if t.seq > maxSeen {
+				maxSeen = t.seq
+			}
+			if t.seq >= next {
+				pending[t.seq] = pendingTag{tag: t.tag, gop: t.gop}
+			}
+		case e := <-r.streams:
+			if e.done {
+				delete(streams, e.stream)
+				break
+			}
+			r.lock.Lock()
+			r.stats.Streams++
+			r.lock.Unlock()
+			if e.reliableSeq > reliableAnnounced {
+				reliableAnnounced = e.reliableSeq
+			}
+			streams[e.stream] = e.gop
+			cancelStale()
+		case <-ticker.C:
+		case <-r.closed:
+			return
+		}
+		if !flush(time.Now()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package quicFlv
+
+import (
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"quic_demo/flv"
+	"quic_demo/rtmpServer"
+	"sync"
+)
+
+// TagSender Sender和StreamSender的公共接口
+type TagSender interface {
+	WriteTag(tag *flv.TagInfo) error
+	Stats() SenderStats
+	// Close 关闭控制流
+	Close() error
+}
+
+// SenderStats 发送端统计
+type SenderStats struct {
+	Tags         int64
+	ReliableTags int64 // 走控制流的tag数
+	Datagrams    int64
+	Streams      int64 // 按GOP或按帧打开的单向流数
+	Canceled     int64 // 被对端取消或写失败的单向流数
+	Bytes        int64
+}
+
+func (s SenderStats) String() string {
+	return fmt.Sprintf("tags:%d, reliable:%d, datagrams:%d, streams:%d, canceled:%d, bytes:%d",
+		s.Tags, s.ReliableTags, s.Datagrams, s.Streams, s.Canceled, s.Bytes)
+}
+
+// Sender 把flv tag按序号分片后用quic datagram发出，metadata、sequence header和关键帧走可靠流
+type Sender struct {
+	// MaxPayload 每个datagram携带的tag数据上限
+	MaxPayload int
+	// ReliableKeyframes 关键帧是否走可靠流，false时只有metadata和sequence header走可靠流
+	ReliableKeyframes bool
+
+	session quic.Session
+	stream  io.Writer
+
+	lock        sync.Mutex
+	seq         uint32
+	reliableSeq uint32
+	stats       SenderStats
+}
+
+// NewSender stream为可靠流，datagram在session上发送，session需要协商支持datagram
+func NewSender(session quic.Session, stream io.Writer) *Sender {
+	return &Sender{
+		MaxPayload:        DefaultMaxPayload,
+		ReliableKeyframes: true,
+		session:           session,
+		stream:            stream,
+	}
+}
+
+func (s *Sender) reliable(tag *flv.TagInfo) bool {
+	if tag.TagType == flv.SCRIPT_DATA_TAG || rtmpServer.IsSequenceHeader(tag) {
+		return true
+	}
+	return s.ReliableKeyframes && rtmpServer.IsKeyFrame(tag)
+}
+
+// WriteTag 发送一个tag，序号从1开始递增
+func (s *Sender) WriteTag(tag *flv.TagInfo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	s.stats.Tags++
+	s.stats.Bytes += int64(len(tag.Body))
+
+	fragCount := (len(tag.Body) + s.MaxPayload - 1) / s.MaxPayload
+	if fragCount == 0 {
+		fragCount = 1
+	}
+	if s.reliable(tag) || fragCount > 0xffff {
+		if err := writeReliable(s.stream, s.seq, tag); err != nil {
+			return err
+		}
+		s.reliableSeq = s.seq
+		s.stats.ReliableTags++
+		return nil
+	}
+
+	header := datagramHeader{
+		seq:         s.seq,
+		reliableSeq: s.reliableSeq,
+		fragCount:   uint16(fragCount),
+		tagType:     tag.TagType,
+		timestamp:   tag.Timestamp,
+	}
+	for i := 0; i < fragCount; i++ {
+		end := (i + 1) * s.MaxPayload
+		if end > len(tag.Body) {
+			end = len(tag.Body)
+		}
+		header.fragIndex = uint16(i)
+		if err := s.session.SendMessage(header.encode(tag.Body[i*s.MaxPayload : end])); err != nil {
+			return fmt.Errorf("quicSession.SendMessage failed, err:%v", err)
+		}
+		s.stats.Datagrams++
+	}
+	return nil
+}
+
+func (s *Sender) Close() error {
+	if closer, ok := s.stream.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *Sender) Stats() SenderStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
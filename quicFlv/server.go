@@ -0,0 +1,234 @@
+package quicFlv
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"log"
+	"quic_demo/quicConn"
+	"quic_demo/rtmpServer"
+	"strings"
+	"time"
+)
+
+// 每个session只有一条双向流：客户端先发一行"play app/stream mode"或"publish app/stream mode"，
+// 服务端回"ok"或"error 原因"，之后这条流作为控制流，其余tag按mode通过datagram或单向流发送
+
+// 媒体映射方式
+const (
+	ModeDatagram = "datagram" // tag分片后走datagram
+	ModeGop      = "gop"      // 每个GOP一条单向流
+	ModeFrame    = "frame"    // 每个tag一条单向流
+)
+
+// maxUniStreams 按帧分流时每个tag一条流，对端允许的单向流数需要足够大
+const maxUniStreams = 1000
+
+// ParseMode 检查mode是否有效，空串为datagram
+func ParseMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ModeDatagram, nil
+	case ModeDatagram, ModeGop, ModeFrame:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown mode:%s", mode)
+}
+
+// QuicConfig 返回开启datagram并放宽单向流数的配置
+func QuicConfig(quicConfig *quic.Config) *quic.Config {
+	if quicConfig == nil {
+		quicConfig = &quic.Config{}
+	}
+	quicConfig = quicConfig.Clone()
+	quicConfig.EnableDatagrams = true
+	if quicConfig.MaxIncomingUniStreams < maxUniStreams {
+		quicConfig.MaxIncomingUniStreams = maxUniStreams
+	}
+	return quicConfig
+}
+
+// Server 以datagram或单向流收发直播流，流来自(或推到)进程内的rtmp服务器，
+// 可以和rtmp、http-flv共用同一路流
+type Server struct {
+	Rtmp              *rtmpServer.Server
+	MaxPayload        int
+	ReliableKeyframes bool
+	MaxDelay          time.Duration
+}
+
+func NewServer(rtmp *rtmpServer.Server) *Server {
+	return &Server{
+		Rtmp:              rtmp,
+		MaxPayload:        DefaultMaxPayload,
+		ReliableKeyframes: true,
+		MaxDelay:          150 * time.Millisecond,
+	}
+}
+
+// Listen 监听quic，alpn为"flv over quic datagram"，开启datagram支持
+func Listen(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlyListener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{DatagramFlvAlpn}
+	listener, err := quic.ListenAddrEarly(addr, tlsConfig, QuicConfig(quicConfig))
+	if err != nil {
+		return nil, fmt.Errorf("quic.ListenAddrEarly failed, addr:%s, err:%v", addr, err)
+	}
+	return listener, nil
+}
+
+func (s *Server) ListenAndServe(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) error {
+	listener, err := Listen(addr, tlsConfig, quicConfig)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve 循环accept，直到listener被关闭
+func (s *Server) Serve(listener quic.EarlyListener) error {
+	defer listener.Close()
+	for {
+		session, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go s.serveSession(session)
+	}
+}
+
+func (s *Server) serveSession(session quic.Session) {
+	stream, err := session.AcceptStream(session.Context())
+	if err != nil {
+		return
+	}
+	conn := quicConn.NewQuicStreamConn(session, stream)
+	defer session.CloseWithError(quicConn.CodeNoError, "")
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		log.Printf("read request failed, remote:%v, err:%v", session.RemoteAddr(), err)
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		fmt.Fprintf(conn, "error bad request\n")
+		return
+	}
+	method, key := fields[0], fields[1]
+	mode := ModeDatagram
+	if len(fields) == 3 {
+		if mode, err = ParseMode(fields[2]); err != nil {
+			fmt.Fprintf(conn, "error %v\n", err)
+			return
+		}
+	}
+	if mode == ModeDatagram && !session.ConnectionState().SupportsDatagrams {
+		fmt.Fprintf(conn, "error datagram not supported\n")
+		return
+	}
+	log.Printf("quic flv %s, remote:%v, key:%s, mode:%s", method, session.RemoteAddr(), key, mode)
+
+	switch method {
+	case "publish":
+		publisher, err := s.Rtmp.Publish(key)
+		if err != nil {
+			fmt.Fprintf(conn, "error %v\n", err)
+			return
+		}
+		defer publisher.Close()
+		fmt.Fprintf(conn, "ok\n")
+		receiver := newModeReceiver(session, reader, mode, s.MaxDelay)
+		for tag := range receiver.Tags {
+			publisher.WriteTag(tag)
+		}
+		log.Printf("quic flv publish end, remote:%v, key:%s, %v, err:%v", session.RemoteAddr(), key, receiver.Stats(), receiver.Err())
+	case "play":
+		subscriber := s.Rtmp.Subscribe(key)
+		defer subscriber.Close()
+		fmt.Fprintf(conn, "ok\n")
+		go func() {
+			<-session.Context().Done()
+			subscriber.Close()
+		}()
+		var sender TagSender
+		if mode == ModeDatagram {
+			datagramSender := NewSender(session, conn)
+			datagramSender.MaxPayload = s.MaxPayload
+			datagramSender.ReliableKeyframes = s.ReliableKeyframes
+			sender = datagramSender
+		} else {
+			streamSender := NewStreamSender(session, conn)
+			streamSender.PerFrame = mode == ModeFrame
+			sender = streamSender
+		}
+		for tag := range subscriber.Tags {
+			if err = sender.WriteTag(tag); err != nil {
+				break
+			}
+		}
+		sender.Close()
+		log.Printf("quic flv play end, remote:%v, key:%s, %v, err:%v", session.RemoteAddr(), key, sender.Stats(), err)
+	default:
+		fmt.Fprintf(conn, "error unknown method:%s\n", method)
+	}
+}
+
+func newModeReceiver(session quic.Session, reader *bufio.Reader, mode string, maxDelay time.Duration) *Receiver {
+	if mode == ModeDatagram {
+		return NewReceiver(session, reader, maxDelay)
+	}
+	return NewStreamReceiver(session, reader, maxDelay)
+}
+
+// request 在session上打开流并发送请求，返回控制流
+func request(session quic.Session, method string, key string, mode string) (io.WriteCloser, *bufio.Reader, error) {
+	stream, err := session.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("quicSession.OpenStreamSync failed, err:%v", err)
+	}
+	conn := quicConn.NewQuicStreamConn(session, stream)
+	if _, err := fmt.Fprintf(conn, "%s %s %s\n", method, key, mode); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("write request failed, err:%v", err)
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("read response failed, err:%v", err)
+	}
+	if line = strings.TrimSpace(line); line != "ok" {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%s failed, response:%s", method, line)
+	}
+	return conn, reader, nil
+}
+
+// Play 请求以mode播放key，datagram模式需要session开启datagram
+func Play(session quic.Session, key string, mode string, maxDelay time.Duration) (*Receiver, error) {
+	_, reader, err := request(session, "play", key, mode)
+	if err != nil {
+		return nil, err
+	}
+	return newModeReceiver(session, reader, mode, maxDelay), nil
+}
+
+// Publish 请求以mode推流到key，推流结束后调用TagSender.Close
+func Publish(session quic.Session, key string, mode string) (TagSender, error) {
+	conn, _, err := request(session, "publish", key, mode)
+	if err != nil {
+		return nil, err
+	}
+	if mode == ModeDatagram {
+		return NewSender(session, conn), nil
+	}
+	sender := NewStreamSender(session, conn)
+	sender.PerFrame = mode == ModeFrame
+	return sender, nil
+}
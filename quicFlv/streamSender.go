@@ -0,0 +1,143 @@
+package quicFlv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"quic_demo/flv"
+	"quic_demo/quicConn"
+	"quic_demo/rtmpServer"
+	"sync"
+)
+
+// maxQueuedTags 每条单向流排队的tag上限，满了之后WriteTag阻塞
+const maxQueuedTags = 4096
+
+// StreamSender 每个GOP(PerFrame时每个tag)打开一条单向流，metadata和sequence header走控制流。
+// 每条流由单独的协程写，旧GOP的流被阻塞时不影响新GOP，接收端收到新关键帧后取消旧流
+type StreamSender struct {
+	// PerFrame 每个tag一条流。quic-go没有流优先级接口，各流按打开顺序调度，
+	// 旧帧让出带宽依赖接收端取消
+	PerFrame bool
+
+	session quic.Session
+	control io.Writer
+
+	lock        sync.Mutex
+	seq         uint32
+	reliableSeq uint32
+	gop         uint32
+	current     *streamWriter
+	writers     sync.WaitGroup
+	stats       SenderStats
+}
+
+// streamWriter 一条单向流和它的发送队列
+type streamWriter struct {
+	tags chan reliableTag
+}
+
+func NewStreamSender(session quic.Session, control io.Writer) *StreamSender {
+	return &StreamSender{
+		session: session,
+		control: control,
+	}
+}
+
+// WriteTag 发送一个tag，序号从1开始递增。第一个关键帧之前的音频在GOP 0的流上
+func (s *StreamSender) WriteTag(tag *flv.TagInfo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	s.stats.Tags++
+	s.stats.Bytes += int64(len(tag.Body))
+
+	if tag.TagType == flv.SCRIPT_DATA_TAG || rtmpServer.IsSequenceHeader(tag) {
+		if err := writeReliable(s.control, s.seq, tag); err != nil {
+			return err
+		}
+		s.reliableSeq = s.seq
+		s.stats.ReliableTags++
+		return nil
+	}
+
+	if rtmpServer.IsKeyFrame(tag) {
+		s.gop++
+		s.finishCurrent()
+	}
+	if s.current == nil {
+		s.current = s.openWriter()
+	}
+	s.current.tags <- reliableTag{seq: s.seq, tag: tag}
+	if s.PerFrame {
+		s.finishCurrent()
+	}
+	return nil
+}
+
+func (s *StreamSender) finishCurrent() {
+	if s.current != nil {
+		close(s.current.tags)
+		s.current = nil
+	}
+}
+
+// openWriter 打开流在写协程里进行，达到对端流数上限时不阻塞WriteTag
+func (s *StreamSender) openWriter() *streamWriter {
+	w := &streamWriter{tags: make(chan reliableTag, maxQueuedTags)}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, s.gop)
+	binary.BigEndian.PutUint32(header[4:], s.reliableSeq)
+	s.stats.Streams++
+	s.writers.Add(1)
+	go func() {
+		defer s.writers.Done()
+		err := s.writeStream(header, w.tags)
+		// 取消或失败后丢掉队列里剩下的tag
+		for range w.tags {
+		}
+		if err != nil {
+			s.lock.Lock()
+			s.stats.Canceled++
+			s.lock.Unlock()
+		}
+	}()
+	return w
+}
+
+func (s *StreamSender) writeStream(header []byte, tags <-chan reliableTag) error {
+	stream, err := s.session.OpenUniStreamSync(s.session.Context())
+	if err != nil {
+		return fmt.Errorf("quicSession.OpenUniStreamSync failed, err:%v", err)
+	}
+	if _, err := stream.Write(header); err != nil {
+		stream.CancelWrite(quicConn.CodeCanceled)
+		return err
+	}
+	for t := range tags {
+		if err := writeReliable(stream, t.seq, t.tag); err != nil {
+			stream.CancelWrite(quicConn.CodeCanceled)
+			return err
+		}
+	}
+	return stream.Close()
+}
+
+// Close 结束当前流，等所有流写完后关闭控制流
+func (s *StreamSender) Close() error {
+	s.lock.Lock()
+	s.finishCurrent()
+	s.lock.Unlock()
+	s.writers.Wait()
+	if closer, ok := s.control.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *StreamSender) Stats() SenderStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
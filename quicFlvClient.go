@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"quic_demo/analytics"
+	"quic_demo/flv"
+	"quic_demo/httpFlv"
+	"quic_demo/quicConn"
+	"quic_demo/quicFlv"
+	"quic_demo/resolver"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+
+	var streamUrl string
+	var port int
+	var mode string
+	var transport string
+	var fileName string
+	var loop bool
+	var outFile string
+	var versions string
+	var maxDelay time.Duration
+	var maxPayload int
+	var reliableKeyframes bool
+	var statsInterval int
+	flag.StringVar(&streamUrl, "url", "", "stream url, https://domain/live/stream")
+	flag.IntVar(&port, "port", 443, "server port, default 443")
+	flag.StringVar(&mode, "mode", "play", "play or publish")
+	flag.StringVar(&transport, "transport", quicFlv.ModeDatagram, "media mapping, datagram, gop (a uni stream per gop) or frame (a uni stream per tag)")
+	flag.StringVar(&fileName, "fileName", "", "flv file to publish")
+	flag.BoolVar(&loop, "loop", false, "publish the file in a loop")
+	flag.StringVar(&outFile, "outFile", "", "write the played stream into this flv file, empty to disable")
+	flag.StringVar(&versions, "versions", "v1", "quic versions, v1,draft29, the first is used for the initial packet")
+	flag.DurationVar(&maxDelay, "maxDelay", 150*time.Millisecond, "how long the player waits for a missing tag before skipping it")
+	flag.IntVar(&maxPayload, "maxPayload", quicFlv.DefaultMaxPayload, "max tag bytes per datagram when publishing in datagram mode")
+	flag.BoolVar(&reliableKeyframes, "reliableKeyframes", true, "send keyframes on the control stream when publishing in datagram mode")
+	flag.IntVar(&statsInterval, "statsInterval", 5, "stats interval in seconds, 0 to disable")
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
+	flag.Parse()
+	if streamUrl == "" || (mode != "play" && mode != "publish") || (mode == "publish" && fileName == "") {
+		log.Fatalln("url == \"\" || (mode != \"play\" && mode != \"publish\") || (mode == \"publish\" && fileName == \"\")")
+	}
+
+	url2, err := url.Parse(streamUrl)
+	if err != nil {
+		log.Fatalf("url.Parse failed, err:%v", err)
+	}
+	if transport, err = quicFlv.ParseMode(transport); err != nil {
+		log.Fatalf("quicFlv.ParseMode err:%v", err)
+	}
+	key := strings.TrimSuffix(strings.TrimPrefix(url2.Path, "/"), ".flv")
+	if url2.Port() != "" {
+		if port, err = strconv.Atoi(url2.Port()); err != nil {
+			log.Fatalf("strconv.Atoi failed, port:%s, err:%v", url2.Port(), err)
+		}
+	}
+
+	domain := url2.Hostname()
+	addrs, err := addrOptions.Lookup(domain)
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	quicVersions, err := quicConn.ParseVersions(versions)
+	if err != nil {
+		log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+	}
+	tlsConfig, err := tlsOptions.QuicClientConfig(domain)
+	if err != nil {
+		log.Fatalf("tlsOptions.QuicClientConfig err:%v", err)
+	}
+	tlsConfig.NextProtos = []string{quicFlv.DatagramFlvAlpn}
+
+	quicAddr := net.JoinHostPort(addrs.Ips[0], strconv.Itoa(port))
+	quicSession, err := quic.DialAddr(quicAddr, tlsConfig, quicFlv.QuicConfig(&quic.Config{
+		Versions: quicVersions,
+	}))
+	if err != nil {
+		log.Fatalf("quic.DialAddr err:%v", err)
+	}
+	defer quicSession.CloseWithError(quicConn.CodeNoError, "")
+	if transport == quicFlv.ModeDatagram && !quicSession.ConnectionState().SupportsDatagrams {
+		log.Fatalf("server does not support datagram, addr:%s", quicAddr)
+	}
+
+	if mode == "publish" {
+		publish(quicSession, key, transport, fileName, loop, maxPayload, reliableKeyframes, statsInterval)
+	} else {
+		play(quicSession, key, transport, outFile, maxDelay, statsInterval)
+	}
+}
+
+func publish(quicSession quic.Session, key string, transport string, fileName string, loop bool, maxPayload int, reliableKeyframes bool, statsInterval int) {
+	sender, err := quicFlv.Publish(quicSession, key, transport)
+	if err != nil {
+		log.Fatalf("quicFlv.Publish err:%v", err)
+	}
+	defer sender.Close()
+	if datagramSender, ok := sender.(*quicFlv.Sender); ok {
+		datagramSender.MaxPayload = maxPayload
+		datagramSender.ReliableKeyframes = reliableKeyframes
+	}
+
+	// FileSource按时间戳实时读文件
+	source := &httpFlv.FileSource{FileName: fileName, Loop: loop}
+	tags, cancel, err := source.Subscribe(key)
+	if err != nil {
+		log.Fatalf("source.Subscribe err:%v", err)
+	}
+	defer cancel()
+
+	if statsInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(statsInterval) * time.Second) {
+				log.Printf("publish stats, %v", sender.Stats())
+			}
+		}()
+	}
+	for tag := range tags {
+		if err := sender.WriteTag(tag); err != nil {
+			log.Fatalf("sender.WriteTag err:%v", err)
+		}
+	}
+	fmt.Printf("publish end, %v\n", sender.Stats())
+}
+
+func play(quicSession quic.Session, key string, transport string, outFile string, maxDelay time.Duration, statsInterval int) {
+	receiver, err := quicFlv.Play(quicSession, key, transport, maxDelay)
+	if err != nil {
+		log.Fatalf("quicFlv.Play err:%v", err)
+	}
+
+	var file *os.File
+	if outFile != "" {
+		if file, err = os.Create(outFile); err != nil {
+			log.Fatalf("os.Create err:%v", err)
+		}
+		defer file.Close()
+		if err := flv.WriteHeader(file, true, true); err != nil {
+			log.Fatalf("flv.WriteHeader err:%v", err)
+		}
+	}
+
+	if statsInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(statsInterval) * time.Second) {
+				log.Printf("play stats, %v", receiver.Stats())
+			}
+		}()
+	}
+	// 推流端插入了时间标记时输出端到端时延
+	latencyMeter := analytics.NewLatencyMeter()
+	for tag := range receiver.Tags {
+		if file != nil {
+			if err := flv.WriteTag(file, tag); err != nil {
+				log.Fatalf("flv.WriteTag err:%v", err)
+			}
+		}
+		if sample, ok := latencyMeter.Add(tag.TagType, tag.Body); ok {
+			fmt.Printf("latency, %s, pts:%d\n", sample, tag.Timestamp)
+		}
+	}
+	fmt.Printf("play end, %v, err:%v\n", receiver.Stats(), receiver.Err())
+	if stats := latencyMeter.Stats(); stats.Samples > 0 {
+		fmt.Printf("latency ms, %s\n", stats)
+	}
+}
@@ -0,0 +1,136 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"quic_demo/timing"
+)
+
+// Result 一个地址的探测结果
+type Result struct {
+	Ip       string
+	Status   string         // ok/timeout/failed
+	Phases   []timing.Phase // 子进程输出的timing阶段，同名阶段取第一次出现的
+	LastLine string         // 子进程最后一行输出，失败时一般是错误原因
+}
+
+// ProbeAll 每个地址启动一个子进程并发探测，子进程与当前进程的参数相同，只是把-ip换成该地址，
+// 从子进程输出的timing行收集各阶段耗时。到了ProbeTime还没结束的子进程会被杀掉
+func (o *Options) ProbeAll(ips []string) []Result {
+	results := make([]Result, len(ips))
+	wg := sync.WaitGroup{}
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(result *Result, ip string) {
+			defer wg.Done()
+			*result = o.probe(ip)
+		}(&results[i], ip)
+	}
+	wg.Wait()
+	return results
+}
+
+func (o *Options) probe(ip string) Result {
+	result := Result{Ip: ip}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.ProbeTime)*time.Second)
+	defer cancel()
+
+	// 后面的参数覆盖前面的同名参数
+	args := append(append([]string{}, os.Args[1:]...), "-ip="+ip, "-resolveAll=false")
+	cmd := exec.CommandContext(ctx, os.Args[0], args...)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	if err := cmd.Start(); err != nil {
+		result.Status = "failed"
+		result.LastLine = err.Error()
+		return result
+	}
+	go func() {
+		cmd.Wait()
+		writer.Close()
+	}()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		result.LastLine = line
+		report, ok := timing.ParseReport(line)
+		if !ok {
+			continue
+		}
+		for _, phase := range report.Phases {
+			if !seen[phase.Name] {
+				seen[phase.Name] = true
+				result.Phases = append(result.Phases, phase)
+			}
+		}
+	}
+	io.Copy(io.Discard, reader)
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded && len(result.Phases) > 0:
+		// 拉流和推流不会自己结束，到时间后被杀掉是正常的
+		result.Status = "ok"
+	case ctx.Err() == context.DeadlineExceeded:
+		result.Status = "timeout"
+	case cmd.ProcessState != nil && cmd.ProcessState.Success():
+		result.Status = "ok"
+	default:
+		result.Status = "failed"
+	}
+	return result
+}
+
+// PrintResults 按地址输出结果表，每个阶段一列，值为阶段结束时距开始的毫秒数
+func PrintResults(w io.Writer, results []Result) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, result := range results {
+		for _, phase := range result.Phases {
+			if !seen[phase.Name] {
+				seen[phase.Name] = true
+				names = append(names, phase.Name)
+			}
+		}
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "ip\tstatus")
+	for _, name := range names {
+		fmt.Fprintf(table, "\t%s", name)
+	}
+	fmt.Fprintf(table, "\tlast output\n")
+	for _, result := range results {
+		fmt.Fprintf(table, "%s\t%s", result.Ip, result.Status)
+		for _, name := range names {
+			value := "-"
+			for _, phase := range result.Phases {
+				if phase.Name == name {
+					value = fmt.Sprintf("%.1f", phase.EndMs)
+				}
+			}
+			fmt.Fprintf(table, "\t%s", value)
+		}
+		lastLine := result.LastLine
+		if len(lastLine) > 80 {
+			lastLine = lastLine[:80] + "..."
+		}
+		fmt.Fprintf(table, "\t%s\n", lastLine)
+	}
+	table.Flush()
+}
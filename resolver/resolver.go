@@ -0,0 +1,109 @@
+package resolver
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"quic_demo/timing"
+)
+
+// Options 服务端地址相关参数，各个客户端共用
+type Options struct {
+	Ip         string // 逗号分隔的ip列表，为空时解析url中的域名
+	ResolveAll bool   // 探测域名解析出的所有A/AAAA记录
+	IpVersion  string // 4或6，限制解析的地址类型
+	ProbeTime  int    // 多地址时每个地址的探测时长，单位秒
+}
+
+// AddFlags 在flag.CommandLine上注册地址相关参数
+func (o *Options) AddFlags() {
+	flag.StringVar(&o.Ip, "ip", "", "server ip, comma separated to probe several edges, empty to resolve the url host")
+	flag.BoolVar(&o.ResolveAll, "resolveAll", false, "probe every A/AAAA record of the url host concurrently")
+	flag.StringVar(&o.IpVersion, "ipVersion", "", "4 or 6, only resolve addresses of this family")
+	flag.IntVar(&o.ProbeTime, "probeTime", 15, "probe time in seconds of each address when several are probed")
+}
+
+// Addrs 要探测的地址
+type Addrs struct {
+	Ips      []string
+	Resolved bool // 是否做了dns解析
+	DnsStart time.Time
+	DnsEnd   time.Time
+}
+
+// RecordDns 做了dns解析时把耗时写入recorder，dns在recorder创建之前完成，
+// 需要在recorder刚创建时调用，起点提前到dns开始
+func (a *Addrs) RecordDns(recorder *timing.Recorder) {
+	if !a.Resolved || recorder == nil {
+		return
+	}
+	recorder.Begin = a.DnsStart
+	recorder.AddPhase(timing.PhaseDns, a.DnsStart, a.DnsEnd)
+}
+
+func (o *Options) network() (string, error) {
+	switch o.IpVersion {
+	case "":
+		return "ip", nil
+	case "4":
+		return "ip4", nil
+	case "6":
+		return "ip6", nil
+	}
+	return "", fmt.Errorf("unknown ip version:%s", o.IpVersion)
+}
+
+// Lookup 返回要探测的地址。指定了ip时直接使用，否则解析host，
+// 没有设置ResolveAll时只取第一个地址
+func (o *Options) Lookup(host string) (*Addrs, error) {
+	addrs := &Addrs{}
+	if o.Ip != "" {
+		for _, ip := range strings.Split(o.Ip, ",") {
+			ip = strings.Trim(strings.TrimSpace(ip), "[]")
+			if ip != "" {
+				addrs.Ips = append(addrs.Ips, ip)
+			}
+		}
+		return addrs, nil
+	}
+	if host == "" {
+		return nil, fmt.Errorf("no ip and no host to resolve")
+	}
+	if net.ParseIP(host) != nil {
+		addrs.Ips = []string{host}
+		return addrs, nil
+	}
+
+	network, err := o.network()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs.Resolved = true
+	addrs.DnsStart = time.Now()
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	addrs.DnsEnd = time.Now()
+	if err != nil {
+		return nil, fmt.Errorf("resolve host failed, host:%s, err:%v", host, err)
+	}
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		addrs.Ips = append(addrs.Ips, ip.String())
+	}
+	if len(addrs.Ips) == 0 {
+		return nil, fmt.Errorf("no address found, host:%s, network:%s", host, network)
+	}
+	if !o.ResolveAll {
+		addrs.Ips = addrs.Ips[:1]
+	}
+	return addrs, nil
+}
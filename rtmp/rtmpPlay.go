@@ -9,6 +9,7 @@ import (
 
 	"github.com/zhangpeihao/goflv"
 	rtmp "github.com/zhangpeihao/gortmp"
+	"quic_demo/timing"
 )
 
 type RtmpPlay struct {
@@ -19,7 +20,15 @@ type RtmpPlay struct {
 	TcUrl            string
 	StreamName       string
 	FlvFile          *flv.File
+	DurationMs       int64 // 播放时长
 	ErrorMessageChan chan string
+
+	mediaCounter
+	StatsIntervalMs int64            // 统计打印间隔，0为不打印
+	ExtraStats      func() string    // 追加在统计后面的传输层信息
+	Timing          *timing.Recorder // 记录rtmp各阶段耗时，可以为nil
+	// OnTag 每收到一个音视频或数据tag时调用，可以为nil
+	OnTag func(tagType uint8, timestamp uint32, body []byte)
 }
 
 func NewRtmpPlay(conn net.Conn, flvFileName string, tcUrl string, streamName string,
@@ -29,32 +38,52 @@ func NewRtmpPlay(conn net.Conn, flvFileName string, tcUrl string, streamName str
 		FlvFileName: flvFileName,
 		TcUrl:       tcUrl,
 		StreamName:  streamName,
+		DurationMs:  1000 * 60 * 60 * 24 * 365 * 100,
+		// 带缓冲，避免读协程在PlayData退出后阻塞
+		ErrorMessageChan: make(chan string, 1),
+		StatsIntervalMs:  5000,
 	}
 }
 
 func (r *RtmpPlay) OnStatus(conn rtmp.OutboundConn) {
 	status, err := conn.Status()
 	log.Printf("Handler On Status, status:%v, err:%v", status, err)
+	switch status {
+	case rtmp.OUTBOUND_CONN_STATUS_CONNECT_OK:
+		r.Timing.End(timing.PhaseRtmpConnect)
+		r.Timing.Start(timing.PhaseCreateStream)
+	case rtmp.OUTBOUND_CONN_STATUS_CREATE_STREAM_OK:
+		r.Timing.End(timing.PhaseCreateStream)
+	}
 }
 
 func (r *RtmpPlay) OnClosed(conn rtmp.Conn) {
 	log.Printf("Connect Closed")
+	r.notifyError("connection is closed")
 }
 
 func (r *RtmpPlay) OnReceived(conn rtmp.Conn, message *rtmp.Message) {
+	switch message.Type {
+	case rtmp.VIDEO_TYPE, rtmp.AUDIO_TYPE, rtmp.DATA_AMF0, rtmp.DATA_AMF3:
+		r.addTag(message.Type, message.Buf.Len(), message.AbsoluteTimestamp)
+		r.Timing.MarkTag(message.Type, message.Buf.Bytes())
+		if r.OnTag != nil {
+			r.OnTag(message.Type, message.AbsoluteTimestamp, message.Buf.Bytes())
+		}
+	}
 	switch message.Type {
 	case rtmp.VIDEO_TYPE:
 		if r.FlvFile != nil {
 			err := r.FlvFile.WriteVideoTag(message.Buf.Bytes(), message.Timestamp)
 			if err != nil {
-				r.ErrorMessageChan <- fmt.Sprintf("FlvFile.WriteVideoTag failed, err:%v", err)
+				r.notifyError(fmt.Sprintf("FlvFile.WriteVideoTag failed, err:%v", err))
 			}
 		}
 	case rtmp.AUDIO_TYPE:
 		if r.FlvFile != nil {
 			err := r.FlvFile.WriteAudioTag(message.Buf.Bytes(), message.Timestamp)
 			if err != nil {
-				r.ErrorMessageChan <- fmt.Sprintf("FlvFile.WriteVideoTag failed, err:%v", err)
+				r.notifyError(fmt.Sprintf("FlvFile.WriteVideoTag failed, err:%v", err))
 			}
 		}
 	case rtmp.DATA_AMF0:
@@ -63,7 +92,7 @@ func (r *RtmpPlay) OnReceived(conn rtmp.Conn, message *rtmp.Message) {
 		if r.FlvFile != nil {
 			err := r.FlvFile.WriteTag(message.Buf.Bytes(), message.Type, message.AbsoluteTimestamp)
 			if err != nil {
-				r.ErrorMessageChan <- fmt.Sprintf("FlvFile.WriteVideoTag failed, err:%v", err)
+				r.notifyError(fmt.Sprintf("FlvFile.WriteVideoTag failed, err:%v", err))
 			}
 		}
 	}
@@ -78,6 +107,7 @@ func (r *RtmpPlay) OnStreamCreated(conn rtmp.OutboundConn, stream rtmp.OutboundS
 
 	stream.Attach(r)
 
+	r.Timing.Start(timing.PhasePlayStart)
 	if err := stream.Play(r.StreamName, nil, nil, nil); err != nil {
 		log.Printf("OnStreamCreated failed, err:%v", err)
 	}
@@ -85,6 +115,7 @@ func (r *RtmpPlay) OnStreamCreated(conn rtmp.OutboundConn, stream rtmp.OutboundS
 
 func (r *RtmpPlay) OnPlayStart(stream rtmp.OutboundStream) {
 	log.Printf("Play Start")
+	r.Timing.End(timing.PhasePlayStart)
 	r.Stream = stream
 }
 
@@ -97,10 +128,12 @@ func (r *RtmpPlay) Start() error {
 	var err error
 	br := bufio.NewReader(r.Conn)
 	bw := bufio.NewWriter(r.Conn)
+	r.Timing.Start(timing.PhaseRtmpHandshake)
 	err = rtmp.Handshake(r.Conn, br, bw, time.Second*10)
 	if err != nil {
 		return fmt.Errorf("gortmp.Handshake err:%v", err)
 	}
+	r.Timing.End(timing.PhaseRtmpHandshake)
 
 	obConn, err := rtmp.NewOutbounConn(r.Conn, r.TcUrl, r, 100)
 	if err != nil {
@@ -110,6 +143,7 @@ func (r *RtmpPlay) Start() error {
 	// 通知握手成功
 	r.OnStatus(obConn)
 
+	r.Timing.Start(timing.PhaseRtmpConnect)
 	err = obConn.Connect()
 	if err != nil {
 		return fmt.Errorf("obConn.Connect error: %v", err)
@@ -141,10 +175,23 @@ func (r *RtmpPlay) PlayData() error {
 		r.FlvFile = flvFile
 	}
 
+	statsDone := make(chan struct{})
+	defer close(statsDone)
+	go r.reportStats("play", r.StatsIntervalMs, r.ExtraStats, statsDone)
+
 	select {
 	case errMessage := <-r.ErrorMessageChan:
 		return fmt.Errorf("play error, err:%v", errMessage)
+	case <-time.After(time.Duration(r.DurationMs) * time.Millisecond):
+		return nil
 	}
 
 	return fmt.Errorf("unkown reason")
 }
+
+func (r *RtmpPlay) notifyError(message string) {
+	select {
+	case r.ErrorMessageChan <- message:
+	default:
+	}
+}
@@ -10,6 +10,8 @@ import (
 
 	"github.com/zhangpeihao/goflv"
 	rtmp "github.com/zhangpeihao/gortmp"
+	"quic_demo/latency"
+	"quic_demo/timing"
 )
 
 type RtmpPublisher struct {
@@ -27,6 +29,15 @@ type RtmpPublisher struct {
 	CanPublisher     bool
 	BeginTimeMs      int64
 	PublisherBeginMs int64
+
+	mediaCounter
+	StatsIntervalMs int64            // 统计打印间隔，0为不打印
+	ExtraStats      func() string    // 追加在统计后面的传输层信息
+	Timing          *timing.Recorder // 记录rtmp各阶段耗时，可以为nil
+	// OnTag 每发出一个tag后调用，timestamp为实际发送的时间戳，可以为nil
+	OnTag func(tagType uint8, timestamp uint32, body []byte)
+	// Marker 按间隔插入发送时间和序号，播放端用来计算端到端时延，可以为nil
+	Marker *latency.Injector
 }
 
 func NewRtmpPublisher(conn net.Conn, flvFileName string, tcUrl string, streamName string,
@@ -42,6 +53,7 @@ func NewRtmpPublisher(conn net.Conn, flvFileName string, tcUrl string, streamNam
 		IsClosed:         false,
 		CanPublisher:     false,
 		PublisherBeginMs: 0,
+		StatsIntervalMs:  5000,
 	}
 }
 
@@ -49,6 +61,13 @@ func (r *RtmpPublisher) OnStatus(conn rtmp.OutboundConn) {
 	status, err := conn.Status()
 	log.Printf("Handler On Status, status:%v, err:%v", status, err)
 	r.Status = status
+	switch status {
+	case rtmp.OUTBOUND_CONN_STATUS_CONNECT_OK:
+		r.Timing.End(timing.PhaseRtmpConnect)
+		r.Timing.Start(timing.PhaseCreateStream)
+	case rtmp.OUTBOUND_CONN_STATUS_CREATE_STREAM_OK:
+		r.Timing.End(timing.PhaseCreateStream)
+	}
 }
 
 func (r *RtmpPublisher) OnClosed(conn rtmp.Conn) {
@@ -69,6 +88,7 @@ func (r *RtmpPublisher) OnStreamCreated(conn rtmp.OutboundConn, stream rtmp.Outb
 
 	stream.Attach(r)
 
+	r.Timing.Start(timing.PhasePublishStart)
 	if err := stream.Publish(r.StreamName, "live"); err != nil {
 		log.Printf("OnStreamCreated failed, err:%v", err)
 	}
@@ -80,6 +100,7 @@ func (r *RtmpPublisher) OnPlayStart(stream rtmp.OutboundStream) {
 
 func (r *RtmpPublisher) OnPublishStart(stream rtmp.OutboundStream) {
 	log.Printf("Publish Start")
+	r.Timing.End(timing.PhasePublishStart)
 	r.PublisherBeginMs = time.Now().UnixNano() / 1e6
 	r.Stream = stream
 	r.CanPublisher = true
@@ -92,10 +113,12 @@ func (r *RtmpPublisher) Start() error {
 	var err error
 	br := bufio.NewReader(r.Conn)
 	bw := bufio.NewWriter(r.Conn)
+	r.Timing.Start(timing.PhaseRtmpHandshake)
 	err = rtmp.Handshake(r.Conn, br, bw, time.Second*10)
 	if err != nil {
 		return fmt.Errorf("gortmp.Handshake err:%v", err)
 	}
+	r.Timing.End(timing.PhaseRtmpHandshake)
 
 	obConn, err := rtmp.NewOutbounConn(r.Conn, r.TcUrl, r, 100)
 	if err != nil {
@@ -105,6 +128,7 @@ func (r *RtmpPublisher) Start() error {
 	// 通知握手成功
 	r.OnStatus(obConn)
 
+	r.Timing.Start(timing.PhaseRtmpConnect)
 	err = obConn.Connect()
 	if err != nil {
 		return fmt.Errorf("obConn.Connect error: %v", err)
@@ -132,6 +156,10 @@ func (r *RtmpPublisher) PublishData() error {
 	}
 	defer flvFile.Close()
 
+	statsDone := make(chan struct{})
+	defer close(statsDone)
+	go r.reportStats("publish", r.StatsIntervalMs, r.ExtraStats, statsDone)
+
 	startTs := uint32(0)
 	startAt := time.Now().UnixNano()
 	needWaitTime := uint32(0)
@@ -202,11 +230,23 @@ func (r *RtmpPublisher) PublishData() error {
 		if header.Timestamp > startTs {
 			needWaitTime = header.Timestamp - startTs
 		}
+		// 需要时先推送时间标记，或者把标记插入到视频帧中
+		script, data := r.Marker.Inject(header.TagType, data)
+		if script != nil {
+			if err = r.Stream.PublishData(rtmp.DATA_AMF0, script, needWaitTime); err != nil {
+				return fmt.Errorf("stream.PublishData failed, err:%v", err)
+			}
+		}
 		// 推送当前tag
 		if err = r.Stream.PublishData(header.TagType, data,
 			needWaitTime); err != nil {
 			return fmt.Errorf("stream.PublishData failed, err:%v", err)
 		}
+		r.addTag(header.TagType, len(data), header.Timestamp)
+		r.Timing.MarkTag(header.TagType, data)
+		if r.OnTag != nil {
+			r.OnTag(header.TagType, needWaitTime, data)
+		}
 
 	}
 
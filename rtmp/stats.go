@@ -0,0 +1,79 @@
+package rtmp
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	rtmp "github.com/zhangpeihao/gortmp"
+)
+
+// MediaStats 推流或播放的音视频统计
+type MediaStats struct {
+	AudioTags     int64
+	VideoTags     int64
+	DataTags      int64
+	Bytes         int64
+	LastTimestamp uint32
+}
+
+func (s MediaStats) String() string {
+	return fmt.Sprintf("audio:%d, video:%d, data:%d, bytes:%d, timestamp:%d",
+		s.AudioTags, s.VideoTags, s.DataTags, s.Bytes, s.LastTimestamp)
+}
+
+// mediaCounter 嵌入RtmpPublisher和RtmpPlay，统计收发的tag
+type mediaCounter struct {
+	statsLock sync.Mutex
+	stats     MediaStats
+}
+
+func (c *mediaCounter) addTag(tagType uint8, size int, timestamp uint32) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	switch tagType {
+	case rtmp.AUDIO_TYPE:
+		c.stats.AudioTags++
+	case rtmp.VIDEO_TYPE:
+		c.stats.VideoTags++
+	default:
+		c.stats.DataTags++
+	}
+	c.stats.Bytes += int64(size)
+	c.stats.LastTimestamp = timestamp
+}
+
+// Stats 返回当前的音视频统计
+func (c *mediaCounter) Stats() MediaStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return c.stats
+}
+
+// reportStats 每隔intervalMs打印一次音视频统计和码率，extra不为空时追加在后面，
+// 用于打印传输层(如quic)的统计
+func (c *mediaCounter) reportStats(name string, intervalMs int64, extra func() string, done <-chan struct{}) {
+	if intervalMs <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	lastBytes := int64(0)
+	lastTime := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			stats := c.Stats()
+			bitrate := (stats.Bytes - lastBytes) * 8 / int64(now.Sub(lastTime)/time.Millisecond+1)
+			lastBytes, lastTime = stats.Bytes, now
+			if extra != nil {
+				log.Printf("%s stats, %v, bitrate:%dkbps, %s", name, stats, bitrate, extra())
+			} else {
+				log.Printf("%s stats, %v, bitrate:%dkbps", name, stats, bitrate)
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"quic_demo/quicConn"
+	"quic_demo/resolver"
+	"quic_demo/rtmp"
+	"quic_demo/timing"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type streamResult struct {
+	index      int
+	streamName string
+	startupMs  int64
+	err        error
+	timing     *timing.Recorder
+}
+
+func main() {
+
+	var tcUrl string
+	var streamName string
+	var fileName string
+	var port int
+	var count int
+	var mode string
+	var transport string
+	var duration int
+	var versions string
+	var alpn string
+	var qlogDir string
+	flag.StringVar(&tcUrl, "tcUrl", "", "tcUrl")
+	flag.StringVar(&streamName, "streamName", "", "streamName, stream i is named streamName_i")
+	flag.StringVar(&fileName, "fileName", "", "fileName, flv to publish or record prefix to play")
+	flag.IntVar(&port, "port", 443, "port, default 443")
+	flag.IntVar(&count, "count", 4, "stream count, default 4")
+	flag.StringVar(&mode, "mode", "publish", "publish or play")
+	flag.StringVar(&transport, "transport", "quic", "quic: all streams on one quic session, tcp/tls: one connection per stream")
+	flag.IntVar(&duration, "duration", 60, "duration in seconds, default 60")
+	flag.StringVar(&versions, "versions", "draft29", "quic versions, v1,draft29, the first is used for the initial packet")
+	flag.StringVar(&alpn, "alpn", quicConn.RtmpOverQuicAlpn, "tls alpn, comma separated")
+	flag.StringVar(&qlogDir, "qlogDir", "", "write a qlog file per quic session into this dir, empty to disable")
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
+	flag.Parse()
+	if tcUrl == "" || streamName == "" || (mode == "publish" && fileName == "") || count <= 0 {
+		log.Fatalln("tcUrl == \"\" ||streamName == \"\" ||fileName == \"\" ||count <= 0")
+	}
+	if mode != "publish" && mode != "play" {
+		log.Fatalf("unknown mode:%s", mode)
+	}
+
+	url2, err := url.Parse(tcUrl)
+	if err != nil {
+		log.Fatalf("url.Parse failed, err:%v", err)
+	}
+	domain := url2.Hostname()
+	addrs, err := addrOptions.Lookup(domain)
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	ip := addrs.Ips[0]
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+
+	var tlsConfig *tls.Config
+	if transport == "quic" {
+		tlsConfig, err = tlsOptions.QuicClientConfig(domain)
+	} else {
+		tlsConfig, err = tlsOptions.ClientConfig(domain)
+	}
+	if err != nil {
+		log.Fatalf("tlsOptions.ClientConfig err:%v", err)
+	}
+
+	var dial func(recorder *timing.Recorder) (net.Conn, error)
+	// quic下所有流共用一个session，统计里追加session的传输信息
+	var quicStats func() string
+	switch transport {
+	case "quic":
+		quicVersions, err := quicConn.ParseVersions(versions)
+		if err != nil {
+			log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+		}
+		tracer := quicConn.NewTracer()
+		tracer.QlogDir = qlogDir
+		// 所有流共用一次quic握手，单独输出
+		sessionRecorder := timing.NewRecorder(transport)
+		addrs.RecordDns(sessionRecorder)
+		sessionRecorder.Start(timing.PhaseQuicHandshake)
+		tlsConfig.NextProtos = quicConn.ParseAlpn(alpn)
+		quicSession, err := quic.DialAddr(addr, tlsConfig, &quic.Config{
+			Versions: quicVersions,
+			Tracer:   tracer,
+		})
+		if err != nil {
+			log.Fatalf("quic.DialAddr err:%v", err)
+		}
+		sessionRecorder.End(timing.PhaseQuicHandshake)
+		sessionRecorder.Print(os.Stdout)
+		fmt.Printf("%s\n", tracer.SessionInfo(quicSession))
+		quicStats = func() string {
+			return tracer.Stats(quicSession).String()
+		}
+		mux := quicConn.NewQuicSessionMux(quicSession)
+		defer mux.Close()
+		dial = func(recorder *timing.Recorder) (net.Conn, error) {
+			return mux.OpenConn(context.Background())
+		}
+	case "tcp":
+		dial = func(recorder *timing.Recorder) (net.Conn, error) {
+			recorder.Start(timing.PhaseTcpConnect)
+			defer recorder.End(timing.PhaseTcpConnect)
+			return net.Dial("tcp", addr)
+		}
+	case "tls":
+		dial = func(recorder *timing.Recorder) (net.Conn, error) {
+			recorder.Start(timing.PhaseTcpConnect)
+			tcpConn, err := net.Dial("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			recorder.End(timing.PhaseTcpConnect)
+			recorder.Start(timing.PhaseTlsHandshake)
+			conn := tls.Client(tcpConn, tlsConfig)
+			if err := conn.Handshake(); err != nil {
+				tcpConn.Close()
+				return nil, err
+			}
+			recorder.End(timing.PhaseTlsHandshake)
+			return conn, nil
+		}
+	default:
+		log.Fatalf("unknown transport:%s", transport)
+	}
+
+	results := make([]streamResult, count)
+	wg := sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		results[i] = streamResult{
+			index:      i,
+			streamName: fmt.Sprintf("%s_%d", streamName, i),
+			timing:     timing.NewRecorder(transport),
+		}
+		if transport != "quic" {
+			// quic的dns记在session上，tcp/tls每个流单独建连
+			addrs.RecordDns(results[i].timing)
+		}
+		wg.Add(1)
+		go func(result *streamResult) {
+			defer wg.Done()
+			beginTime := time.Now()
+			conn, err := dial(result.timing)
+			if err != nil {
+				result.err = err
+				return
+			}
+			defer conn.Close()
+
+			if mode == "publish" {
+				rtmpPublisher := rtmp.NewRtmpPublisher(conn, fileName, tcUrl, result.streamName)
+				rtmpPublisher.DurationMs = int64(duration) * 1000
+				rtmpPublisher.ExtraStats = quicStats
+				rtmpPublisher.Timing = result.timing
+				result.err = rtmpPublisher.Start()
+				if rtmpPublisher.PublisherBeginMs > 0 {
+					result.startupMs = rtmpPublisher.PublisherBeginMs - beginTime.UnixNano()/1e6
+				}
+				return
+			}
+
+			recordName := ""
+			if fileName != "" {
+				ext := filepath.Ext(fileName)
+				recordName = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(fileName, ext), result.index, ext)
+			}
+			rtmpPlay := rtmp.NewRtmpPlay(conn, recordName, tcUrl, result.streamName)
+			rtmpPlay.DurationMs = int64(duration) * 1000
+			rtmpPlay.ExtraStats = quicStats
+			rtmpPlay.Timing = result.timing
+			result.err = rtmpPlay.Start()
+		}(&results[i])
+	}
+	wg.Wait()
+
+	fmt.Printf("transport:%s, mode:%s, streams:%d\n", transport, mode, count)
+	for _, result := range results {
+		fmt.Printf("stream:%d, name:%s, startup:%dms, err:%v\n",
+			result.index, result.streamName, result.startupMs, result.err)
+		result.timing.Print(os.Stdout)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"log"
+	"net"
+	"quic_demo/quicConn"
+	"time"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// halfCloseTimeout 一个方向结束后等待另一个方向结束的最长时间
+const halfCloseTimeout = 10 * time.Second
+
+func main() {
+
+	var quicAddr string
+	var tlsAddr string
+	var tcpAddr string
+	var certFile string
+	var keyFile string
+	var versions string
+	var alpn string
+	var qlogDir string
+	var upstream string
+	flag.StringVar(&quicAddr, "quicAddr", ":443", "rtmp over quic listen addr, empty to disable")
+	flag.StringVar(&tlsAddr, "tlsAddr", "", "rtmps listen addr, empty to disable")
+	flag.StringVar(&tcpAddr, "tcpAddr", "", "rtmp listen addr, empty to disable")
+	flag.StringVar(&certFile, "cert", "", "cert file, self-signed if empty")
+	flag.StringVar(&keyFile, "key", "", "key file")
+	flag.StringVar(&versions, "versions", "v1,draft29", "supported quic versions, comma separated")
+	flag.StringVar(&alpn, "alpn", quicConn.RtmpOverQuicAlpn, "tls alpn, comma separated")
+	flag.StringVar(&qlogDir, "qlogDir", "", "write a qlog file per quic session into this dir, empty to disable")
+	flag.StringVar(&upstream, "upstream", "127.0.0.1:1935", "upstream rtmp server addr")
+	flag.Parse()
+
+	tlsConfig, err := quicConn.LoadServerTlsConfig(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("quicConn.LoadServerTlsConfig err:%v", err)
+	}
+
+	quicVersions, err := quicConn.ParseVersions(versions)
+	if err != nil {
+		log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+	}
+	tlsConfig.NextProtos = quicConn.ParseAlpn(alpn)
+	tracer := quicConn.NewTracer()
+	tracer.QlogDir = qlogDir
+	quicConfig := &quic.Config{
+		Versions: quicVersions,
+		Tracer:   tracer,
+	}
+
+	listener := quicConn.NewListener()
+	defer listener.Close()
+	for network, addr := range map[string]string{"quic": quicAddr, "tls": tlsAddr, "tcp": tcpAddr} {
+		if addr == "" {
+			continue
+		}
+		if err := listener.Listen(network, addr, tlsConfig, quicConfig); err != nil {
+			log.Fatalf("listener.Listen err:%v", err)
+		}
+		log.Printf("listen %s on %s", network, addr)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatalf("listener.Accept err:%v", err)
+		}
+		go proxy(conn, upstream)
+	}
+}
+
+func proxy(conn net.Conn, upstream string) {
+	defer conn.Close()
+	upConn, err := net.DialTimeout("tcp", upstream, time.Second*5)
+	if err != nil {
+		log.Printf("dial upstream failed, upstream:%s, err:%v", upstream, err)
+		return
+	}
+	defer upConn.Close()
+	log.Printf("proxy %v -> %s", conn.RemoteAddr(), upstream)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upConn, conn)
+	go pipe(conn, upConn)
+	// 一个方向结束时只半关闭，另一个方向的数据继续转发完再关闭两端
+	<-done
+	timer := time.NewTimer(halfCloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("proxy %v -> %s, the other direction did not finish in %v", conn.RemoteAddr(), upstream, halfCloseTimeout)
+	}
+}
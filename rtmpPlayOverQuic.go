@@ -2,60 +2,224 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/lucas-clemente/quic-go"
 	"log"
+	"net"
 	"net/url"
+	"os"
+	"quic_demo/analytics"
 	"quic_demo/quicConn"
+	"quic_demo/resolver"
 	"quic_demo/rtmp"
-	"strings"
+	"quic_demo/timing"
+	"strconv"
+	"time"
 )
 
 func main() {
 
-	var ip string
 	var tcUrl string
 	var streamName string
 	var fileName string
 	var port int
-	flag.StringVar(&ip, "ip", "", "ip")
+	var versions string
+	var alpn string
+	var sessionCacheFile string
+	var early bool
+	var qlogDir string
 	flag.StringVar(&tcUrl, "tcUrl", "", "tcUrl")
 	flag.StringVar(&streamName, "streamName", "", "streamName")
 	flag.StringVar(&fileName, "fileName", "", "fileName")
 	flag.IntVar(&port, "port", 443, "port, default 443")
+	flag.StringVar(&versions, "versions", "draft29", "quic versions, v1,draft29, the first is used for the initial packet")
+	flag.StringVar(&alpn, "alpn", quicConn.RtmpOverQuicAlpn, "tls alpn, comma separated")
+	flag.StringVar(&sessionCacheFile, "sessionCache", "", "tls session cache file, kept between runs for resumption and 0-RTT")
+	flag.BoolVar(&early, "early", true, "send the rtmp handshake as 0-RTT data when a cached session is available")
+	flag.StringVar(&qlogDir, "qlogDir", "", "write a qlog file per quic session into this dir, empty to disable")
+	var raceDialer quicConn.RaceDialer
+	raceDialer.AddFlags(false)
+	var rebindTest quicConn.RebindTest
+	rebindTest.AddFlags()
+	var analyticsOptions analytics.Options
+	analyticsOptions.AddFlags()
+	var playerOptions analytics.PlayerOptions
+	playerOptions.AddFlags()
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
 	flag.Parse()
-	if ip == "" || tcUrl == "" || streamName == "" || fileName == "" {
-		log.Fatalln("ip == \"\" ||tcUrl == \"\" ||streamName == \"\" ||fileName == \"\"")
+	if tcUrl == "" || streamName == "" || fileName == "" {
+		log.Fatalln("tcUrl == \"\" ||streamName == \"\" ||fileName == \"\"")
 
 	}
+	if raceDialer.Enabled && rebindTest.Enabled() {
+		log.Fatalln("raceDialer.Enabled && rebindTest.Enabled()")
+	}
 
 	url2, err := url.Parse(tcUrl)
 	if err != nil {
 		log.Fatalf("url.Parse failed, err:%v", err)
 	}
-	domain := strings.Split(url2.Host, ":")[0]
+	domain := url2.Hostname()
+	addrs, err := addrOptions.Lookup(domain)
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	ip := addrs.Ips[0]
+	quicVersions, err := quicConn.ParseVersions(versions)
+	if err != nil {
+		log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+	}
+
+	sessionCache, err := quicConn.NewFileSessionCache(sessionCacheFile)
+	if err != nil {
+		log.Fatalf("quicConn.NewFileSessionCache err:%v", err)
+	}
+
+	tlsConfig, err := tlsOptions.QuicClientConfig(domain)
+	if err != nil {
+		log.Fatalf("tlsOptions.QuicClientConfig err:%v", err)
+	}
+	tlsConfig.NextProtos = quicConn.ParseAlpn(alpn)
+	tlsConfig.ClientSessionCache = sessionCache
+
+	tracer := quicConn.NewTracer()
+	tracer.QlogDir = qlogDir
+	recorder := timing.NewRecorder("quic")
+	addrs.RecordDns(recorder)
+	go func() {
+		recorder.Wait(timing.PhaseFirstVideoKeyframe, 10*time.Second)
+		recorder.Print(os.Stdout)
+	}()
+	// 收到的tag送入统计和模拟播放器，首帧从dns解析开始算
+	analyzer := analytics.NewAnalyzer(analyticsOptions)
+	analyzer.Player = analytics.NewPlayer(playerOptions, recorder.Begin)
+	analyzer.Latency = analytics.NewLatencyMeter()
+	analyzer.PrintOnInterrupt(os.Stdout)
+	onTag := func(tagType uint8, timestamp uint32, body []byte) {
+		sample := analyzer.Add(tagType, timestamp, body)
+		if sample.StallMs > 0 {
+			fmt.Printf("stall, gap:%.1fms, pts:%d\n", sample.StallMs, timestamp)
+		}
+		if event := sample.Player.String(); event != "" {
+			fmt.Printf("%s, pts:%d\n", event, timestamp)
+		}
+		if sample.Latency != nil {
+			fmt.Printf("latency, %s, pts:%d\n", sample.Latency, timestamp)
+		}
+		if rebindTest.Enabled() {
+			rebindTest.OnTag(tagType, timestamp, body)
+		}
+	}
+
+	quicAddr := net.JoinHostPort(ip, strconv.Itoa(port))
+	quicConfig := &quic.Config{
+		Versions: quicVersions,
+		Tracer:   tracer,
+	}
+
+	var quicSession quic.EarlySession
+	if raceDialer.Enabled {
+		// quic与tcp赛跑，udp不通时回退到rtmp(s) over tcp
+		raceDialer.QuicAddr = quicAddr
+		raceDialer.QuicTlsConfig = tlsConfig
+		raceDialer.QuicConfig = quicConfig
+		raceDialer.Timing = recorder
+		if raceDialer.Tls {
+			if raceDialer.TlsConfig, err = tlsOptions.ClientConfig(domain); err != nil {
+				log.Fatalf("tlsOptions.ClientConfig err:%v", err)
+			}
+		}
+		raceResult, err := raceDialer.Dial(context.Background())
+		if err != nil {
+			log.Fatalf("raceDialer.Dial err:%v", err)
+		}
+		fmt.Printf("%s\n", raceResult)
+		if raceResult.Conn != nil {
+			defer raceResult.Conn.Close()
+			rtmpPlay := rtmp.NewRtmpPlay(raceResult.Conn, fileName,
+				tcUrl,
+				streamName)
+			rtmpPlay.Timing = recorder
+			rtmpPlay.OnTag = onTag
+			err := rtmpPlay.Start()
+			analyzer.Summary().Print(os.Stdout)
+			if err != nil {
+				log.Fatalf("rtmpPlay.Start err:%v", err)
+			}
+			return
+		}
+		quicSession = raceResult.Session
+	} else {
+		recorder.Start(timing.PhaseQuicHandshake)
+		if rebindTest.Enabled() {
+			// 在可替换的socket上建连，播放中途换端口模拟NAT重绑定
+			quicSession, err = rebindTest.DialEarly(quicAddr, tlsConfig, quicConfig)
+		} else {
+			quicSession, err = quic.DialAddrEarly(quicAddr, tlsConfig, quicConfig)
+		}
+		if err != nil {
+			log.Fatalf("quic.DialAddrEarly err:%v", err)
+			return
+		}
+	}
+	defer quicSession.CloseWithError(quicConn.CodeNoError, "")
+	if !early {
+		quicConn.WaitHandshake(quicSession)
+	}
+	go func() {
+		if quicConn.WaitHandshake(quicSession) {
+			recorder.End(timing.PhaseQuicHandshake)
+			fmt.Printf("%s\n", tracer.SessionInfo(quicSession))
+		}
+	}()
 
-	quicSession, err := quic.DialAddr(fmt.Sprintf("%s:%d", ip, port), &tls.Config{
-		ServerName: domain,
-		NextProtos: []string{"rtmp over quic"},
-	}, &quic.Config{
-		Versions: []quic.VersionNumber{quic.VersionDraft29},
-	})
+	if rebindTest.Enabled() {
+		go func() {
+			fmt.Printf("%s\n", rebindTest.Run(quicSession))
+		}()
+	}
+
+	quicStats := func() string {
+		return tracer.Stats(quicSession).String()
+	}
+	err = play(quicSession, fileName, tcUrl, streamName, quicStats, recorder, onTag)
+	if err != nil && quicConn.WaitHandshake(quicSession) && tracer.SessionInfo(quicSession).Rejected0RTT() {
+		// 0-RTT被拒绝时之前打开的流都已失效，握手完成后在新的流上重试
+		log.Printf("0-RTT rejected, retry after handshake, err:%v", err)
+		err = play(quicSession.NextSession(), fileName, tcUrl, streamName, quicStats, recorder, onTag)
+	}
+	analyzer.Summary().Print(os.Stdout)
 	if err != nil {
-		log.Fatalf("quic.DialAddr err:%v", err)
+		quicSession.CloseWithError(quicConn.CodeInternalError, err.Error())
+		log.Fatalf("rtmpPlay.Start err:%v", err)
 		return
 	}
+}
+
+func play(quicSession quic.Session, fileName string, tcUrl string, streamName string, quicStats func() string, recorder *timing.Recorder,
+	onTag func(tagType uint8, timestamp uint32, body []byte)) error {
 	quicStream, err := quicSession.OpenStreamSync(context.Background())
+	if err != nil {
+		return fmt.Errorf("quicSession.OpenStreamSync failed, err:%v", err)
+	}
 
-	qConn := quicConn.NewQuicConn(quicSession, quicStream)
+	qConn := quicConn.NewQuicStreamConn(quicSession, quicStream)
+	defer qConn.Close()
 
 	rtmpPlay := rtmp.NewRtmpPlay(qConn, fileName,
 		tcUrl,
 		streamName)
-	if err := rtmpPlay.Start(); err != nil {
-		log.Fatalf("rtmpPlay.Start err:%v", err)
-		return
-	}
+	rtmpPlay.ExtraStats = quicStats
+	rtmpPlay.Timing = recorder
+	rtmpPlay.OnTag = onTag
+	return rtmpPlay.Start()
 }
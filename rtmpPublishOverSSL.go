@@ -3,48 +3,93 @@ package main
 import (
 	"crypto/tls"
 	"flag"
-	"fmt"
 	"log"
+	"net"
 	"net/url"
+	"os"
+	"quic_demo/latency"
+	"quic_demo/quicConn"
+	"quic_demo/resolver"
 	"quic_demo/rtmp"
+	"quic_demo/timing"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
 
-	var ip string
 	var tcUrl string
 	var streamName string
 	var fileName string
 	var port int
-	flag.StringVar(&ip, "ip", "", "ip")
 	flag.StringVar(&tcUrl, "tcUrl", "", "tcUrl")
 	flag.StringVar(&streamName, "streamName", "", "streamName")
 	flag.StringVar(&fileName, "fileName", "", "fileName")
 	flag.IntVar(&port, "port", 443, "port, default 443")
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
+	var markerOptions latency.Options
+	markerOptions.AddFlags()
 	flag.Parse()
-	if ip == "" || tcUrl == "" || streamName == "" || fileName == "" {
-		log.Fatalln("ip == \"\" ||tcUrl == \"\" ||streamName == \"\" ||fileName == \"\"")
+	if tcUrl == "" || streamName == "" || fileName == "" {
+		log.Fatalln("tcUrl == \"\" ||streamName == \"\" ||fileName == \"\"")
 
 	}
+	marker, err := markerOptions.NewInjector()
+	if err != nil {
+		log.Fatalf("markerOptions.NewInjector err:%v", err)
+	}
 
 	tcUrl = strings.Replace(tcUrl, "rtmps://", "rtmp://", -1)
 	url2, err := url.Parse(tcUrl)
 	if err != nil {
 		log.Fatalf("url.Parse failed, err:%v", err)
 	}
-	domain := strings.Split(url2.Host, ":")[0]
+	domain := url2.Hostname()
+	addrs, err := addrOptions.Lookup(domain)
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	ip := addrs.Ips[0]
 
-	conn, err := tls.Dial("tcp", fmt.Sprintf("%s:%d", ip, port), &tls.Config{
-		ServerName: domain,
-	})
+	tlsConfig, err := tlsOptions.ClientConfig(domain)
 	if err != nil {
-		log.Fatalf("tls.Dial failed, err:%v", err)
+		log.Fatalf("tlsOptions.ClientConfig err:%v", err)
+	}
+
+	// tcp连接和tls握手分开，分别统计耗时
+	recorder := timing.NewRecorder("tcp+tls")
+	addrs.RecordDns(recorder)
+	recorder.Start(timing.PhaseTcpConnect)
+	tcpConn, err := net.Dial("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		log.Fatalf("net.Dial failed, err:%v", err)
+	}
+	recorder.End(timing.PhaseTcpConnect)
+	recorder.Start(timing.PhaseTlsHandshake)
+	conn := tls.Client(tcpConn, tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		log.Fatalf("tls handshake failed, err:%v", err)
 	}
+	recorder.End(timing.PhaseTlsHandshake)
+	go func() {
+		recorder.Wait(timing.PhaseFirstVideoKeyframe, 10*time.Second)
+		recorder.Print(os.Stdout)
+	}()
 
 	rtmpPublisher := rtmp.NewRtmpPublisher(conn, fileName,
 		tcUrl,
 		streamName)
+	rtmpPublisher.Timing = recorder
+	rtmpPublisher.Marker = marker
 	if err := rtmpPublisher.Start(); err != nil {
 		log.Fatalf("rtmpPublisher.Start err:%v", err)
 		return
@@ -0,0 +1,175 @@
+package rtmpServer
+
+import (
+	"bytes"
+	amf "github.com/zhangpeihao/goamf"
+	"quic_demo/flv"
+	"sync"
+)
+
+// Subscriber 订阅一路直播流，Tags在订阅取消或消费过慢时被关闭
+type Subscriber struct {
+	Tags   chan *flv.TagInfo
+	stream *liveStream
+}
+
+func (s *Subscriber) Close() {
+	s.stream.removeSubscriber(s)
+}
+
+// Publisher 在进程内推流，用于非rtmp协议推上来的流
+type Publisher struct {
+	stream    *liveStream
+	closeOnce sync.Once
+}
+
+func (p *Publisher) WriteTag(tag *flv.TagInfo) {
+	p.stream.writeTag(tag)
+}
+
+func (p *Publisher) Close() {
+	p.closeOnce.Do(p.stream.stopPublish)
+}
+
+// liveStream 一路直播流：缓存metadata、音视频sequence header和最近一个GOP，并将tag分发给所有订阅者
+type liveStream struct {
+	key    string
+	server *Server
+
+	lock        sync.Mutex
+	publishing  bool
+	metaData    *flv.TagInfo
+	videoHeader *flv.TagInfo
+	audioHeader *flv.TagInfo
+	gop         []*flv.TagInfo
+	subscribers map[*Subscriber]struct{}
+}
+
+func newLiveStream(server *Server, key string) *liveStream {
+	return &liveStream{
+		key:         key,
+		server:      server,
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+func (l *liveStream) startPublish() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.publishing {
+		return false
+	}
+	l.publishing = true
+	return true
+}
+
+func (l *liveStream) stopPublish() {
+	l.lock.Lock()
+	l.publishing = false
+	l.metaData = nil
+	l.videoHeader = nil
+	l.audioHeader = nil
+	l.gop = nil
+	l.lock.Unlock()
+	l.server.releaseStream(l)
+}
+
+func (l *liveStream) writeTag(tag *flv.TagInfo) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	switch {
+	case IsMetaData(tag):
+		l.metaData = tag
+	case IsSequenceHeader(tag):
+		if tag.TagType == flv.VIDEO_TAG {
+			l.videoHeader = tag
+		} else {
+			l.audioHeader = tag
+		}
+	case l.server.GopCache && IsKeyFrame(tag):
+		l.gop = append(l.gop[:0], tag)
+	case l.server.GopCache && len(l.gop) > 0:
+		if len(l.gop) < l.server.MaxGopTags {
+			l.gop = append(l.gop, tag)
+		}
+	}
+
+	for subscriber := range l.subscribers {
+		select {
+		case subscriber.Tags <- tag:
+		default:
+			// 消费过慢，断开该订阅者
+			delete(l.subscribers, subscriber)
+			close(subscriber.Tags)
+		}
+	}
+}
+
+func (l *liveStream) addSubscriber(bufferSize int) *Subscriber {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	cache := make([]*flv.TagInfo, 0, len(l.gop)+3)
+	for _, tag := range []*flv.TagInfo{l.metaData, l.videoHeader, l.audioHeader} {
+		if tag != nil {
+			cache = append(cache, tag)
+		}
+	}
+	cache = append(cache, l.gop...)
+
+	subscriber := &Subscriber{
+		Tags:   make(chan *flv.TagInfo, bufferSize+len(cache)),
+		stream: l,
+	}
+	for _, tag := range cache {
+		subscriber.Tags <- tag
+	}
+	l.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (l *liveStream) removeSubscriber(subscriber *Subscriber) {
+	l.lock.Lock()
+	if _, found := l.subscribers[subscriber]; found {
+		delete(l.subscribers, subscriber)
+		close(subscriber.Tags)
+	}
+	l.lock.Unlock()
+	l.server.releaseStream(l)
+}
+
+func (l *liveStream) idle() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return !l.publishing && len(l.subscribers) == 0
+}
+
+// IsMetaData 是否为onMetaData或@setDataFrame，其他script tag(如onTextData)不缓存，只转发
+func IsMetaData(tag *flv.TagInfo) bool {
+	if tag.TagType != flv.SCRIPT_DATA_TAG {
+		return false
+	}
+	name, err := amf.ReadValue(bytes.NewReader(tag.Body))
+	return err == nil && (name == "onMetaData" || name == "@setDataFrame")
+}
+
+// IsKeyFrame 是否为视频关键帧(不含sequence header)
+func IsKeyFrame(tag *flv.TagInfo) bool {
+	return tag.TagType == flv.VIDEO_TAG && len(tag.Body) > 1 && tag.Body[0]>>4 == 1 && !IsSequenceHeader(tag)
+}
+
+// IsSequenceHeader 是否为AVC/HEVC sequence header或AAC sequence header
+func IsSequenceHeader(tag *flv.TagInfo) bool {
+	if len(tag.Body) < 2 || tag.Body[1] != 0 {
+		return false
+	}
+	switch tag.TagType {
+	case flv.VIDEO_TAG:
+		codecID := tag.Body[0] & 0x0f
+		return codecID == 7 || codecID == 12
+	case flv.AUDIO_TAG:
+		return tag.Body[0]>>4 == 10
+	}
+	return false
+}
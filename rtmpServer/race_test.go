@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package rtmpServer
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,108 @@
+package rtmpServer
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	rtmp "github.com/zhangpeihao/gortmp"
+)
+
+// Server 最小化的rtmp服务器：支持publish推流和play拉流，可运行在任意net.Conn上(tcp/tls/quicConn.QuicConn)
+type Server struct {
+	GopCache         bool // 新的播放者是否先收到最近一个GOP
+	MaxGopTags       int  // GOP缓存的最大tag数
+	SubscriberBuffer int  // 每个播放者的tag缓冲数，满了之后断开该播放者
+	HandshakeTimeout time.Duration
+
+	lock    sync.Mutex
+	streams map[string]*liveStream
+}
+
+func NewServer() *Server {
+	return &Server{
+		GopCache:         true,
+		MaxGopTags:       4096,
+		SubscriberBuffer: 1024,
+		HandshakeTimeout: time.Second * 10,
+		streams:          make(map[string]*liveStream),
+	}
+}
+
+// Serve 循环accept，直到listener被关闭
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn 在一个连接上完成握手，并处理后续的rtmp消息
+func (s *Server) ServeConn(c net.Conn) {
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+	if err := rtmp.SHandshake(c, br, bw, s.HandshakeTimeout); err != nil {
+		log.Printf("rtmp.SHandshake failed, remote:%v, err:%v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	newSession(s, c, br, bw)
+}
+
+// Subscribe 在进程内订阅一路流，key为"app/streamName"。流还未推上来时也可以订阅
+func (s *Server) Subscribe(key string) *Subscriber {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.getStream(key).addSubscriber(s.SubscriberBuffer)
+}
+
+// Publish 在进程内推一路流，key为"app/streamName"，同一路流同时只能有一个推流者
+func (s *Server) Publish(key string) (*Publisher, error) {
+	stream, ok := s.startPublish(key)
+	if !ok {
+		return nil, fmt.Errorf("stream is publishing, key:%s", key)
+	}
+	return &Publisher{stream: stream}, nil
+}
+
+// StreamKey 由app和streamName生成流的key，忽略streamName中的参数
+func StreamKey(app string, streamName string) string {
+	if index := strings.Index(streamName, "?"); index >= 0 {
+		streamName = streamName[:index]
+	}
+	return strings.Trim(app, "/") + "/" + streamName
+}
+
+// startPublish 查找或创建流并开始推流，已经有推流者时返回false
+func (s *Server) startPublish(key string) (*liveStream, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stream := s.getStream(key)
+	return stream, stream.startPublish()
+}
+
+// getStream 查找或创建流，需要持有s.lock并在释放之前完成订阅或推流，
+// 否则空闲的流可能在这之间被releaseStream删除
+func (s *Server) getStream(key string) *liveStream {
+	stream, found := s.streams[key]
+	if !found {
+		stream = newLiveStream(s, key)
+		s.streams[key] = stream
+	}
+	return stream
+}
+
+func (s *Server) releaseStream(stream *liveStream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.streams[stream.key] == stream && stream.idle() {
+		delete(s.streams, stream.key)
+	}
+}
@@ -0,0 +1,150 @@
+package rtmpServer
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	amf "github.com/zhangpeihao/goamf"
+	"quic_demo/flv"
+	"quic_demo/rtmp"
+)
+
+// writeTestFlv 生成一个2秒的flv文件：metadata、AVC/AAC sequence header，视频25fps每秒一个关键帧，音频50个tag每秒
+func writeTestFlv(t *testing.T) string {
+	buf := &bytes.Buffer{}
+	if err := flv.WriteHeader(buf, true, true); err != nil {
+		t.Fatal(err)
+	}
+	metaData := &bytes.Buffer{}
+	amf.WriteString(metaData, "onMetaData")
+	amf.WriteObject(metaData, amf.Object{"duration": 2.0})
+	tags := []*flv.TagInfo{
+		{TagType: flv.SCRIPT_DATA_TAG, Body: metaData.Bytes()},
+		{TagType: flv.VIDEO_TAG, Body: []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f, 0xff, 0xe1}},
+		{TagType: flv.AUDIO_TAG, Body: []byte{0xaf, 0, 0x12, 0x10}},
+	}
+	for ts := uint32(0); ts < 2000; ts += 20 {
+		if ts%40 == 0 {
+			frameType := byte(0x27)
+			if ts%1000 == 0 {
+				frameType = 0x17
+			}
+			tags = append(tags, &flv.TagInfo{TagType: flv.VIDEO_TAG, Timestamp: ts, Body: []byte{frameType, 1, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88}})
+		}
+		tags = append(tags, &flv.TagInfo{TagType: flv.AUDIO_TAG, Timestamp: ts, Body: []byte{0xaf, 1, 0x21, 0x10}})
+	}
+	for _, tag := range tags {
+		if err := flv.WriteTag(buf, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileName := filepath.Join(t.TempDir(), "test.flv")
+	if err := os.WriteFile(fileName, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// raceEnabled -race时为true，gortmp的收发协程之间有数据竞争，这时跳过需要gortmp客户端的测试
+var raceEnabled = false
+
+func (s *Server) subscribers(key string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stream, found := s.streams[key]
+	if !found {
+		return 0
+	}
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	return len(stream.subscribers)
+}
+
+// TestPublishPlay 在进程内通过tcp推流和播放，播放先于推流开始
+func TestPublishPlay(t *testing.T) {
+	if raceEnabled {
+		t.Skip("gortmp client is not race free")
+	}
+	fileName := writeTestFlv(t)
+	server := NewServer()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+	tcUrl := "rtmp://" + listener.Addr().String() + "/live"
+
+	playConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer playConn.Close()
+	received := make(chan uint8, 1024)
+	player := rtmp.NewRtmpPlay(playConn, "", tcUrl, "test")
+	player.StatsIntervalMs = 0
+	player.OnTag = func(tagType uint8, timestamp uint32, body []byte) {
+		select {
+		case received <- tagType:
+		default:
+		}
+	}
+	go player.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.subscribers("live/test") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("player did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	publishConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publishConn.Close()
+	publisher := rtmp.NewRtmpPublisher(publishConn, fileName, tcUrl, "test")
+	publisher.StatsIntervalMs = 0
+	go publisher.Start()
+
+	counts := make(map[uint8]int)
+	timeout := time.After(10 * time.Second)
+	for counts[flv.SCRIPT_DATA_TAG] == 0 || counts[flv.VIDEO_TAG] < 10 || counts[flv.AUDIO_TAG] < 20 {
+		select {
+		case tagType := <-received:
+			counts[tagType]++
+		case <-timeout:
+			t.Fatalf("not enough tags received, counts:%v", counts)
+		}
+	}
+}
+
+// TestSubscribeRelease 订阅和释放并发时，订阅者所在的流始终是server中登记的那一路
+func TestSubscribeRelease(t *testing.T) {
+	server := NewServer()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20000; j++ {
+				subscriber := server.Subscribe("live/test")
+				server.lock.Lock()
+				registered := server.streams["live/test"]
+				server.lock.Unlock()
+				if registered != subscriber.stream {
+					t.Error("subscriber is attached to a released stream")
+					return
+				}
+				subscriber.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,296 @@
+package rtmpServer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"quic_demo/flv"
+	"sync"
+
+	amf "github.com/zhangpeihao/goamf"
+	rtmp "github.com/zhangpeihao/gortmp"
+)
+
+// sessionStream 连接上通过createStream创建的一路流
+type sessionStream struct {
+	id            uint32
+	chunkStreamID uint32
+	publishing    *liveStream
+	subscriber    *Subscriber
+}
+
+// session 一个rtmp连接，实现gortmp.ConnHandler
+type session struct {
+	server *Server
+	conn   rtmp.Conn
+	remote net.Addr
+	app    string
+	ready  chan struct{}
+
+	lock         sync.Mutex
+	streams      map[uint32]*sessionStream
+	nextStreamID uint32
+}
+
+func newSession(server *Server, c net.Conn, br *bufio.Reader, bw *bufio.Writer) *session {
+	s := &session{
+		server:       server,
+		remote:       c.RemoteAddr(),
+		streams:      make(map[uint32]*sessionStream),
+		nextStreamID: 1,
+		ready:        make(chan struct{}),
+	}
+	// NewConn会立即启动读协程，回调中需要等s.conn赋值后再使用
+	s.conn = rtmp.NewConn(c, br, bw, s, 100)
+	close(s.ready)
+	return s
+}
+
+func (s *session) OnReceived(conn rtmp.Conn, message *rtmp.Message) {
+	<-s.ready
+	stream := s.getStream(message.StreamID)
+	if stream == nil {
+		return
+	}
+	switch message.Type {
+	case rtmp.COMMAND_AMF0, rtmp.COMMAND_AMF3:
+		cmd, err := readCommand(message)
+		if err != nil {
+			log.Printf("read stream command failed, remote:%v, err:%v", s.remote, err)
+			return
+		}
+		s.onStreamCommand(stream, cmd)
+	case rtmp.AUDIO_TYPE, rtmp.VIDEO_TYPE, rtmp.DATA_AMF0:
+		if stream.publishing == nil {
+			return
+		}
+		body := make([]byte, message.Buf.Len())
+		copy(body, message.Buf.Bytes())
+		stream.publishing.writeTag(&flv.TagInfo{
+			TagType:   message.Type,
+			DataSize:  uint32(len(body)),
+			Timestamp: message.AbsoluteTimestamp,
+			Body:      body,
+		})
+	}
+}
+
+func (s *session) OnReceivedRtmpCommand(conn rtmp.Conn, command *rtmp.Command) {
+	<-s.ready
+	switch command.Name {
+	case "connect":
+		s.onConnect(command)
+	case "createStream":
+		s.onCreateStream(command)
+	case "deleteStream":
+		if len(command.Objects) >= 2 {
+			if streamID, ok := command.Objects[1].(float64); ok {
+				s.closeStream(uint32(streamID))
+			}
+		}
+	case "releaseStream", "FCPublish", "FCUnpublish", "getStreamLength":
+		s.sendResult(command.TransactionID, nil, nil)
+	}
+}
+
+func (s *session) OnClosed(conn rtmp.Conn) {
+	<-s.ready
+	s.lock.Lock()
+	ids := make([]uint32, 0, len(s.streams))
+	for id := range s.streams {
+		ids = append(ids, id)
+	}
+	s.lock.Unlock()
+	for _, id := range ids {
+		s.closeStream(id)
+	}
+	log.Printf("rtmp session closed, remote:%v", s.remote)
+}
+
+func (s *session) onConnect(command *rtmp.Command) {
+	if len(command.Objects) > 0 {
+		if params, ok := command.Objects[0].(amf.Object); ok {
+			s.app, _ = params["app"].(string)
+		}
+	}
+	log.Printf("rtmp connect, remote:%v, app:%s", s.remote, s.app)
+	s.conn.SetWindowAcknowledgementSize()
+	s.conn.SetPeerBandwidth(2500000, rtmp.SET_PEER_BANDWIDTH_DYNAMIC)
+	s.conn.SetChunkSize(4096)
+	s.sendResult(command.TransactionID, amf.Object{
+		"fmsVer":       fmt.Sprintf("FMS/%s", rtmp.FMS_VERSION_STRING),
+		"capabilities": float64(255),
+	}, amf.Object{
+		"level":       "status",
+		"code":        rtmp.RESULT_CONNECT_OK,
+		"description": rtmp.RESULT_CONNECT_OK_DESC,
+	})
+}
+
+func (s *session) onCreateStream(command *rtmp.Command) {
+	chunkStream, err := s.conn.CreateMediaChunkStream()
+	if err != nil {
+		log.Printf("CreateMediaChunkStream failed, remote:%v, err:%v", s.remote, err)
+		return
+	}
+	s.lock.Lock()
+	stream := &sessionStream{
+		id:            s.nextStreamID,
+		chunkStreamID: chunkStream.ID,
+	}
+	s.streams[stream.id] = stream
+	s.nextStreamID++
+	s.lock.Unlock()
+	s.sendResult(command.TransactionID, nil, float64(stream.id))
+}
+
+func (s *session) onStreamCommand(stream *sessionStream, cmd *rtmp.Command) {
+	switch cmd.Name {
+	case "publish":
+		streamName, _ := commandString(cmd, 1)
+		key := StreamKey(s.app, streamName)
+		live, ok := s.server.startPublish(key)
+		if !ok {
+			log.Printf("stream is publishing, remote:%v, key:%s", s.remote, key)
+			s.sendStatus(stream, "error", "NetStream.Publish.BadName", "stream is publishing")
+			return
+		}
+		stream.publishing = live
+		log.Printf("rtmp publish, remote:%v, key:%s", s.remote, key)
+		s.sendStatus(stream, "status", rtmp.NETSTREAM_PUBLISH_START, fmt.Sprintf("%s is now published", streamName))
+	case "play":
+		streamName, _ := commandString(cmd, 1)
+		key := StreamKey(s.app, streamName)
+		log.Printf("rtmp play, remote:%v, key:%s", s.remote, key)
+		s.sendUserControl(rtmp.EVENT_STREAM_BEGIN, stream.id)
+		s.sendStatus(stream, "status", rtmp.NETSTREAM_PLAY_RESET, fmt.Sprintf("playing and resetting %s", streamName))
+		s.sendStatus(stream, "status", rtmp.NETSTREAM_PLAY_START, fmt.Sprintf("started playing %s", streamName))
+		sampleAccess := rtmp.NewMessage(stream.chunkStreamID, rtmp.DATA_AMF0, stream.id, 0, nil)
+		amf.WriteString(sampleAccess.Buf, "|RtmpSampleAccess")
+		amf.WriteBoolean(sampleAccess.Buf, false)
+		amf.WriteBoolean(sampleAccess.Buf, false)
+		s.conn.Send(sampleAccess)
+
+		stream.subscriber = s.server.Subscribe(key)
+		go s.playLoop(stream, stream.subscriber)
+	case "closeStream", "deleteStream":
+		s.closeStream(stream.id)
+	}
+}
+
+func (s *session) playLoop(stream *sessionStream, subscriber *Subscriber) {
+	for tag := range subscriber.Tags {
+		message := rtmp.NewMessage(stream.chunkStreamID, tag.TagType, stream.id, tag.Timestamp, tag.Body)
+		if err := s.conn.Send(message); err != nil {
+			subscriber.Close()
+			return
+		}
+	}
+}
+
+func (s *session) getStream(id uint32) *sessionStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *session) closeStream(id uint32) {
+	s.lock.Lock()
+	stream, found := s.streams[id]
+	delete(s.streams, id)
+	s.lock.Unlock()
+	if !found {
+		return
+	}
+	if stream.publishing != nil {
+		stream.publishing.stopPublish()
+	}
+	if stream.subscriber != nil {
+		stream.subscriber.Close()
+	}
+}
+
+func (s *session) sendResult(transactionID uint32, objects ...interface{}) {
+	cmd := &rtmp.Command{
+		Name:          "_result",
+		TransactionID: transactionID,
+		Objects:       objects,
+	}
+	buf := new(bytes.Buffer)
+	if err := cmd.Write(buf); err != nil {
+		log.Printf("write _result failed, err:%v", err)
+		return
+	}
+	s.conn.Send(&rtmp.Message{
+		ChunkStreamID: rtmp.CS_ID_COMMAND,
+		Type:          rtmp.COMMAND_AMF0,
+		Size:          uint32(buf.Len()),
+		Buf:           buf,
+	})
+}
+
+func (s *session) sendStatus(stream *sessionStream, level string, code string, description string) {
+	cmd := &rtmp.Command{
+		Name: "onStatus",
+		Objects: []interface{}{nil, amf.Object{
+			"level":       level,
+			"code":        code,
+			"description": description,
+		}},
+	}
+	message := rtmp.NewMessage(rtmp.CS_ID_COMMAND, rtmp.COMMAND_AMF0, stream.id, 0, nil)
+	if err := cmd.Write(message.Buf); err != nil {
+		log.Printf("write onStatus failed, err:%v", err)
+		return
+	}
+	message.Size = uint32(message.Buf.Len())
+	s.conn.Send(message)
+}
+
+func (s *session) sendUserControl(event uint16, streamID uint32) {
+	message := rtmp.NewMessage(rtmp.CS_ID_PROTOCOL_CONTROL, rtmp.USER_CONTROL_MESSAGE, 0, 0, nil)
+	binary.Write(message.Buf, binary.BigEndian, event)
+	binary.Write(message.Buf, binary.BigEndian, streamID)
+	message.Size = uint32(message.Buf.Len())
+	s.conn.Send(message)
+}
+
+// readCommand 解析流上的命令消息(publish/play等)
+func readCommand(message *rtmp.Message) (*rtmp.Command, error) {
+	cmd := &rtmp.Command{}
+	if message.Type == rtmp.COMMAND_AMF3 {
+		cmd.IsFlex = true
+		if _, err := message.Buf.ReadByte(); err != nil {
+			return nil, fmt.Errorf("read flex byte failed, err:%v", err)
+		}
+	}
+	var err error
+	cmd.Name, err = amf.ReadString(message.Buf)
+	if err != nil {
+		return nil, fmt.Errorf("read command name failed, err:%v", err)
+	}
+	transactionID, err := amf.ReadDouble(message.Buf)
+	if err != nil {
+		return nil, fmt.Errorf("read transaction id failed, err:%v", err)
+	}
+	cmd.TransactionID = uint32(transactionID)
+	for message.Buf.Len() > 0 {
+		object, err := amf.ReadValue(message.Buf)
+		if err != nil {
+			return nil, fmt.Errorf("read command object failed, err:%v", err)
+		}
+		cmd.Objects = append(cmd.Objects, object)
+	}
+	return cmd, nil
+}
+
+func commandString(cmd *rtmp.Command, index int) (string, bool) {
+	if len(cmd.Objects) <= index {
+		return "", false
+	}
+	value, ok := cmd.Objects[index].(string)
+	return value, ok
+}
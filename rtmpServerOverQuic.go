@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"github.com/lucas-clemente/quic-go"
+	"log"
+	"quic_demo/quicConn"
+	"quic_demo/quicFlv"
+	"quic_demo/rtmpServer"
+	"time"
+)
+
+func main() {
+
+	var quicAddr string
+	var tlsAddr string
+	var tcpAddr string
+	var certFile string
+	var keyFile string
+	var versions string
+	var alpn string
+	var qlogDir string
+	var gopCache bool
+	var dgramAddr string
+	var dgramReliableKeyframes bool
+	var dgramMaxDelay time.Duration
+	flag.StringVar(&quicAddr, "quicAddr", ":443", "rtmp over quic listen addr, empty to disable")
+	flag.StringVar(&tlsAddr, "tlsAddr", ":8443", "rtmps listen addr, empty to disable")
+	flag.StringVar(&tcpAddr, "tcpAddr", ":1935", "rtmp listen addr, empty to disable")
+	flag.StringVar(&certFile, "cert", "", "cert file, self-signed if empty")
+	flag.StringVar(&keyFile, "key", "", "key file")
+	flag.StringVar(&versions, "versions", "v1,draft29", "supported quic versions, comma separated")
+	flag.StringVar(&alpn, "alpn", quicConn.RtmpOverQuicAlpn, "tls alpn, comma separated")
+	flag.StringVar(&qlogDir, "qlogDir", "", "write a qlog file per quic session into this dir, empty to disable")
+	flag.BoolVar(&gopCache, "gopCache", true, "send the latest gop to new players")
+	flag.StringVar(&dgramAddr, "dgramAddr", "", "flv over quic (datagram, stream per gop or per frame) listen addr, empty to disable")
+	flag.BoolVar(&dgramReliableKeyframes, "dgramReliableKeyframes", true, "send keyframes on the reliable stream in datagram mode")
+	flag.DurationVar(&dgramMaxDelay, "dgramMaxDelay", 150*time.Millisecond, "how long the server waits for a missing tag from a datagram or stream publisher before skipping it")
+	flag.Parse()
+
+	tlsConfig, err := quicConn.LoadServerTlsConfig(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("quicConn.LoadServerTlsConfig err:%v", err)
+	}
+
+	quicVersions, err := quicConn.ParseVersions(versions)
+	if err != nil {
+		log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+	}
+	tlsConfig.NextProtos = quicConn.ParseAlpn(alpn)
+	tracer := quicConn.NewTracer()
+	tracer.QlogDir = qlogDir
+	quicConfig := &quic.Config{
+		Versions: quicVersions,
+		Tracer:   tracer,
+	}
+
+	listener := quicConn.NewListener()
+	defer listener.Close()
+	for network, addr := range map[string]string{"quic": quicAddr, "tls": tlsAddr, "tcp": tcpAddr} {
+		if addr == "" {
+			continue
+		}
+		if err := listener.Listen(network, addr, tlsConfig, quicConfig); err != nil {
+			log.Fatalf("listener.Listen err:%v", err)
+		}
+		log.Printf("listen %s on %s", network, addr)
+	}
+
+	server := rtmpServer.NewServer()
+	server.GopCache = gopCache
+	if dgramAddr != "" {
+		dgramServer := quicFlv.NewServer(server)
+		dgramServer.ReliableKeyframes = dgramReliableKeyframes
+		dgramServer.MaxDelay = dgramMaxDelay
+		go func() {
+			log.Fatalf("dgramServer.ListenAndServe err:%v", dgramServer.ListenAndServe(dgramAddr, tlsConfig, quicConfig))
+		}()
+		log.Printf("listen quic flv on %s", dgramAddr)
+	}
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("server.Serve err:%v", err)
+	}
+}
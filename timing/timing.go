@@ -0,0 +1,246 @@
+package timing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 建连各阶段的名称，tcp+tls和quic使用相同的名称，便于逐阶段对比
+const (
+	PhaseDns                = "dns"
+	PhaseTcpConnect         = "tcp_connect"
+	PhaseQuicHandshake      = "quic_handshake" // quic的tls握手包含在其中
+	PhaseTlsHandshake       = "tls_handshake"
+	PhaseRtmpHandshake      = "rtmp_handshake"
+	PhaseRtmpConnect        = "rtmp_connect"
+	PhaseCreateStream       = "create_stream"
+	PhasePublishStart       = "publish_start"
+	PhasePlayStart          = "play_start"
+	PhaseHttpTtfb           = "http_ttfb"
+	PhaseFlvHeader          = "first_flv_header"
+	PhaseFirstAudio         = "first_audio_tag"
+	PhaseFirstVideoKeyframe = "first_video_keyframe"
+)
+
+const reportPrefix = "timing "
+
+// Phase 一个阶段，时间都是相对Recorder.Begin的毫秒数
+type Phase struct {
+	Name       string  `json:"name"`
+	StartMs    float64 `json:"start_ms"`
+	EndMs      float64 `json:"end_ms"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// Recorder 记录一次连接各阶段的耗时，nil的Recorder可以直接调用，不做任何记录
+type Recorder struct {
+	Transport string
+	Begin     time.Time
+
+	lock   sync.Mutex
+	starts map[string]time.Time
+	phases []Phase
+	dones  map[string]chan struct{}
+}
+
+func NewRecorder(transport string) *Recorder {
+	return &Recorder{
+		Transport: transport,
+		Begin:     time.Now(),
+		starts:    make(map[string]time.Time),
+		dones:     make(map[string]chan struct{}),
+	}
+}
+
+// Start 阶段开始，同一阶段重复调用以第一次为准
+func (r *Recorder) Start(name string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.starts[name]; !ok {
+		r.starts[name] = time.Now()
+	}
+}
+
+// End 阶段结束，没有调用过Start时从Begin开始算，同一阶段只记录一次
+func (r *Recorder) End(name string) {
+	if r == nil {
+		return
+	}
+	r.endAt(name, time.Now())
+}
+
+func (r *Recorder) endAt(name string, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, phase := range r.phases {
+		if phase.Name == name {
+			return
+		}
+	}
+	start, ok := r.starts[name]
+	if !ok {
+		start = r.Begin
+	}
+	r.phases = append(r.phases, Phase{
+		Name:       name,
+		StartMs:    r.sinceBegin(start),
+		EndMs:      r.sinceBegin(now),
+		DurationMs: float64(now.Sub(start)) / float64(time.Millisecond),
+	})
+	close(r.done(name))
+}
+
+// Done 返回的chan在阶段完成时关闭，用于等待启动完成后输出
+func (r *Recorder) Done(name string) <-chan struct{} {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.done(name)
+}
+
+// Wait 等待阶段完成，超时返回false
+func (r *Recorder) Wait(name string, timeout time.Duration) bool {
+	if r == nil {
+		return false
+	}
+	select {
+	case <-r.Done(name):
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (r *Recorder) done(name string) chan struct{} {
+	done, ok := r.dones[name]
+	if !ok {
+		done = make(chan struct{})
+		r.dones[name] = done
+	}
+	return done
+}
+
+// AddPhase 直接添加一个已经完成的阶段，如在Recorder创建之前做的dns解析
+func (r *Recorder) AddPhase(name string, start time.Time, end time.Time) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	if _, ok := r.starts[name]; !ok {
+		r.starts[name] = start
+	}
+	r.lock.Unlock()
+	r.endAt(name, end)
+}
+
+// Mark 记录一个时间点，如收到第一个音频tag，耗时从Begin开始算
+func (r *Recorder) Mark(name string) {
+	r.End(name)
+}
+
+// MarkTag 根据flv tag记录第一个音频tag和第一个视频关键帧
+func (r *Recorder) MarkTag(tagType uint8, body []byte) {
+	if r == nil {
+		return
+	}
+	if len(body) == 0 {
+		return
+	}
+	switch tagType {
+	case 8:
+		// 跳过aac sequence header
+		if body[0]>>4 == 10 && (len(body) < 2 || body[1] == 0) {
+			return
+		}
+		r.Mark(PhaseFirstAudio)
+	case 9:
+		// 视频tag第一个字节高4位为帧类型，1为关键帧；avc/hevc跳过sequence header
+		if body[0]>>4 != 1 {
+			return
+		}
+		if codecId := body[0] & 0x0f; (codecId == 7 || codecId == 12) && (len(body) < 2 || body[1] != 1) {
+			return
+		}
+		r.Mark(PhaseFirstVideoKeyframe)
+	}
+}
+
+// Phases 按结束时间顺序返回已完成的阶段
+func (r *Recorder) Phases() []Phase {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Phase(nil), r.phases...)
+}
+
+// Has 阶段是否已经完成
+func (r *Recorder) Has(name string) bool {
+	_, ok := r.Get(name)
+	return ok
+}
+
+// Get 返回已经完成的阶段
+func (r *Recorder) Get(name string) (Phase, bool) {
+	for _, phase := range r.Phases() {
+		if phase.Name == name {
+			return phase, true
+		}
+	}
+	return Phase{}, false
+}
+
+func (r *Recorder) sinceBegin(t time.Time) float64 {
+	return float64(t.Sub(r.Begin)) / float64(time.Millisecond)
+}
+
+// Report Print输出的内容
+type Report struct {
+	Transport string  `json:"transport"`
+	BeginMs   int64   `json:"begin_ms"`
+	Phases    []Phase `json:"phases"`
+}
+
+// ParseReport 解析Print输出的一行，不是timing行时返回false
+func ParseReport(line string) (*Report, bool) {
+	if !strings.HasPrefix(line, reportPrefix) {
+		return nil, false
+	}
+	report := &Report{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, reportPrefix)), report); err != nil {
+		return nil, false
+	}
+	return report, true
+}
+
+// MarshalJSON 输出{"transport":..., "begin_ms":..., "phases":[...]}
+func (r *Recorder) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Report{
+		Transport: r.Transport,
+		BeginMs:   r.Begin.UnixNano() / 1e6,
+		Phases:    r.Phases(),
+	})
+}
+
+// Print 以一行json输出，前缀"timing "便于从日志中过滤
+func (r *Recorder) Print(writer io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "%s%s\n", reportPrefix, data)
+	return err
+}
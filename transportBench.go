@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"quic_demo/analytics"
+	"quic_demo/bench"
+	"quic_demo/flv"
+	"quic_demo/httpFlv"
+	"quic_demo/impair"
+	"quic_demo/moq"
+	"quic_demo/quicConn"
+	"quic_demo/quicFlv"
+	"quic_demo/rtmp"
+	"quic_demo/rtmpServer"
+	"quic_demo/timing"
+	"strings"
+	"time"
+)
+
+// protocolMoq 推流和播放都经过进程内的MoQ relay，只能跑在quic上
+const protocolMoq = "moq"
+
+// benchServers 进程内的rtmp和http-flv服务，key为传输层(tcp/tls/quic)，
+// 以及只能跑在quic上的quicFlv服务(datagram、按GOP或按帧分流)和MoQ relay
+type benchServers struct {
+	rtmpAddrs   map[string]string
+	httpAddrs   map[string]string
+	quicFlvAddr string
+	moqAddr     string
+	quicConfig  *quic.Config
+}
+
+// benchRun 一次运行的参数
+type benchRun struct {
+	protocol  string
+	transport string
+	run       int
+	fileName  string
+	duration  time.Duration
+	warmup    time.Duration
+	stallGap  time.Duration
+	maxDelay  time.Duration
+	player    analytics.PlayerOptions
+	impair    impair.Config
+	seed      int64
+}
+
+func main() {
+
+	var fileName string
+	var transports string
+	var protocols string
+	var repeat int
+	var duration time.Duration
+	var warmup time.Duration
+	var stallGap time.Duration
+	var maxDelay time.Duration
+	var versions string
+	var seed int64
+	var jsonFile string
+	var mdFile string
+	flag.StringVar(&fileName, "fileName", "", "flv file to publish")
+	flag.StringVar(&transports, "transports", "tcp,tls,quic", "transports to compare, comma separated")
+	flag.StringVar(&protocols, "protocols", "rtmp,httpflv", "play protocols, rtmp, httpflv, datagram, gop, frame or moq, comma separated. datagram, gop, frame and moq only run on quic")
+	flag.IntVar(&repeat, "repeat", 3, "runs of each protocol and transport")
+	flag.DurationVar(&duration, "duration", 20*time.Second, "play duration of each run")
+	flag.DurationVar(&warmup, "warmup", 2*time.Second, "wait after publish start before playing")
+	flag.DurationVar(&stallGap, "stallGap", 500*time.Millisecond, "a video tag later than its timestamp gap by more than this is a stall")
+	flag.DurationVar(&maxDelay, "maxDelay", 150*time.Millisecond, "how long datagram, gop and frame players wait for a missing tag, and moq players for an old group, before skipping it")
+	flag.StringVar(&versions, "versions", "v1", "quic versions")
+	flag.Int64Var(&seed, "seed", 1, "impairment random seed, each run uses seed+run so every transport sees the same sequence")
+	flag.StringVar(&jsonFile, "json", "bench.json", "json report file, empty to disable")
+	flag.StringVar(&mdFile, "markdown", "bench.md", "markdown report file, empty to disable")
+	var playerOptions analytics.PlayerOptions
+	playerOptions.AddFlags()
+	var impairFlags impair.Flags
+	impairFlags.AddFlags()
+	flag.Parse()
+	if fileName == "" || repeat <= 0 {
+		log.Fatalln("fileName == \"\" || repeat <= 0")
+	}
+
+	impairConfig, err := impairFlags.Config()
+	if err != nil {
+		log.Fatalf("impairFlags.Config err:%v", err)
+	}
+	quicVersions, err := quicConn.ParseVersions(versions)
+	if err != nil {
+		log.Fatalf("quicConn.ParseVersions failed, err:%v", err)
+	}
+	servers, err := startBenchServers(&quic.Config{Versions: quicVersions})
+	if err != nil {
+		log.Fatalf("startBenchServers err:%v", err)
+	}
+
+	report := &bench.Report{
+		FileName: fileName,
+		Duration: duration.String(),
+		Repeat:   repeat,
+		Begin:    time.Now(),
+	}
+	if impairConfig.Enabled() {
+		report.Impair = fmt.Sprintf("%+v", impairFlags)
+	}
+	// 按轮次交替运行各传输层，避免机器负载随时间变化影响对比
+	for run := 1; run <= repeat; run++ {
+		for _, protocol := range strings.Split(protocols, ",") {
+			protocol = strings.TrimSpace(protocol)
+			for _, transport := range strings.Split(transports, ",") {
+				transport = strings.TrimSpace(transport)
+				if _, err := quicFlv.ParseMode(protocol); (err == nil || protocol == protocolMoq) && transport != "quic" {
+					continue
+				}
+				result := servers.run(&benchRun{
+					protocol:  protocol,
+					transport: transport,
+					run:       run,
+					fileName:  fileName,
+					duration:  duration,
+					warmup:    warmup,
+					stallGap:  stallGap,
+					maxDelay:  maxDelay,
+					player:    playerOptions,
+					impair:    impairConfig,
+					seed:      seed + int64(run),
+				})
+				log.Printf("bench run done, protocol:%s, transport:%s, run:%d, %+v, err:%s",
+					result.Protocol, result.Transport, result.Run, result.Metrics, result.Error)
+				report.AddResult(result)
+			}
+		}
+	}
+	report.Summarize()
+
+	if jsonFile != "" {
+		if err := writeReport(jsonFile, report.WriteJson); err != nil {
+			log.Fatalf("write json report failed, err:%v", err)
+		}
+	}
+	if mdFile != "" {
+		if err := writeReport(mdFile, report.WriteMarkdown); err != nil {
+			log.Fatalf("write markdown report failed, err:%v", err)
+		}
+	}
+	report.WriteMarkdown(os.Stdout)
+}
+
+func writeReport(fileName string, write func(w io.Writer) error) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// startBenchServers 在本机随机端口上启动rtmp(tcp/tls/quic)和http-flv(http/1.1、http/2、http/3)服务，
+// http-flv的流来自同一个rtmp服务器
+func startBenchServers(quicConfig *quic.Config) (*benchServers, error) {
+	tlsConfig, err := quicConn.LoadServerTlsConfig("", "")
+	if err != nil {
+		return nil, err
+	}
+	servers := &benchServers{
+		rtmpAddrs:  make(map[string]string),
+		httpAddrs:  make(map[string]string),
+		quicConfig: quicConfig,
+	}
+
+	server := rtmpServer.NewServer()
+	for _, network := range []string{"tcp", "tls", "quic"} {
+		listener, err := quicConn.Listen(network, "127.0.0.1:0", tlsConfig.Clone(), quicConfig)
+		if err != nil {
+			return nil, err
+		}
+		go server.Serve(listener)
+		servers.rtmpAddrs[network] = listener.Addr().String()
+	}
+
+	handler := &httpFlv.Handler{Source: &httpFlv.RtmpSource{Server: server}}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(tcpListener, handler)
+	servers.httpAddrs["tcp"] = tcpListener.Addr().String()
+
+	tlsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	tlsServer := &http.Server{Handler: handler, TLSConfig: tlsConfig.Clone()}
+	go tlsServer.ServeTLS(tlsListener, "", "")
+	servers.httpAddrs["tls"] = tlsListener.Addr().String()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h3Server := &http3.Server{
+		Server:     &http.Server{Handler: handler, TLSConfig: tlsConfig.Clone()},
+		QuicConfig: quicConfig,
+	}
+	go h3Server.Serve(udpConn)
+	servers.httpAddrs["quic"] = udpConn.LocalAddr().String()
+
+	quicFlvListener, err := quicFlv.Listen("127.0.0.1:0", tlsConfig, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	go quicFlv.NewServer(server).Serve(quicFlvListener)
+	servers.quicFlvAddr = quicFlvListener.Addr().String()
+
+	moqListener, err := moq.Listen("127.0.0.1:0", tlsConfig, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	go moq.NewRelay().Serve(moqListener)
+	servers.moqAddr = moqListener.Addr().String()
+
+	log.Printf("bench servers, rtmp:%v, http-flv:%v, quic flv:%s, moq:%s",
+		servers.rtmpAddrs, servers.httpAddrs, servers.quicFlvAddr, servers.moqAddr)
+	return servers, nil
+}
+
+// impairAddr 配置了损伤时在target前面启动一个代理，返回客户端应连接的地址
+func (s *benchServers) impairAddr(b *benchRun, target string, index int64) (string, func(), error) {
+	if !b.impair.Enabled() {
+		return target, func() {}, nil
+	}
+	upConfig, downConfig := b.impair, b.impair
+	upConfig.Seed = b.seed*10 + index*2
+	downConfig.Seed = b.seed*10 + index*2 + 1
+	up, down := impair.NewLink(upConfig), impair.NewLink(downConfig)
+	if b.transport == "quic" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return "", nil, err
+		}
+		go impair.NewUdpProxy("", target, up, down).ServePacketConn(conn)
+		return conn.LocalAddr().String(), func() { conn.Close() }, nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	go impair.NewTcpProxy("", target, up, down).ServeListener(listener)
+	return listener.Addr().String(), func() { listener.Close() }, nil
+}
+
+func (s *benchServers) dialRtmp(transport string, addr string) (net.Conn, error) {
+	switch transport {
+	case "tcp":
+		return net.DialTimeout("tcp", addr, 10*time.Second)
+	case "tls":
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	case "quic":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		session, err := quic.DialAddrContext(ctx, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{quicConn.RtmpOverQuicAlpn},
+		}, s.quicConfig)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.OpenStreamSync(ctx)
+		if err != nil {
+			session.CloseWithError(quicConn.CodeInternalError, err.Error())
+			return nil, err
+		}
+		return quicConn.NewQuicConn(session, stream), nil
+	}
+	return nil, fmt.Errorf("unknown transport:%s", transport)
+}
+
+// run 推流，预热后播放duration，返回这次播放的结果
+func (s *benchServers) run(b *benchRun) bench.RunResult {
+	result := bench.RunResult{Protocol: b.protocol, Transport: b.transport, Run: b.run}
+	if _, ok := s.rtmpAddrs[b.transport]; !ok {
+		result.Error = fmt.Sprintf("unknown transport:%s", b.transport)
+		return result
+	}
+	tracker := bench.NewTracker(b.stallGap)
+	tracker.Player = b.player
+	streamName := fmt.Sprintf("bench_%s_%s_%d", b.protocol, b.transport, b.run)
+	tcUrl := "rtmp://127.0.0.1/live"
+
+	var stopPublish func()
+	var err error
+	if b.protocol == protocolMoq {
+		stopPublish, err = s.publishMoq(b, streamName, tracker)
+	} else {
+		stopPublish, err = s.publishRtmp(b, tcUrl, streamName, tracker)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer stopPublish()
+	time.Sleep(b.warmup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.duration)
+	defer cancel()
+	tracker.Begin()
+	switch b.protocol {
+	case "rtmp":
+		err = s.playRtmp(b, tcUrl, streamName, tracker)
+	case "httpflv":
+		err = s.playHttpFlv(ctx, b, streamName, tracker)
+	case quicFlv.ModeDatagram, quicFlv.ModeGop, quicFlv.ModeFrame:
+		err = s.playQuicFlv(ctx, b, streamName, tracker)
+	case protocolMoq:
+		err = s.playMoq(ctx, b, streamName, tracker)
+	default:
+		err = fmt.Errorf("unknown protocol:%s", b.protocol)
+	}
+	result.Metrics = tracker.Metrics()
+	if err != nil {
+		result.Error = err.Error()
+	} else if result.StartupMs == 0 {
+		result.Error = "no video keyframe received"
+	}
+	return result
+}
+
+// publishRtmp 用RtmpPublisher推流，等到publish start后返回，返回的函数停止推流
+func (s *benchServers) publishRtmp(b *benchRun, tcUrl string, streamName string, tracker *bench.Tracker) (func(), error) {
+	publishAddr, closePublishProxy, err := s.impairAddr(b, s.rtmpAddrs[b.transport], 0)
+	if err != nil {
+		return nil, err
+	}
+	publishConn, err := s.dialRtmp(b.transport, publishAddr)
+	if err != nil {
+		closePublishProxy()
+		return nil, fmt.Errorf("publish dial failed, err:%v", err)
+	}
+	publisher := rtmp.NewRtmpPublisher(publishConn, b.fileName, tcUrl, streamName)
+	publisher.StatsIntervalMs = 0
+	publisher.Timing = timing.NewRecorder(b.transport)
+	publisher.OnTag = tracker.Sent
+	publishDone := make(chan error, 1)
+	go func() {
+		publishDone <- publisher.Start()
+	}()
+	stop := func() {
+		publishConn.Close()
+		select {
+		case <-publishDone:
+		case <-time.After(5 * time.Second):
+		}
+		closePublishProxy()
+	}
+	select {
+	case <-publisher.Timing.Done(timing.PhasePublishStart):
+		return stop, nil
+	case err := <-publishDone:
+		stop()
+		return nil, fmt.Errorf("publish failed, err:%v", err)
+	case <-time.After(10 * time.Second):
+		stop()
+		return nil, fmt.Errorf("publish start timeout")
+	}
+}
+
+// publishMoq 按时间戳循环读同一个文件，经MoQ发布到relay，namespace为streamName，track为flv。
+// 发出前调用tracker.Sent，和RtmpPublisher.OnTag的时机一致
+func (s *benchServers) publishMoq(b *benchRun, streamName string, tracker *bench.Tracker) (func(), error) {
+	addr, closeProxy, err := s.impairAddr(b, s.moqAddr, 0)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session, err := moq.Dial(ctx, addr, &tls.Config{InsecureSkipVerify: true}, s.quicConfig, moq.RolePublisher)
+	if err != nil {
+		closeProxy()
+		return nil, fmt.Errorf("publish dial failed, err:%v", err)
+	}
+	writer := moq.NewTagWriter(session.Publish(streamName, "flv"))
+	if err := session.Announce(streamName); err != nil {
+		session.Close()
+		closeProxy()
+		return nil, err
+	}
+	tags, cancelSource, err := (&httpFlv.FileSource{FileName: b.fileName, Loop: true}).Subscribe(streamName)
+	if err != nil {
+		session.Close()
+		closeProxy()
+		return nil, err
+	}
+	publishDone := make(chan struct{})
+	go func() {
+		defer close(publishDone)
+		for tag := range tags {
+			tracker.Sent(tag.TagType, tag.Timestamp, tag.Body)
+			if err := writer.WriteTag(tag); err != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		cancelSource()
+		<-publishDone
+		writer.Close()
+		session.Close()
+		closeProxy()
+	}, nil
+}
+
+// playRtmp 播放时长由RtmpPlay.DurationMs控制
+func (s *benchServers) playRtmp(b *benchRun, tcUrl string, streamName string, tracker *bench.Tracker) error {
+	addr, closeProxy, err := s.impairAddr(b, s.rtmpAddrs[b.transport], 1)
+	if err != nil {
+		return err
+	}
+	defer closeProxy()
+	conn, err := s.dialRtmp(b.transport, addr)
+	if err != nil {
+		return fmt.Errorf("play dial failed, err:%v", err)
+	}
+	defer conn.Close()
+	player := rtmp.NewRtmpPlay(conn, "", tcUrl, streamName)
+	player.StatsIntervalMs = 0
+	player.DurationMs = int64(b.duration / time.Millisecond)
+	player.OnTag = tracker.Received
+	return player.Start()
+}
+
+func (s *benchServers) playHttpFlv(ctx context.Context, b *benchRun, streamName string, tracker *bench.Tracker) error {
+	addr, closeProxy, err := s.impairAddr(b, s.httpAddrs[b.transport], 1)
+	if err != nil {
+		return err
+	}
+	defer closeProxy()
+
+	insecure := &tls.Config{InsecureSkipVerify: true}
+	var roundTripper http.RoundTripper
+	scheme := "https"
+	switch b.transport {
+	case "tcp":
+		scheme = "http"
+		roundTripper = &http.Transport{DisableKeepAlives: true}
+	case "tls":
+		roundTripper = &http.Transport{TLSClientConfig: insecure, ForceAttemptHTTP2: true, DisableKeepAlives: true}
+	case "quic":
+		h3RoundTripper := &http3.RoundTripper{TLSClientConfig: insecure, QuicConfig: s.quicConfig}
+		defer h3RoundTripper.Close()
+		roundTripper = h3RoundTripper
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/live/%s.flv", scheme, addr, streamName), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: roundTripper}).Do(req)
+	if err != nil {
+		return fmt.Errorf("http request failed, err:%v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status:%d", resp.StatusCode)
+	}
+	flvParse, err := flv.NewFlvParse(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("flv.NewFlvParse failed, err:%v", err)
+	}
+	for {
+		tag, err := flvParse.ReadTag()
+		if err != nil {
+			if ctx.Err() != nil {
+				// 播放时长到了
+				return nil
+			}
+			return fmt.Errorf("flvParse.ReadTag failed, err:%v", err)
+		}
+		tracker.Received(tag.TagType, tag.Timestamp, tag.Body)
+	}
+}
+
+// playQuicFlv 以datagram、按GOP或按帧分流的方式播放，推流仍然是rtmp
+func (s *benchServers) playQuicFlv(ctx context.Context, b *benchRun, streamName string, tracker *bench.Tracker) error {
+	addr, closeProxy, err := s.impairAddr(b, s.quicFlvAddr, 1)
+	if err != nil {
+		return err
+	}
+	defer closeProxy()
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	session, err := quic.DialAddrContext(dialCtx, addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{quicFlv.DatagramFlvAlpn},
+	}, quicFlv.QuicConfig(s.quicConfig))
+	if err != nil {
+		return fmt.Errorf("play dial failed, err:%v", err)
+	}
+	defer session.CloseWithError(quicConn.CodeNoError, "")
+	receiver, err := quicFlv.Play(session, "live/"+streamName, b.protocol, b.maxDelay)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// 播放时长到了
+			return nil
+		case tag, ok := <-receiver.Tags:
+			if !ok {
+				return fmt.Errorf("receiver closed, %v, err:%v", receiver.Stats(), receiver.Err())
+			}
+			tracker.Received(tag.TagType, tag.Timestamp, tag.Body)
+		}
+	}
+}
+
+// playMoq 经relay订阅publishMoq发布的track
+func (s *benchServers) playMoq(ctx context.Context, b *benchRun, streamName string, tracker *bench.Tracker) error {
+	addr, closeProxy, err := s.impairAddr(b, s.moqAddr, 1)
+	if err != nil {
+		return err
+	}
+	defer closeProxy()
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	session, err := moq.Dial(dialCtx, addr, &tls.Config{InsecureSkipVerify: true}, s.quicConfig, moq.RoleSubscriber)
+	if err != nil {
+		return fmt.Errorf("play dial failed, err:%v", err)
+	}
+	defer session.Close()
+	subscription, err := session.Subscribe(streamName, "flv", b.maxDelay)
+	if err != nil {
+		return err
+	}
+	tags := moq.ReadTags(subscription.Objects)
+	for {
+		select {
+		case <-ctx.Done():
+			// 播放时长到了
+			return nil
+		case tag, ok := <-tags:
+			if !ok {
+				return fmt.Errorf("subscription closed, %v, err:%v", subscription.Stats(), session.Err())
+			}
+			tracker.Received(tag.TagType, tag.Timestamp, tag.Body)
+		}
+	}
+}
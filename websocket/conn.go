@@ -0,0 +1,224 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// 只实现客户端需要的部分：发送带掩码的帧，接收不带掩码的帧，处理分片、ping和close
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// maxFrameSize 单个帧payload的上限，防止错误的长度字段导致分配过大的内存
+const maxFrameSize = 16 << 20
+
+// Stats 收到的数据消息统计
+type Stats struct {
+	Messages int64
+	Frames   int64
+	Bytes    int64
+	Pings    int64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("messages:%d, frames:%d, bytes:%d, pings:%d", s.Messages, s.Frames, s.Bytes, s.Pings)
+}
+
+// Conn 一条websocket连接，底层可以是http/1.1升级后的tcp连接，也可以是http/2的一条流(RFC 8441)。
+// Read把收到的数据消息payload依次作为字节流读出，flv over websocket的播放端就是这样拼接的
+type Conn struct {
+	// Protocol 建立websocket使用的http协议，http/1.1或h2
+	Protocol string
+
+	conn      io.ReadWriteCloser
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	closed    bool // 已发送close帧，由writeLock保护
+
+	lock    sync.Mutex
+	stats   Stats
+	pending []byte // 当前数据帧还没被Read读走的部分
+}
+
+func newConn(conn io.ReadWriteCloser, reader *bufio.Reader, protocol string) *Conn {
+	return &Conn{
+		Protocol: protocol,
+		conn:     conn,
+		reader:   reader,
+	}
+}
+
+func (c *Conn) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Read 读取数据消息的payload，对端正常关闭时返回io.EOF
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, _, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		if opcode == OpContinuation || opcode == OpText || opcode == OpBinary {
+			c.pending = payload
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// ReadMessage 读取一个完整的数据消息，分片的消息合并后返回
+func (c *Conn) ReadMessage() (byte, []byte, error) {
+	var message []byte
+	messageType := byte(0)
+	for {
+		opcode, payload, fin, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if opcode != OpContinuation {
+			messageType = opcode
+		}
+		message = append(message, payload...)
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame 读取下一个数据帧，控制帧在这里处理掉
+func (c *Conn) readFrame() (byte, []byte, bool, error) {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, nil, false, err
+		}
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, buf); err != nil {
+				return 0, nil, false, err
+			}
+			length = uint64(binary.BigEndian.Uint16(buf))
+		case 127:
+			buf := make([]byte, 8)
+			if _, err := io.ReadFull(c.reader, buf); err != nil {
+				return 0, nil, false, err
+			}
+			length = binary.BigEndian.Uint64(buf)
+		}
+		if length > maxFrameSize {
+			return 0, nil, false, fmt.Errorf("frame too large, length:%d", length)
+		}
+		var mask []byte
+		if masked {
+			// 服务端发的帧不应带掩码，兼容处理
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(c.reader, mask); err != nil {
+				return 0, nil, false, err
+			}
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, false, err
+		}
+		for i := range mask {
+			for j := i; j < len(payload); j += 4 {
+				payload[j] ^= mask[i]
+			}
+		}
+
+		switch opcode {
+		case OpPing:
+			c.lock.Lock()
+			c.stats.Pings++
+			c.lock.Unlock()
+			if err := c.WriteMessage(OpPong, payload); err != nil {
+				return 0, nil, false, err
+			}
+		case OpPong:
+		case OpClose:
+			// 回一个close，之后对端会关闭连接
+			c.WriteMessage(OpClose, payload)
+			if len(payload) >= 2 {
+				if code := binary.BigEndian.Uint16(payload); code != 1000 {
+					return 0, nil, false, fmt.Errorf("websocket closed, code:%d, reason:%s", code, payload[2:])
+				}
+			}
+			return 0, nil, false, io.EOF
+		case OpContinuation, OpText, OpBinary:
+			c.lock.Lock()
+			c.stats.Frames++
+			c.stats.Bytes += int64(len(payload))
+			if fin {
+				c.stats.Messages++
+			}
+			c.lock.Unlock()
+			return opcode, payload, fin, nil
+		default:
+			return 0, nil, false, fmt.Errorf("unknown opcode:%#x", opcode)
+		}
+	}
+}
+
+// WriteMessage 发送一个不分片的消息，客户端发送的帧都带掩码
+func (c *Conn) WriteMessage(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(payload)))
+	}
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closed {
+		return errors.New("websocket closed")
+	}
+	if opcode == OpClose {
+		c.closed = true
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		return fmt.Errorf("write websocket frame failed, err:%v", err)
+	}
+	return nil
+}
+
+// Close 发送close帧后关闭底层连接
+func (c *Conn) Close() error {
+	c.WriteMessage(OpClose, []byte{0x03, 0xe8})
+	return c.conn.Close()
+}
@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"quic_demo/timing"
+	"strings"
+)
+
+const acceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Dialer 建立websocket连接，ws/wss走http/1.1升级，Http2时wss走RFC 8441的extended CONNECT
+type Dialer struct {
+	TLSConfig *tls.Config
+	// NetDial 建立tcp连接，addr为url中的host:port，为nil时使用net.Dialer
+	NetDial func(ctx context.Context, network string, addr string) (net.Conn, error)
+	// Header 附加的请求头
+	Header http.Header
+	// Http2 通过http/2的extended CONNECT建立websocket，服务端需要在SETTINGS中开启ENABLE_CONNECT_PROTOCOL
+	Http2 bool
+	// Timing 记录tcp连接、tls握手和升级响应的耗时，可以为nil
+	Timing *timing.Recorder
+}
+
+// Dial 返回的Conn.Protocol为实际使用的http协议，响应的body为空
+func (d *Dialer) Dial(ctx context.Context, rawUrl string) (*Conn, *http.Response, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("url.Parse failed, err:%v", err)
+	}
+	secure := false
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		secure = true
+	default:
+		return nil, nil, fmt.Errorf("unsupported scheme:%s", u.Scheme)
+	}
+	if d.Http2 && !secure {
+		return nil, nil, fmt.Errorf("websocket over http/2 needs wss")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	netDial := d.NetDial
+	if netDial == nil {
+		netDial = (&net.Dialer{}).DialContext
+	}
+	d.Timing.Start(timing.PhaseTcpConnect)
+	conn, err := netDial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial failed, addr:%s, err:%v", addr, err)
+	}
+	d.Timing.End(timing.PhaseTcpConnect)
+
+	// 握手阶段跟随ctx取消
+	stop := make(chan struct{})
+	defer close(stop)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}(conn)
+
+	if secure {
+		tlsConfig := d.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		if d.Http2 {
+			tlsConfig.NextProtos = []string{"h2"}
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		d.Timing.Start(timing.PhaseTlsHandshake)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, nil, fmt.Errorf("tls handshake failed, err:%v", err)
+		}
+		d.Timing.End(timing.PhaseTlsHandshake)
+		conn = tlsConn
+		if d.Http2 && tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+			conn.Close()
+			return nil, nil, fmt.Errorf("server does not support h2, alpn:%q", tlsConn.ConnectionState().NegotiatedProtocol)
+		}
+	}
+
+	var ws *Conn
+	var resp *http.Response
+	if d.Http2 {
+		ws, resp, err = d.dialHttp2(conn, u)
+	} else {
+		ws, resp, err = d.upgrade(conn, u)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, resp, err
+	}
+	return ws, resp, nil
+}
+
+func newKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGuid))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgrade http/1.1的Upgrade握手
+func (d *Dialer) upgrade(conn net.Conn, u *url.URL) (*Conn, *http.Response, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     d.Header.Clone(),
+		Host:       u.Host,
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, nil, fmt.Errorf("write upgrade request failed, err:%v", err)
+	}
+	d.Timing.Start(timing.PhaseHttpTtfb)
+
+	reader := bufio.NewReader(conn)
+	if _, err := reader.Peek(1); err != nil {
+		return nil, nil, fmt.Errorf("read upgrade response failed, err:%v", err)
+	}
+	d.Timing.End(timing.PhaseHttpTtfb)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read upgrade response failed, err:%v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, resp, fmt.Errorf("upgrade failed, status:%s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, resp, fmt.Errorf("bad upgrade response, upgrade:%q, accept:%q",
+			resp.Header.Get("Upgrade"), resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return newConn(conn, reader, "http/1.1"), resp, nil
+}
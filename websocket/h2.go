@@ -0,0 +1,228 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"quic_demo/timing"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RFC 8441：服务端在SETTINGS里带ENABLE_CONNECT_PROTOCOL=1，客户端用:method CONNECT、
+// :protocol websocket打开一条流，响应200后流上的DATA就是websocket帧。
+// net/http的http/2客户端不支持:protocol，这里直接用Framer实现一条流的最小客户端
+
+const settingEnableConnectProtocol = http2.SettingID(0x8)
+
+// h2StreamId 连接上只有这一条流
+const h2StreamId = 1
+
+// h2Window 本端的接收窗口，读走多少就补多少
+const h2Window = 1 << 20
+
+// h2Stream 把http/2连接上的一条流包装成io.ReadWriteCloser
+type h2Stream struct {
+	conn      net.Conn
+	framer    *http2.Framer
+	writeLock sync.Mutex
+	reader    *io.PipeReader
+	writer    *io.PipeWriter
+}
+
+func (d *Dialer) dialHttp2(conn net.Conn, u *url.URL) (*Conn, *http.Response, error) {
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, nil, fmt.Errorf("write client preface failed, err:%v", err)
+	}
+	framer := http2.NewFramer(conn, bufio.NewReader(conn))
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2Window}); err != nil {
+		return nil, nil, fmt.Errorf("write settings failed, err:%v", err)
+	}
+	if err := framer.WriteWindowUpdate(0, h2Window); err != nil {
+		return nil, nil, fmt.Errorf("write window update failed, err:%v", err)
+	}
+
+	// 等服务端的第一个SETTINGS，确认支持extended CONNECT
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read settings failed, err:%v", err)
+		}
+		settings, ok := frame.(*http2.SettingsFrame)
+		if !ok || settings.IsAck() {
+			continue
+		}
+		if err := framer.WriteSettingsAck(); err != nil {
+			return nil, nil, err
+		}
+		if value, ok := settings.Value(settingEnableConnectProtocol); !ok || value != 1 {
+			return nil, nil, errors.New("server does not enable extended CONNECT (SETTINGS_ENABLE_CONNECT_PROTOCOL)")
+		}
+		break
+	}
+
+	headers := &bytes.Buffer{}
+	encoder := hpack.NewEncoder(headers)
+	path := u.RequestURI()
+	for _, field := range [][2]string{
+		{":method", http.MethodConnect},
+		{":protocol", "websocket"},
+		{":scheme", "https"},
+		{":path", path},
+		{":authority", u.Host},
+		{"sec-websocket-version", "13"},
+	} {
+		encoder.WriteField(hpack.HeaderField{Name: field[0], Value: field[1]})
+	}
+	for name, values := range d.Header {
+		for _, value := range values {
+			encoder.WriteField(hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      h2StreamId,
+		BlockFragment: headers.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		return nil, nil, fmt.Errorf("write headers failed, err:%v", err)
+	}
+	d.Timing.Start(timing.PhaseHttpTtfb)
+
+	resp, err := readH2Response(framer)
+	if err != nil {
+		return nil, resp, err
+	}
+	d.Timing.End(timing.PhaseHttpTtfb)
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, fmt.Errorf("extended CONNECT failed, status:%s", resp.Status)
+	}
+
+	stream := &h2Stream{conn: conn, framer: framer}
+	stream.reader, stream.writer = io.Pipe()
+	go stream.readLoop()
+	return newConn(stream, bufio.NewReader(stream), "h2"), resp, nil
+}
+
+// readH2Response 处理连接级的帧，直到收到流的响应头
+func readH2Response(framer *http2.Framer) (*http.Response, error) {
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return nil, fmt.Errorf("read response failed, err:%v", err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				framer.WritePing(true, f.Data)
+			}
+		case *http2.GoAwayFrame:
+			return nil, fmt.Errorf("server sent GOAWAY, code:%v", f.ErrCode)
+		case *http2.RSTStreamFrame:
+			return nil, fmt.Errorf("server reset the stream, code:%v", f.ErrCode)
+		case *http2.MetaHeadersFrame:
+			status, err := strconv.Atoi(f.PseudoValue("status"))
+			if err != nil {
+				return nil, fmt.Errorf("bad :status, err:%v", err)
+			}
+			resp := &http.Response{
+				Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+				StatusCode: status,
+				Proto:      "HTTP/2.0",
+				ProtoMajor: 2,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+			}
+			for _, field := range f.RegularFields() {
+				resp.Header.Add(field.Name, field.Value)
+			}
+			return resp, nil
+		}
+	}
+}
+
+// readLoop 把流上的DATA写入pipe，被读走之后再补充窗口
+func (s *h2Stream) readLoop() {
+	for {
+		frame, err := s.framer.ReadFrame()
+		if err != nil {
+			s.writer.CloseWithError(err)
+			return
+		}
+		switch f := frame.(type) {
+		case *http2.DataFrame:
+			if f.StreamID != h2StreamId {
+				continue
+			}
+			if len(f.Data()) > 0 {
+				if _, err := s.writer.Write(f.Data()); err != nil {
+					return
+				}
+				s.writeLock.Lock()
+				s.framer.WriteWindowUpdate(0, uint32(f.Length))
+				s.framer.WriteWindowUpdate(h2StreamId, uint32(f.Length))
+				s.writeLock.Unlock()
+			}
+			if f.StreamEnded() {
+				s.writer.Close()
+				return
+			}
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				s.writeLock.Lock()
+				s.framer.WriteSettingsAck()
+				s.writeLock.Unlock()
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				s.writeLock.Lock()
+				s.framer.WritePing(true, f.Data)
+				s.writeLock.Unlock()
+			}
+		case *http2.GoAwayFrame:
+			if f.LastStreamID < h2StreamId {
+				s.writer.CloseWithError(fmt.Errorf("server sent GOAWAY, code:%v", f.ErrCode))
+				return
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == h2StreamId {
+				s.writer.CloseWithError(fmt.Errorf("server reset the stream, code:%v", f.ErrCode))
+				return
+			}
+		}
+	}
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+// Write 客户端只发送很小的控制帧，不考虑对端的流控窗口
+func (s *h2Stream) Write(p []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if err := s.framer.WriteData(h2StreamId, false, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *h2Stream) Close() error {
+	s.writeLock.Lock()
+	s.framer.WriteRSTStream(h2StreamId, http2.ErrCodeCancel)
+	s.writeLock.Unlock()
+	s.reader.Close()
+	return s.conn.Close()
+}
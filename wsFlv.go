@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	neturl "net/url"
+	"os"
+	"quic_demo/analytics"
+	"quic_demo/flv"
+	"quic_demo/quicConn"
+	"quic_demo/resolver"
+	"quic_demo/timing"
+	"quic_demo/websocket"
+	"strconv"
+	"time"
+)
+
+func main() {
+	var url string
+	var port int
+	var h2 bool
+	var statsInterval int
+	flag.StringVar(&url, "url", "", "such as: wss://domain/live/stream.flv")
+	flag.IntVar(&port, "port", 0, "port, default the url port, 443 for wss and 80 for ws")
+	flag.BoolVar(&h2, "h2", false, "websocket over http/2 (RFC 8441 extended CONNECT), wss only")
+	flag.IntVar(&statsInterval, "statsInterval", 5, "sliding window bitrate and frame rate interval in seconds, 0 to disable")
+	var analyticsOptions analytics.Options
+	analyticsOptions.AddFlags()
+	var playerOptions analytics.PlayerOptions
+	playerOptions.AddFlags()
+	var tlsOptions quicConn.TlsOptions
+	tlsOptions.AddFlags()
+	var addrOptions resolver.Options
+	addrOptions.AddFlags()
+	flag.Parse()
+
+	if url == "" {
+		log.Fatalln("url == \"\"")
+	}
+	url2, err := neturl.Parse(url)
+	if err != nil {
+		log.Fatalf("url.Parse failed, err:%v", err)
+	}
+	secure := url2.Scheme == "wss" || url2.Scheme == "https"
+	if port == 0 {
+		port, _ = strconv.Atoi(url2.Port())
+	}
+	if port == 0 {
+		port = 80
+		if secure {
+			port = 443
+		}
+	}
+	addrs, err := addrOptions.Lookup(url2.Hostname())
+	if err != nil {
+		log.Fatalf("addrOptions.Lookup err:%v", err)
+	}
+	if len(addrs.Ips) > 1 {
+		// 多个地址时每个地址起一个子进程并发探测，输出对比表
+		resolver.PrintResults(os.Stdout, addrOptions.ProbeAll(addrs.Ips))
+		return
+	}
+	serverAddr := net.JoinHostPort(addrs.Ips[0], strconv.Itoa(port))
+
+	tlsConfig, err := tlsOptions.ClientConfig(url2.Hostname())
+	if err != nil {
+		log.Fatalf("tlsOptions.ClientConfig err:%v", err)
+	}
+
+	transport := "tcp"
+	if secure {
+		transport = "tcp+tls"
+	}
+	recorder := timing.NewRecorder(transport)
+	addrs.RecordDns(recorder)
+	netDialer := net.Dialer{}
+	dialer := &websocket.Dialer{
+		TLSConfig: tlsConfig,
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return netDialer.DialContext(ctx, network, serverAddr)
+		},
+		Http2:  h2,
+		Timing: recorder,
+	}
+	go func() {
+		recorder.Wait(timing.PhaseFirstVideoKeyframe, 10*time.Second)
+		recorder.Print(os.Stdout)
+	}()
+
+	beginTime := time.Now()
+	fmt.Printf("begin time:%d\n", beginTime.UnixNano()/1e6)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	conn, resp, err := dialer.Dial(ctx, url)
+	cancel()
+	if err != nil {
+		log.Fatalf("dialer.Dial err:%v", err)
+	}
+	defer conn.Close()
+	fmt.Printf("websocket connected, protocol:%s, status:%s\n", conn.Protocol, resp.Status)
+
+	flvParse, err := flv.NewFlvParse(conn)
+	if err != nil {
+		log.Fatalln("flv.NewFlvParse error, ", err)
+	}
+	recorder.Mark(timing.PhaseFlvHeader)
+	analyzer := analytics.NewAnalyzer(analyticsOptions)
+	analyzer.Player = analytics.NewPlayer(playerOptions, beginTime)
+	analyzer.Latency = analytics.NewLatencyMeter()
+	analyzer.PrintOnInterrupt(os.Stdout)
+	lastTime, lastStatsTime := beginTime, beginTime
+	for {
+		tagInfo, err := flvParse.ReadTag()
+		if errors.Is(err, io.EOF) {
+			analyzer.Summary().Print(os.Stdout)
+			return
+		}
+		if err != nil {
+			analyzer.Summary().Print(os.Stdout)
+			log.Fatalf("flvParse.ReadTag error, %v, err:%v", conn.Stats(), err)
+		}
+		recorder.MarkTag(tagInfo.TagType, tagInfo.Body)
+		currentTime := time.Now()
+		sample := analyzer.AddAt(currentTime, tagInfo.TagType, tagInfo.Timestamp, tagInfo.Body)
+		fmt.Printf("read tag, curr time:%d, interval:%d, type:%d, body:%d, pts:%d, jitter:%.1f, delay:%.1f\n",
+			currentTime.UnixNano()/1e6, currentTime.Sub(lastTime).Nanoseconds()/1e6, tagInfo.TagType, len(tagInfo.Body), tagInfo.Timestamp,
+			sample.JitterMs, sample.DelayMs)
+		lastTime = currentTime
+		if sample.StallMs > 0 {
+			fmt.Printf("stall, gap:%.1fms, pts:%d\n", sample.StallMs, tagInfo.Timestamp)
+		}
+		if event := sample.Player.String(); event != "" {
+			fmt.Printf("%s, pts:%d\n", event, tagInfo.Timestamp)
+		}
+		if sample.Latency != nil {
+			fmt.Printf("latency, %s, pts:%d\n", sample.Latency, tagInfo.Timestamp)
+		}
+		if statsInterval > 0 && currentTime.Sub(lastStatsTime) >= time.Duration(statsInterval)*time.Second {
+			fmt.Printf("flv stats, %s, %s\n", analyzer.WindowStats(), conn.Stats())
+			lastStatsTime = currentTime
+		}
+	}
+}